@@ -0,0 +1,290 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Seconds between saves of changes made with saveSoon
+const ACCOUNT_SAVE_INTERVAL = 10
+
+// Number of PBKDF2 iterations used for new SCRAM-SHA-256 credentials
+const SCRAM_ITERATIONS = 4096
+
+var (
+	errNoSuchAccount = errors.New("no such account")
+	errUnverified    = errors.New("account is not verified")
+)
+
+// A user account which clients can log into with SASL
+type Account struct {
+	Name         string
+	PasswordHash []byte // bcrypt
+
+	// SCRAM-SHA-256 credentials, derived from the password when it is set
+	ScramSalt       []byte
+	ScramIterations int
+	ScramStoredKey  []byte
+	ScramServerKey  []byte
+
+	// SHA-256 fingerprints of TLS client certificates for SASL EXTERNAL
+	CertFPs []string
+
+	Email      string
+	Registered int64
+
+	// Nicks grouped to this account with NickServ GROUP. The account name
+	// itself is always owned by the account, so it isn't listed here.
+	Nicks []string
+
+	// Rename users who use this account's nicks without identifying
+	Enforce bool
+
+	// Messages left for this account while it was offline
+	Memos []Memo
+
+	// Custom host set with HostServ, shown instead of a cloak while VHostOn.
+	// VHostRequest is a vhost waiting for an operator to approve it.
+	VHost        string
+	VHostOn      bool
+	VHostRequest string
+
+	// Accounts created under the "verify" registration policy can't be
+	// logged into until VERIFY is sent with the code from the outbox
+	Unverified bool
+	VerifyCode string // SHA-256 of the verification code
+}
+
+// A message sent to an account with MemoServ, or to one of its nicks while
+// nobody was using it
+type Memo struct {
+	From string // nick!user@host of the sender
+	Sent int64
+	Text string
+	Read bool
+}
+
+// All accounts on the server, saved to a JSON file whenever they change
+type AccountStore struct {
+	path     string
+	changed  bool                // changed with saveSoon since the last save
+	Accounts map[string]*Account // lowercase name => account
+}
+
+// Load accounts from a file. A missing file gives an empty store, which will
+// be created the first time an account is saved.
+func loadAccounts(path string) *AccountStore {
+	store := &AccountStore{
+		path:     path,
+		Accounts: make(map[string]*Account),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Println("No account database found, starting with no accounts")
+		return store
+	} else if err != nil {
+		log.Fatal("Couldn't read account database: ", err)
+	}
+
+	if err = json.Unmarshal(data, store); err != nil {
+		log.Fatal("Couldn't parse account database: ", err)
+	}
+
+	log.Println("Accounts Loaded")
+	return store
+}
+
+// Write every account to disk. The file is replaced atomically so a crash
+// never leaves a half-written database.
+func (a *AccountStore) save() error {
+	if len(a.path) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(a, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := a.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, a.path); err != nil {
+		return err
+	}
+
+	a.changed = false
+	return nil
+}
+
+// Mark the store as changed, for changes such as memos which happen too often
+// to rewrite the whole file each time. The event handler saves it within
+// ACCOUNT_SAVE_INTERVAL seconds.
+func (a *AccountStore) saveSoon() {
+	a.changed = true
+}
+
+// Save the store if saveSoon was used since it was last saved
+func (a *AccountStore) saveIfChanged() error {
+	if !a.changed {
+		return nil
+	}
+
+	return a.save()
+}
+
+// Look up an account by name. Account names are not case-sensitive.
+func (a *AccountStore) get(name string) (*Account, bool) {
+	acct, exists := a.Accounts[strings.ToLower(name)]
+	return acct, exists
+}
+
+// Find the account which owns a nick, either as its name or a grouped nick
+func (a *AccountStore) getByNick(nick string) (*Account, bool) {
+	if acct, exists := a.get(nick); exists {
+		return acct, true
+	}
+
+	for _, acct := range a.Accounts {
+		for _, grouped := range acct.Nicks {
+			if strings.EqualFold(grouped, nick) {
+				return acct, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Delete an account and save the store
+func (a *AccountStore) drop(acct *Account) error {
+	delete(a.Accounts, strings.ToLower(acct.Name))
+	return a.save()
+}
+
+// Find the account a TLS client certificate fingerprint belongs to
+func (a *AccountStore) getByCertFP(fp string) (*Account, bool) {
+	if len(fp) == 0 {
+		return nil, false
+	}
+
+	for _, acct := range a.Accounts {
+		for _, accountFP := range acct.CertFPs {
+			if strings.EqualFold(accountFP, fp) && !acct.Unverified {
+				return acct, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Create a new account with a password and save it
+func (a *AccountStore) create(name, password string) (*Account, error) {
+	acct, err := newAccount(name, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return acct, a.add(acct)
+}
+
+// Make an account without storing it, so it can be filled in before add
+func newAccount(name, password string) (*Account, error) {
+	acct := &Account{
+		Name:       name,
+		Registered: time.Now().Unix(),
+		Enforce:    true,
+	}
+
+	if err := acct.setPassword(password); err != nil {
+		return nil, err
+	}
+
+	return acct, nil
+}
+
+// Store a new account and save the store. If saving fails, the account
+// isn't kept.
+func (a *AccountStore) add(acct *Account) error {
+	if _, exists := a.get(acct.Name); exists {
+		return errors.New("account already exists")
+	}
+
+	key := strings.ToLower(acct.Name)
+	a.Accounts[key] = acct
+	if err := a.save(); err != nil {
+		delete(a.Accounts, key)
+		return err
+	}
+
+	return nil
+}
+
+// Set the password of an account, which also replaces its SCRAM credentials.
+// The caller is responsible for saving the store.
+func (acct *Account) setPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return err
+	}
+
+	saltedPassword, err := pbkdf2.Key(sha256.New, password, salt, SCRAM_ITERATIONS, sha256.Size)
+	if err != nil {
+		return err
+	}
+
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	acct.PasswordHash = hash
+	acct.ScramSalt = salt
+	acct.ScramIterations = SCRAM_ITERATIONS
+	acct.ScramStoredKey = storedKey[:]
+	acct.ScramServerKey = hmacSHA256(saltedPassword, []byte("Server Key"))
+
+	return nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,443 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A server ban set by an operator
+type Ban struct {
+	Mask    string // an IP address or CIDR network, or user@host for K-lines
+	Reason  string
+	SetBy   string
+	Set     int64
+	Expires int64 // 0 for a permanent ban
+}
+
+// Server bans, saved to a JSON file whenever they change. Z-lines ban IPs
+// before they can connect, and K-lines ban user@host masks when clients
+// register. Z-lines are checked by the listeners as well as the event
+// handler, so the store is locked while it's used.
+type BanStore struct {
+	mu     sync.Mutex
+	path   string
+	ZLines []*Ban
+	KLines []*Ban
+}
+
+// Load server bans from a file. A missing file gives an empty store, which
+// will be created the first time a ban is set.
+func loadBans(path string) *BanStore {
+	store := &BanStore{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Println("No ban database found, starting with no bans")
+		return store
+	} else if err != nil {
+		log.Fatal("Couldn't read ban database: ", err)
+	}
+
+	if err = json.Unmarshal(data, store); err != nil {
+		log.Fatal("Couldn't parse ban database: ", err)
+	}
+
+	log.Println("Bans Loaded")
+	return store
+}
+
+// Write every ban to disk, replacing the file atomically. The store must be
+// locked.
+func (b *BanStore) save() error {
+	if len(b.path) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := b.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, b.path)
+}
+
+// Ban an IP address or CIDR network. Setting a Z-line on a mask which already
+// has one replaces it. Returns the ban with its mask in canonical form.
+func (b *BanStore) addZLine(mask, reason, setBy string, duration time.Duration) (*Ban, error) {
+	network, ok := parseIPMask(mask)
+	if !ok {
+		return nil, errors.New("invalid IP address or network")
+	} else if ones, _ := network.Mask.Size(); ones == 0 {
+		return nil, errors.New("that would ban every IP address")
+	}
+
+	return b.add(&b.ZLines, network.String(), reason, setBy, duration)
+}
+
+// Ban a user@host mask. A mask without a user part bans every user on the
+// host. Returns the ban with its mask in canonical form.
+func (b *BanStore) addKLine(mask, reason, setBy string, duration time.Duration) (*Ban, error) {
+	mask, ok := parseUserHostMask(mask)
+	if !ok {
+		return nil, errors.New("invalid user@host mask")
+	}
+
+	return b.add(&b.KLines, mask, reason, setBy, duration)
+}
+
+// Add a ban to one of the store's lists, replacing any ban on the same mask
+func (b *BanStore) add(list *[]*Ban, mask, reason, setBy string, duration time.Duration) (*Ban, error) {
+	now := time.Now()
+	ban := &Ban{
+		Mask:   mask,
+		Reason: reason,
+		SetBy:  setBy,
+		Set:    now.Unix(),
+	}
+	if duration > 0 {
+		ban.Expires = now.Add(duration).Unix()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	*list = append(removeBan(*list, ban.Mask), ban)
+	return ban, b.save()
+}
+
+// Lift the Z-line on a mask. Returns whether there was one.
+func (b *BanStore) removeZLine(mask string) bool {
+	network, ok := parseIPMask(mask)
+	return ok && b.remove(&b.ZLines, network.String())
+}
+
+// Lift the K-line on a mask. Returns whether there was one.
+func (b *BanStore) removeKLine(mask string) bool {
+	mask, ok := parseUserHostMask(mask)
+	return ok && b.remove(&b.KLines, mask)
+}
+
+func (b *BanStore) remove(list *[]*Ban, mask string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	before := len(*list)
+	*list = removeBan(*list, mask)
+	if len(*list) == before {
+		return false
+	}
+
+	b.save()
+	return true
+}
+
+// Find the Z-line matching an IP address, if any. Expired bans are removed
+// along the way.
+func (b *BanStore) zlined(ip net.IP) *Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	for _, ban := range b.ZLines {
+		if network, ok := parseIPMask(ban.Mask); ok && network.Contains(ip) {
+			return ban
+		}
+	}
+
+	return nil
+}
+
+// Find the K-line matching a client, if any. The host part of a K-line is
+// matched against the client's IP and hostname as well as the host others
+// see.
+func (b *BanStore) klined(c *Client) *Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	for _, ban := range b.KLines {
+		if banMatches(ban.Mask, c) {
+			return ban
+		}
+	}
+
+	return nil
+}
+
+// Copies of every Z-line and K-line which hasn't expired, for STATS
+func (b *BanStore) zlines() []Ban {
+	return b.copyBans(&b.ZLines)
+}
+
+func (b *BanStore) klines() []Ban {
+	return b.copyBans(&b.KLines)
+}
+
+func (b *BanStore) copyBans(list *[]*Ban) []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	bans := make([]Ban, len(*list))
+	for i, ban := range *list {
+		bans[i] = *ban
+	}
+
+	return bans
+}
+
+// Drop expired bans. The store must be locked.
+func (b *BanStore) expire() {
+	now := time.Now().Unix()
+	changed := false
+
+	for _, list := range []*[]*Ban{&b.ZLines, &b.KLines} {
+		kept := (*list)[:0]
+		for _, ban := range *list {
+			if ban.Expires == 0 || ban.Expires > now {
+				kept = append(kept, ban)
+			}
+		}
+
+		if len(kept) != len(*list) {
+			*list = kept
+			changed = true
+		}
+	}
+
+	if changed {
+		b.save()
+	}
+}
+
+func removeBan(bans []*Ban, mask string) []*Ban {
+	kept := bans[:0]
+	for _, ban := range bans {
+		if ban.Mask != mask {
+			kept = append(kept, ban)
+		}
+	}
+	return kept
+}
+
+// Check a user@host mask, adding "*@" if there's no user part. Masks which
+// would ban every host are refused.
+func parseUserHostMask(mask string) (string, bool) {
+	mask = strings.ToLower(mask)
+	if !strings.Contains(mask, "@") {
+		mask = "*@" + mask
+	}
+
+	pair := strings.SplitN(mask, "@", 2)
+	if len(pair[0]) == 0 || strings.Trim(pair[1], "*?.:") == "" ||
+		strings.ContainsAny(mask, "!"+SPACE) || strings.Contains(pair[1], "@") {
+		return "", false
+	}
+
+	return mask, true
+}
+
+// Check if a K-line mask matches a client. A host part which is a CIDR
+// network matches every IP in it.
+func banMatches(mask string, c *Client) bool {
+	pair := strings.SplitN(mask, "@", 2)
+	if !matchMask(pair[0], c.Username) {
+		return false
+	}
+
+	if network, ok := parseIPMask(pair[1]); ok && strings.Contains(pair[1], "/") {
+		ip := net.ParseIP(c.IP())
+		return ip != nil && network.Contains(ip)
+	}
+
+	return matchMask(pair[1], c.IP()) || matchMask(pair[1], c.RealHost()) || matchMask(pair[1], c.Host())
+}
+
+// Parse an IP address or CIDR network. A single address is a network of
+// just that address.
+func parseIPMask(mask string) (*net.IPNet, bool) {
+	if strings.Contains(mask, "/") {
+		_, network, err := net.ParseCIDR(mask)
+		return network, err == nil
+	}
+
+	ip := net.ParseIP(mask)
+	if ip == nil {
+		return nil, false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, true
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, true
+}
+
+// Parse a ban duration such as "30m", "1d12h" or "3600" (seconds). "0" means
+// the ban is permanent.
+func parseBanDuration(text string) (time.Duration, bool) {
+	if len(text) == 0 {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(text); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+
+	var total time.Duration
+	number := ""
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if '0' <= c && c <= '9' {
+			number += string(c)
+			continue
+		}
+
+		unit, known := units[c]
+		n, err := strconv.Atoi(number)
+		if !known || err != nil {
+			return 0, false
+		}
+
+		total += time.Duration(n) * unit
+		number = ""
+	}
+
+	return total, len(number) == 0
+}
+
+// Describe when a ban expires, for notices and STATS
+func banExpiry(ban Ban) string {
+	if ban.Expires == 0 {
+		return "never"
+	}
+	return time.Unix(ban.Expires, 0).Format(TIMEFORMAT)
+}
+
+// Split the parameters of ZLINE or KLINE, which are an optional duration
+// and a reason
+func parseBanParams(params string) (time.Duration, string) {
+	var duration time.Duration
+	reason := params
+
+	if !strings.HasPrefix(params, COLON) {
+		pair := strings.SplitN(params, SPACE, 2)
+		if d, ok := parseBanDuration(pair[0]); ok {
+			duration = d
+			reason = ""
+			if len(pair) == 2 {
+				reason = pair[1]
+			}
+		}
+	}
+
+	reason = strings.TrimLeft(reason, COLON)
+	if len(reason) == 0 {
+		reason = "No reason given"
+	}
+
+	return duration, reason
+}
+
+// Set a Z-line from the parameters of ZLINE and disconnect everyone it
+// matches
+func (cl *Client) zline(s *ServerInfo, mask, params string, users map[string]*Client, channels map[string]*Channel) {
+	duration, reason := parseBanParams(params)
+
+	ban, err := s.bans.addZLine(mask, reason, cl.Nick, duration)
+	if ban == nil {
+		cl.sendServerNotice(s, "Invalid Z-line mask "+mask+": "+err.Error())
+		return
+	} else if err != nil {
+		log.Println("Couldn't save bans:", err)
+	}
+
+	cl.sendServerNotice(s, "Added Z-line for "+ban.Mask+", expires "+banExpiry(*ban))
+	serverNotice(s, users, SNO_BANS, cl.Nick+" added a Z-line for "+ban.Mask+
+		", expires "+banExpiry(*ban)+" ("+ban.Reason+")")
+
+	network, _ := parseIPMask(ban.Mask)
+	disconnectBanned(s, "Z-lined: "+ban.Reason, users, channels, func(u *Client) bool {
+		ip := net.ParseIP(u.IP())
+		return ip != nil && network.Contains(ip) && !s.limits.exempted(ip)
+	})
+}
+
+// Set a K-line from the parameters of KLINE and disconnect everyone it
+// matches
+func (cl *Client) kline(s *ServerInfo, mask, params string, users map[string]*Client, channels map[string]*Channel) {
+	duration, reason := parseBanParams(params)
+
+	ban, err := s.bans.addKLine(mask, reason, cl.Nick, duration)
+	if ban == nil {
+		cl.sendServerNotice(s, "Invalid K-line mask "+mask+": "+err.Error())
+		return
+	} else if err != nil {
+		log.Println("Couldn't save bans:", err)
+	}
+
+	cl.sendServerNotice(s, "Added K-line for "+ban.Mask+", expires "+banExpiry(*ban))
+	serverNotice(s, users, SNO_BANS, cl.Nick+" added a K-line for "+ban.Mask+
+		", expires "+banExpiry(*ban)+" ("+ban.Reason+")")
+
+	disconnectBanned(s, "K-lined: "+ban.Reason, users, channels, func(u *Client) bool {
+		return u.Registered && banMatches(ban.Mask, u)
+	})
+}
+
+// Disconnect every user a new ban matches
+func disconnectBanned(s *ServerInfo, reason string, users map[string]*Client,
+	channels map[string]*Channel, matches func(*Client) bool) {
+	for _, u := range users {
+		if u.service != nil || !matches(u) {
+			continue
+		}
+
+		serverNotice(s, users, SNO_BANS, "Disconnecting "+u.NoCloakString()+" ("+reason+")")
+
+		// an oper who banned themselves gets the replies to their command
+		// first, since these have to be sent before the connection closes
+		u.endLabel(s)
+		u.sendServerMessage(s, ERR_YOUREBANNEDCREEP, "You are banned from this server- "+reason)
+		u.sendError("Closing Link: " + u.Host() + " (" + reason + ")")
+		removeClient(s, u, reason, users, channels)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBanDuration(t *testing.T) {
+	for text, expected := range map[string]time.Duration{
+		"0":     0,
+		"90":    90 * time.Second,
+		"30m":   30 * time.Minute,
+		"1d12h": 36 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+	} {
+		if d, ok := parseBanDuration(text); !ok || d != expected {
+			t.Errorf("parseBanDuration(%q) = %v, %v", text, d, ok)
+		}
+	}
+
+	for _, text := range []string{"", "10x", "1d5", "h", "-5"} {
+		if _, ok := parseBanDuration(text); ok {
+			t.Errorf("parseBanDuration(%q) should fail", text)
+		}
+	}
+}
+
+func TestZLines(t *testing.T) {
+	bans := &BanStore{}
+
+	if _, err := bans.addZLine("not an ip", "bad", "oper", 0); err == nil {
+		t.Error("Z-lined an invalid mask")
+	}
+	for _, everyone := range []string{"0.0.0.0/0", "::/0"} {
+		if _, err := bans.addZLine(everyone, "bad", "oper", 0); err == nil {
+			t.Error("Z-lined every IP with", everyone)
+		}
+	}
+
+	ban, err := bans.addZLine("192.0.2.77/24", "spam", "oper", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ban.Mask != "192.0.2.0/24" {
+		t.Errorf("Z-line mask is %s, not 192.0.2.0/24", ban.Mask)
+	}
+
+	if bans.zlined(net.ParseIP("192.0.2.5")) == nil {
+		t.Error("IP in a Z-lined network wasn't banned")
+	}
+	if bans.zlined(net.ParseIP("198.51.100.1")) != nil {
+		t.Error("IP outside a Z-lined network was banned")
+	}
+
+	bans.addZLine("2001:db8::1", "spam", "oper", time.Hour)
+	if bans.zlined(net.ParseIP("2001:db8::1")) == nil {
+		t.Error("Z-lined IPv6 address wasn't banned")
+	}
+
+	// expired Z-lines are dropped
+	bans.ZLines[1].Expires = time.Now().Add(-time.Minute).Unix()
+	if bans.zlined(net.ParseIP("2001:db8::1")) != nil || len(bans.zlines()) != 1 {
+		t.Error("Expired Z-line is still used")
+	}
+
+	if !bans.removeZLine("192.0.2.0/24") || bans.zlined(net.ParseIP("192.0.2.5")) != nil {
+		t.Error("Z-line wasn't removed")
+	}
+	if bans.removeZLine("192.0.2.0/24") {
+		t.Error("Removed a Z-line which doesn't exist")
+	}
+}
+
+func TestKLines(t *testing.T) {
+	bans := &BanStore{}
+
+	for _, mask := range []string{"*@*", "*", "nick!user@host", "a@b@c"} {
+		if _, err := bans.addKLine(mask, "bad", "oper", 0); err == nil {
+			t.Errorf("K-lined the invalid mask %q", mask)
+		}
+	}
+
+	ban, err := bans.addKLine("Spammer@*.example.com", "spam", "oper", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ban.Mask != "spammer@*.example.com" {
+		t.Errorf("K-line mask is %s", ban.Mask)
+	}
+
+	cl := &Client{Username: "spammer", Cloak: "host.example.com"}
+	if bans.klined(cl) == nil {
+		t.Error("Client matching a K-line wasn't banned")
+	}
+
+	cl.Username = "someone"
+	if bans.klined(cl) != nil {
+		t.Error("Client with another username was banned")
+	}
+
+	// services and test clients without a connection are at 127.0.0.1
+	bans.addKLine("127.0.0.0/8", "local", "oper", 0)
+	if bans.klined(cl) == nil {
+		t.Error("Client in a K-lined network wasn't banned")
+	}
+
+	if !bans.removeKLine("*@127.0.0.0/8") || bans.klined(cl) != nil {
+		t.Error("K-line wasn't removed")
+	}
+	if len(bans.klines()) != 1 {
+		t.Errorf("%d K-lines left, not 1", len(bans.klines()))
+	}
+}
+
+func TestKLineDisconnects(t *testing.T) {
+	s := &ServerInfo{
+		Hostname: "irc.example.com",
+		accounts: &AccountStore{Accounts: make(map[string]*Account)},
+		bans:     &BanStore{},
+	}
+	users := make(map[string]*Client)
+	channels := make(map[string]*Channel)
+
+	oper, readOper := newPipeClient(t, "oper")
+	spammer, readSpammer := newPipeClient(t, "spammer")
+	users["oper"], users["spammer"] = oper, spammer
+
+	oper.kline(s, "spammer@example.com", "spam", users, channels)
+
+	if _, exists := users["spammer"]; exists {
+		t.Error("K-lined client wasn't removed")
+	}
+	if line := readOper(); !strings.Contains(line, "Added K-line for spammer@example.com") {
+		t.Errorf("Oper was sent %q", line)
+	}
+
+	// the numeric and ERROR are still sent after the client is removed
+	if line := readSpammer(); line != ":irc.example.com 465 spammer :You are banned from this server- K-lined: spam" {
+		t.Errorf("Banned client was sent %q", line)
+	}
+	if line := readSpammer(); !strings.HasPrefix(line, "ERROR :Closing Link: ") {
+		t.Errorf("Banned client was sent %q", line)
+	}
+}
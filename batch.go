@@ -0,0 +1,109 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+)
+
+// Max length of a label tag sent with labeled-response
+const MAX_LABEL_LEN = 64
+
+// Start a batch of messages for a client with the batch capability.
+// Returns the batch ID to tag messages with, or "" if the client doesn't
+// support batches, in which case the messages are sent on their own.
+func (c *Client) startBatch(s *ServerInfo, kind string, params ...string) string {
+	if !c.hasCap("batch") {
+		return ""
+	}
+
+	id := newMsgID()[:10]
+	line := ":" + s.Hostname + " BATCH +" + id + " " + kind
+	for _, param := range params {
+		line += " " + param
+	}
+
+	c.sendRaw(line)
+	return id
+}
+
+func (c *Client) endBatch(s *ServerInfo, id string) {
+	if len(id) > 0 {
+		c.sendRaw(":" + s.Hostname + " BATCH -" + id)
+	}
+}
+
+// Start collecting the replies to a command which was sent with a label tag,
+// so endLabel can send them back with the label
+func (c *Client) startLabel(tags map[string]string) {
+	label := tags["label"]
+	if len(label) == 0 || len(label) > MAX_LABEL_LEN || !c.hasCap("labeled-response") {
+		return
+	}
+
+	c.label = label
+	c.labeling = true
+	c.labeled = nil
+}
+
+// Send the replies collected since startLabel. No replies gets an ACK, one
+// reply gets the label, and more than one are wrapped in a labeled-response
+// batch.
+func (c *Client) endLabel(s *ServerInfo) {
+	if !c.labeling {
+		return
+	}
+
+	label, lines := c.label, c.labeled
+	c.labeling, c.label, c.labeled = false, "", nil
+
+	switch {
+	case len(lines) == 0:
+		c.sendRaw(addTag(":"+s.Hostname+" ACK", "label", label))
+	case len(lines) == 1:
+		c.sendRaw(addTag(lines[0], "label", label))
+	case !c.hasCap("batch"):
+		for _, line := range lines {
+			c.sendRaw(line)
+		}
+	default:
+		id := newMsgID()[:10]
+		c.sendRaw(addTag(":"+s.Hostname+" BATCH +"+id+" labeled-response", "label", label))
+		for _, line := range lines {
+			// lines inside a nested batch already belong to it; only the
+			// nested BATCH lines themselves join the outer batch
+			if tags, _, _ := parseTags(line); len(tags["batch"]) == 0 {
+				line = addTag(line, "batch", id)
+			}
+			c.sendRaw(line)
+		}
+		c.sendRaw(":" + s.Hostname + " BATCH -" + id)
+	}
+}
+
+// Add a tag to the front of a line which may already have tags
+func addTag(line, key, value string) string {
+	tag := "@" + key + "=" + tagEscaper.Replace(value)
+
+	if strings.HasPrefix(line, "@") {
+		return tag + ";" + line[1:]
+	}
+
+	return tag + " " + line
+}
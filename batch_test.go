@@ -0,0 +1,136 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAddTag(t *testing.T) {
+	if line := addTag(":irc PONG irc", "label", "a b"); line != `@label=a\sb :irc PONG irc` {
+		t.Errorf("Tag added as %q", line)
+	}
+
+	if line := addTag("@time=now :irc PONG irc", "batch", "1"); line != "@batch=1;time=now :irc PONG irc" {
+		t.Errorf("Tag added as %q", line)
+	}
+}
+
+func TestLabeledResponse(t *testing.T) {
+	s := &ServerInfo{Hostname: "irc.example.com"}
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	cl := NewClient(server)
+	cl.Caps["labeled-response"] = true
+	cl.Caps["batch"] = true
+	go cl.writeLoop()
+
+	reader := bufio.NewReader(client)
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimRight(line, CRLF)
+	}
+
+	// no replies
+	cl.startLabel(map[string]string{"label": "one"})
+	cl.endLabel(s)
+	if line := readLine(); line != "@label=one :irc.example.com ACK" {
+		t.Errorf("Empty response sent as %q", line)
+	}
+
+	// a single reply
+	cl.startLabel(map[string]string{"label": "two"})
+	cl.sendRaw(":irc.example.com PONG irc.example.com")
+	cl.endLabel(s)
+	if line := readLine(); line != "@label=two :irc.example.com PONG irc.example.com" {
+		t.Errorf("Single response sent as %q", line)
+	}
+
+	// several replies are batched
+	cl.startLabel(map[string]string{"label": "three"})
+	cl.sendRaw(":irc.example.com NOTICE * :first")
+	cl.sendRaw(":irc.example.com NOTICE * :second")
+	cl.endLabel(s)
+
+	start := readLine()
+	if !strings.HasPrefix(start, "@label=three :irc.example.com BATCH +") {
+		t.Fatalf("Batch started with %q", start)
+	}
+	id := strings.TrimSuffix(start[strings.Index(start, "+")+1:], " labeled-response")
+
+	for _, text := range []string{"first", "second"} {
+		if line := readLine(); line != "@batch="+id+" :irc.example.com NOTICE * :"+text {
+			t.Errorf("Batched line sent as %q", line)
+		}
+	}
+
+	if line := readLine(); line != ":irc.example.com BATCH -"+id {
+		t.Errorf("Batch ended with %q", line)
+	}
+}
+
+func TestLabeledChatHistory(t *testing.T) {
+	s := &ServerInfo{Hostname: "irc.example.com", history: loadHistory("", 100, 0)}
+	testHistoryItems(s.history, "#test", 2)
+
+	cl, readLine := newPipeClient(t, "tester", "labeled-response", "batch")
+	cl.Channels = []string{"#test"}
+	channels := map[string]*Channel{"#test": NewChannel("#test")}
+
+	cl.startLabel(map[string]string{"label": "hist"})
+	cl.chatHistory(s, "LATEST", []string{"#test", "*", "10"}, nil, channels)
+	cl.endLabel(s)
+
+	start := readLine()
+	if !strings.HasPrefix(start, "@label=hist :irc.example.com BATCH +") {
+		t.Fatalf("Batch started with %q", start)
+	}
+	outer := strings.TrimSuffix(start[strings.Index(start, "+")+1:], " labeled-response")
+
+	inner := readLine()
+	tags, rest, _ := parseTags(inner)
+	if tags["batch"] != outer || !strings.Contains(rest, " BATCH +") {
+		t.Fatalf("Nested batch started with %q", inner)
+	}
+	id := strings.Fields(rest)[2][1:]
+
+	for i := 0; i < 2; i++ {
+		line := readLine()
+		if strings.Count(line, "batch=") != 1 {
+			t.Errorf("Message has more than one batch tag: %q", line)
+		} else if tags, _, _ := parseTags(line); tags["batch"] != id {
+			t.Errorf("Message sent outside the nested batch: %q", line)
+		}
+	}
+
+	if line := readLine(); line != "@batch="+outer+" :irc.example.com BATCH -"+id {
+		t.Errorf("Nested batch ended with %q", line)
+	}
+	if line := readLine(); line != ":irc.example.com BATCH -"+outer {
+		t.Errorf("Batch ended with %q", line)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format of the time tag sent with the server-time capability
+const SERVER_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+
+// IRCv3 capabilities supported by this server, along with the value sent to
+// clients which support CAP LS 302.
+var capabilities = map[string]string{
+	"account-notify":             "",
+	"account-tag":                "",
+	"batch":                      "",
+	"chghost":                    "",
+	"draft/chathistory":          "",
+	"echo-message":               "",
+	"extended-join":              "",
+	"labeled-response":           "",
+	"draft/account-registration": REGISTRATION_CAP,
+	"message-tags":               "",
+	"sasl":                       SASL_MECHANISMS,
+	"server-time":                "",
+	"setname":                    "",
+}
+
+// Handle a CAP subcommand. Clients which start negotiation before
+// registering aren't registered until they send CAP END.
+func (c *Client) handleCap(s *ServerInfo, subcommand string, params []string) {
+	if !c.Registered && subcommand != "END" {
+		c.capNegotiating = true
+	}
+
+	switch subcommand {
+	case "LS":
+		if len(params) > 0 {
+			if version, err := strconv.Atoi(params[0]); err == nil && version >= 302 {
+				c.capVersion = 302
+			}
+		}
+
+		names := []string{}
+		for name := range capabilities {
+			if c.capVersion >= 302 && len(capabilities[name]) > 0 {
+				name += "=" + capabilities[name]
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		c.sendCap(s, "LS", strings.Join(names, SPACE))
+	case "LIST":
+		names := []string{}
+		for name := range c.Caps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		c.sendCap(s, "LIST", strings.Join(names, SPACE))
+	case "REQ":
+		requested := strings.Fields(strings.Join(params, SPACE))
+
+		// requests are all or nothing
+		for _, name := range requested {
+			if _, exists := capabilities[strings.TrimPrefix(name, "-")]; !exists {
+				c.sendCap(s, "NAK", strings.Join(requested, SPACE))
+				return
+			}
+		}
+
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(c.Caps, name[1:])
+			} else {
+				c.Caps[name] = true
+			}
+		}
+
+		c.sendCap(s, "ACK", strings.Join(requested, SPACE))
+	case "END":
+		c.capNegotiating = false
+
+		if c.sasl != nil {
+			c.sasl = nil
+			c.sendServerMessage(s, ERR_SASLABORTED, "SASL authentication aborted")
+		}
+	default:
+		c.sendServerTargetInfo(s, ERR_INVALIDCAPCMD, subcommand, "Invalid CAP command")
+	}
+}
+
+func (c *Client) sendCap(s *ServerInfo, subcommand, caps string) {
+	c.sendMessage(s.Hostname + " CAP " + c.nickOrStar() + " " + subcommand + " :" + caps)
+}
+
+// Check if a client has enabled a capability
+func (c *Client) hasCap(name string) bool {
+	return c.Caps[name]
+}
+
+// Format a time for the server-time tag
+func serverTime(t time.Time) string {
+	return t.UTC().Format(SERVER_TIME_FORMAT)
+}
@@ -0,0 +1,43 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCapVersion(t *testing.T) {
+	s := &ServerInfo{Hostname: "irc.example.com"}
+
+	tests := map[string]int{"": 0, "4": 0, "301": 0, "302": 302, "1000": 302, "abc": 0}
+	for param, want := range tests {
+		cl, readLine := newPipeClient(t, "tester")
+
+		params := []string{}
+		if len(param) > 0 {
+			params = append(params, param)
+		}
+		cl.handleCap(s, "LS", params)
+		readLine()
+
+		if cl.capVersion != want {
+			t.Errorf("CAP LS %s set version %d, not %d", param, cl.capVersion, want)
+		}
+	}
+}
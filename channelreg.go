@@ -0,0 +1,278 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Access levels on a registered channel's access list, highest first
+const (
+	ACCESS_FOUNDER  = "founder"
+	ACCESS_OP       = "op"
+	ACCESS_VOICE    = "voice"
+	ACCESS_AUTOKICK = "autokick"
+)
+
+// A channel registered with ChanServ
+type ChannelReg struct {
+	Name       string
+	Founder    string // account name
+	Registered int64
+
+	// Account names or nick!user@host masks, and the access each one has
+	Access []AccessEntry
+
+	// Modes which are always set or unset, such as "+nt-s"
+	MLock string
+
+	// Only users with op access may change the topic
+	TopicLock bool
+	Topic     string
+}
+
+type AccessEntry struct {
+	Mask  string
+	Level string
+	Added int64
+}
+
+// All registered channels, saved to a JSON file whenever they change
+type ChannelStore struct {
+	path     string
+	Channels map[string]*ChannelReg // lowercase name => channel
+}
+
+// Load registered channels from a file. A missing file gives an empty store,
+// which will be created the first time a channel is registered.
+func loadChannelStore(path string) *ChannelStore {
+	store := &ChannelStore{
+		path:     path,
+		Channels: make(map[string]*ChannelReg),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Println("No channel database found, starting with no registered channels")
+		return store
+	} else if err != nil {
+		log.Fatal("Couldn't read channel database: ", err)
+	}
+
+	if err = json.Unmarshal(data, store); err != nil {
+		log.Fatal("Couldn't parse channel database: ", err)
+	}
+
+	log.Println("Registered Channels Loaded")
+	return store
+}
+
+// Write every registered channel to disk, replacing the file atomically
+func (c *ChannelStore) save() error {
+	if len(c.path) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.path)
+}
+
+// Look up a registered channel. Channel names are not case-sensitive.
+func (c *ChannelStore) get(name string) (*ChannelReg, bool) {
+	reg, exists := c.Channels[strings.ToLower(name)]
+	return reg, exists
+}
+
+// Register a channel to an account and save it
+func (c *ChannelStore) register(name, founder string) (*ChannelReg, error) {
+	if _, exists := c.get(name); exists {
+		return nil, errors.New("channel already registered")
+	}
+
+	reg := &ChannelReg{
+		Name:       name,
+		Founder:    founder,
+		Registered: time.Now().Unix(),
+		MLock:      "+" + NO_EXTERNAL_MESSAGES + OPS_TOPIC,
+	}
+
+	c.Channels[strings.ToLower(name)] = reg
+	return reg, c.save()
+}
+
+// Delete a registered channel and save the store
+func (c *ChannelStore) drop(reg *ChannelReg) error {
+	delete(c.Channels, strings.ToLower(reg.Name))
+	return c.save()
+}
+
+// Forget a dropped account, so whoever registers the name next doesn't get
+// its access. Channels it founded go to the first account with op access, or
+// are dropped if there isn't one.
+func (c *ChannelStore) forgetAccount(name string) error {
+	for key, reg := range c.Channels {
+		access := reg.Access[:0]
+		for _, entry := range reg.Access {
+			if !strings.EqualFold(entry.Mask, name) {
+				access = append(access, entry)
+			}
+		}
+		reg.Access = access
+
+		if !strings.EqualFold(reg.Founder, name) {
+			continue
+		}
+
+		i := reg.successor()
+		if i == -1 {
+			log.Println("Dropping", reg.Name, "since its founder", name, "was dropped")
+			delete(c.Channels, key)
+			continue
+		}
+
+		log.Println("Giving", reg.Name, "to", reg.Access[i].Mask, "since its founder", name, "was dropped")
+		reg.Founder = reg.Access[i].Mask
+		reg.Access = append(reg.Access[:i], reg.Access[i+1:]...)
+	}
+
+	return c.save()
+}
+
+// The first account, not mask, on the access list with op access, or -1
+func (reg *ChannelReg) successor() int {
+	for i, entry := range reg.Access {
+		if entry.Level == ACCESS_OP && !strings.ContainsAny(entry.Mask, "!@$") {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// The highest access level a client has in this channel, or "" for none.
+// Autokick only applies to those without any other access.
+func (reg *ChannelReg) accessLevel(cl *Client) string {
+	if len(cl.Account) > 0 && strings.EqualFold(cl.Account, reg.Founder) {
+		return ACCESS_FOUNDER
+	}
+
+	level := ""
+	for _, entry := range reg.Access {
+		if !entry.matches(cl) {
+			continue
+		}
+
+		switch {
+		case entry.Level == ACCESS_OP:
+			return ACCESS_OP
+		case entry.Level == ACCESS_VOICE:
+			level = ACCESS_VOICE
+		case entry.Level == ACCESS_AUTOKICK && len(level) == 0:
+			level = ACCESS_AUTOKICK
+		}
+	}
+
+	return level
+}
+
+// Check if a client may manage this channel's settings and topic
+func (reg *ChannelReg) isOp(cl *Client) bool {
+	level := reg.accessLevel(cl)
+	return level == ACCESS_FOUNDER || level == ACCESS_OP
+}
+
+// Entries without a ! or @ are account names, anything else is a mask
+func (entry *AccessEntry) matches(cl *Client) bool {
+	if strings.ContainsAny(entry.Mask, "!@$") {
+		return cl.matchesMask(entry.Mask)
+	}
+
+	return len(cl.Account) > 0 && strings.EqualFold(entry.Mask, cl.Account)
+}
+
+// Find the access list entry for a mask
+func (reg *ChannelReg) findAccess(mask string) int {
+	for i, entry := range reg.Access {
+		if strings.EqualFold(entry.Mask, mask) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Check if MLOCK stops a flag from being set (or unset, if !adding)
+func (reg *ChannelReg) locked(mode string, adding bool) bool {
+	on, off := reg.lockedModes()
+	if adding {
+		return strings.Contains(off, mode)
+	}
+
+	return strings.Contains(on, mode)
+}
+
+// Split MLOCK into the flags which must be set and those which must not be
+func (reg *ChannelReg) lockedModes() (on, off string) {
+	adding := true
+	for _, m := range reg.MLock {
+		switch {
+		case m == '+':
+			adding = true
+		case m == '-':
+			adding = false
+		case !strings.ContainsRune(CHANMODES_FLAG, m):
+			continue
+		case adding:
+			on += string(m)
+		default:
+			off += string(m)
+		}
+	}
+
+	return on, off
+}
+
+// Bring a channel's modes in line with MLOCK
+func (reg *ChannelReg) enforceModes(ch *Channel) {
+	on, off := reg.lockedModes()
+
+	for _, m := range on {
+		if !ch.hasMode(string(m)) {
+			ch.Mode += string(m)
+		}
+	}
+	for _, m := range off {
+		ch.Mode = strings.Replace(ch.Mode, string(m), "", -1)
+	}
+}
@@ -21,19 +21,48 @@ package main
 import (
 	"container/list"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
+	MODERATED            = "m"
 	NO_EXTERNAL_MESSAGES = "n"
+	SECRET               = "s"
+	OPS_TOPIC            = "t"
 )
 
+// Channel modes grouped by the kind of parameter they take, as advertised in
+// CHANMODES: list modes, modes that always take a parameter, modes that take
+// a parameter only when set, and flags.
+const (
+	CHANMODES_LIST     = ""
+	CHANMODES_PARAM    = ""
+	CHANMODES_SETPARAM = ""
+	CHANMODES_FLAG     = MODERATED + NO_EXTERNAL_MESSAGES + SECRET + OPS_TOPIC
+)
+
+// Channel membership modes and their matching nick prefixes, highest rank
+// first, as advertised in PREFIX.
+const (
+	PREFIX_MODES   = "ov"
+	PREFIX_SYMBOLS = "@+"
+)
+
+// Max number of channel modes which may be changed by a single MODE command
+const MAXMODES = 4
+
+// Every channel mode this server knows about, as sent in RPL_MYINFO
+const CHANNEL_MODES = CHANMODES_LIST + CHANMODES_PARAM + CHANMODES_SETPARAM + CHANMODES_FLAG + PREFIX_MODES
+
 type Channel struct {
 	Name    string
 	Mode    string
 	Topic   string
 	Users   *list.List
+	Members map[*Client]string // membership modes of each user, such as "o"
 	Created int64
 }
 
@@ -41,9 +70,10 @@ type Channel struct {
 func NewChannel(name string) *Channel {
 	c := Channel{
 		Name:    name,
-		Mode:    "n",
+		Mode:    NO_EXTERNAL_MESSAGES + OPS_TOPIC,
 		Topic:   "Default Topic",
 		Users:   list.New(),
+		Members: make(map[*Client]string),
 		Created: time.Now().Unix(),
 	}
 
@@ -61,6 +91,7 @@ func (ch *Channel) removeUser(nick string) {
 		if cl, ok := (e.Value).(*Client); ok {
 			if strings.ToLower(cl.Nick) == nick { // found our user
 				ch.Users.Remove(e)
+				delete(ch.Members, cl)
 				log.Println("Removed user nick from ", ch.Name)
 				return
 			}
@@ -80,12 +111,14 @@ func (ch *Channel) sendToUsers(message string) {
 // Send a user-generated action to all users in a channel with an optional message
 // appended to the end
 func (ch *Channel) sendEvent(sender *Client, action, message string) {
+	tags := messageTags(sender, nil)
+
 	for user := ch.Users.Front(); user != nil; user = user.Next() {
 		if c, ok := (user.Value).(*Client); ok && !(c == sender && action == "PRIVMSG") {
 			if message != "" {
-				c.sendRaw(":" + sender.String() + " " + action + " " + ch.Name + " :" + message)
+				c.sendTagged(tags, ":"+sender.String()+" "+action+" "+ch.Name+" :"+message)
 			} else {
-				c.sendRaw(":" + sender.String() + " " + action + " " + ch.Name)
+				c.sendTagged(tags, ":"+sender.String()+" "+action+" "+ch.Name)
 			}
 		}
 	}
@@ -94,10 +127,16 @@ func (ch *Channel) sendEvent(sender *Client, action, message string) {
 // Send list of users in channel to recipient. This uses the
 // RPL_NAMREPLY numeric code.
 func (ch *Channel) nameReply(s *ServerInfo, recipient *Client) {
+	member := binarySearch(ch.Name, recipient.Channels) != -1
+
 	users := []string{}
 	for u := ch.Users.Front(); u != nil; u = u.Next() {
 		if cl, ok := (u.Value).(*Client); ok {
-			users = append(users, cl.Nick)
+			// invisible users are hidden from those outside the channel
+			if !member && !recipient.canSee(cl) {
+				continue
+			}
+			users = append(users, ch.prefix(cl)+cl.Nick)
 		} else {
 			log.Println("ruh roh. `nil`  in channel user list")
 		}
@@ -119,3 +158,221 @@ func (ch *Channel) nameReply(s *ServerInfo, recipient *Client) {
 func (ch *Channel) hasMode(mode string) bool {
 	return strings.Index(ch.Mode, mode) != -1
 }
+
+// Check if a user has a membership mode in this channel
+func (ch *Channel) hasMemberMode(cl *Client, mode string) bool {
+	return strings.Contains(ch.Members[cl], mode)
+}
+
+// Give or take away a membership mode. Returns false if nothing changed.
+func (ch *Channel) setMemberMode(cl *Client, mode string, adding bool) bool {
+	if adding == ch.hasMemberMode(cl, mode) {
+		return false
+	}
+
+	if adding {
+		ch.Members[cl] += mode
+	} else {
+		ch.Members[cl] = strings.Replace(ch.Members[cl], mode, "", -1)
+	}
+
+	return true
+}
+
+// The prefix symbol of a user's highest membership mode, if they have any
+func (ch *Channel) prefix(cl *Client) string {
+	for i, mode := range PREFIX_MODES {
+		if ch.hasMemberMode(cl, string(mode)) {
+			return string(PREFIX_SYMBOLS[i])
+		}
+	}
+
+	return ""
+}
+
+// Check if a user has been muted by +m
+func (ch *Channel) canSpeak(cl *Client) bool {
+	return !ch.hasMode(MODERATED) || len(ch.Members[cl]) > 0
+}
+
+// Find a user in this channel by nick
+func (ch *Channel) findUser(nick string) (*Client, bool) {
+	for u := ch.Users.Front(); u != nil; u = u.Next() {
+		if cl, ok := (u.Value).(*Client); ok && strings.EqualFold(cl.Nick, nick) {
+			return cl, true
+		}
+	}
+
+	return nil, false
+}
+
+// Send a list of channels to a client, optionally filtered. Filters are a
+// comma-separated list of channel names, masks (*, ?), negated masks (!mask)
+// and user counts (>n, <n), as advertised by ELIST=MNU.
+func (c *Client) sendList(s *ServerInfo, filter string, channels map[string]*Channel) {
+	filters := []string{}
+	for _, f := range strings.Split(filter, COMMA) {
+		if f = strings.Trim(f, SPACE); len(f) > 0 {
+			filters = append(filters, f)
+		}
+	}
+
+	names := []string{}
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c.sendServerTargetInfo(s, RPL_LISTSTART, "Channel", "Users  Name")
+	for _, name := range names {
+		ch := channels[name]
+		if ch.hasMode(SECRET) && binarySearch(ch.Name, c.Channels) == -1 {
+			continue
+		}
+
+		if ch.matchesListFilters(filters) {
+			c.sendServerTargetInfo(s, RPL_LIST, ch.Name+" "+strconv.Itoa(ch.Users.Len()), ch.Topic)
+		}
+	}
+	c.sendServerMessage(s, RPL_LISTEND, "End of /LIST")
+}
+
+// Check if a channel matches every LIST filter
+func (ch *Channel) matchesListFilters(filters []string) bool {
+	for _, f := range filters {
+		switch f[0] {
+		case '>':
+			n, err := strconv.Atoi(f[1:])
+			if err == nil && ch.Users.Len() <= n {
+				return false
+			}
+		case '<':
+			n, err := strconv.Atoi(f[1:])
+			if err == nil && ch.Users.Len() >= n {
+				return false
+			}
+		case '!':
+			if matchMask(f[1:], ch.Name) {
+				return false
+			}
+		default:
+			if !matchMask(f, ch.Name) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Apply a channel mode string such as "+o-v nick nick" and announce the
+// modes which changed to the channel as coming from `source`. Flags locked
+// with ChanServ MLOCK are left alone. Errors are sent to `cl` unless it's
+// nil, which is the case for changes made by services.
+func (ch *Channel) applyModes(s *ServerInfo, source string, cl *Client, modes string, params []string) {
+	reg, registered := s.registered.get(ch.Name)
+
+	adding := true
+	sign := ""
+	change, args := "", []string{}
+	changes := 0
+
+	record := func(mode, arg string) {
+		next := "-"
+		if adding {
+			next = "+"
+		}
+		if next != sign {
+			change += next
+			sign = next
+		}
+
+		change += mode
+		if len(arg) > 0 {
+			args = append(args, arg)
+		}
+	}
+
+	for _, m := range modes {
+		mode := string(m)
+
+		switch {
+		case m == '+':
+			adding = true
+		case m == '-':
+			adding = false
+		case strings.Contains(PREFIX_MODES, mode):
+			if len(params) == 0 {
+				continue
+			}
+			nick := params[0]
+			params = params[1:]
+
+			if changes >= MAXMODES {
+				continue
+			}
+			changes++
+
+			target, member := ch.findUser(nick)
+			if !member {
+				if cl != nil {
+					cl.sendServerTargetInfo(s, ERR_USERNOTINCHANNEL, nick+" "+ch.Name, "They aren't on that channel")
+				}
+				continue
+			}
+
+			if ch.setMemberMode(target, mode, adding) {
+				record(mode, target.Nick)
+			}
+		case strings.Contains(CHANMODES_FLAG, mode):
+			if registered && reg.locked(mode, adding) {
+				continue
+			}
+
+			if adding && !ch.hasMode(mode) {
+				ch.Mode += mode
+				record(mode, "")
+			} else if !adding && ch.hasMode(mode) {
+				ch.Mode = strings.Replace(ch.Mode, mode, "", -1)
+				record(mode, "")
+			}
+		default:
+			if cl != nil {
+				cl.sendServerTargetInfo(s, ERR_UNKNOWNMODE, mode, "is unknown mode char to me for "+ch.Name)
+			}
+		}
+	}
+
+	if len(change) == 0 {
+		return
+	}
+
+	line := source + " MODE " + ch.Name + " " + change
+	if len(args) > 0 {
+		line += " " + strings.Join(args, SPACE)
+	}
+	ch.sendToUsers(line)
+}
+
+// Relay a PRIVMSG, NOTICE or TAGMSG to everyone else in a channel. If `status` is a
+// prefix symbol, only users with that prefix or a higher one get it, such as
+// every op and voiced user for "+".
+func (ch *Channel) relay(sender *Client, tags map[string]string, command, status, message string) {
+	rank := strings.Index(PREFIX_SYMBOLS, status)
+
+	for user := ch.Users.Front(); user != nil; user = user.Next() {
+		c, ok := (user.Value).(*Client)
+		if !ok || c == sender {
+			continue
+		}
+
+		if len(status) > 0 {
+			prefix := ch.prefix(c)
+			if len(prefix) == 0 || strings.Index(PREFIX_SYMBOLS, prefix) > rank {
+				continue
+			}
+		}
+
+		c.relayTo(tags, sender, command, status+ch.Name, message)
+	}
+}
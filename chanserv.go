@@ -0,0 +1,282 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+var chanServHelp = []string{
+	"ChanServ lets you register channels and keep their ops and settings.",
+	"  REGISTER <#channel>                     - Register a channel you're an op in",
+	"  DROP <#channel>                         - Unregister a channel",
+	"  INFO <#channel>                         - Show information about a channel",
+	"  ACCESS <#channel> LIST                  - Show the access list",
+	"  ACCESS <#channel> ADD <account|mask> <op|voice|autokick>",
+	"  ACCESS <#channel> DEL <account|mask>    - Change the access list",
+	"  SET <#channel> MLOCK <modes>            - Lock channel modes, such as +nt-s",
+	"  SET <#channel> TOPICLOCK <ON|OFF>       - Only let ops change the topic",
+}
+
+func chanServ(s *ServerInfo, service, sender *Client, message string,
+	users map[string]*Client, channels map[string]*Channel) {
+	command, params := serviceCommand(message)
+
+	if command == "HELP" || command == "" {
+		for _, line := range chanServHelp {
+			service.notice(sender, line)
+		}
+		return
+	}
+
+	if len(params) < 1 {
+		service.notice(sender, "Syntax: "+command+" <#channel>. Send HELP for a list of commands.")
+		return
+	}
+
+	name := params[0]
+	reg, registered := s.registered.get(name)
+
+	// everything but REGISTER needs a registered channel
+	if command != "REGISTER" && !registered {
+		service.notice(sender, name+" is not registered")
+		return
+	}
+
+	switch command {
+	case "REGISTER":
+		ch, exists := channels[name]
+		if len(sender.Account) == 0 {
+			service.notice(sender, "You must identify with NickServ before registering channels")
+		} else if registered {
+			service.notice(sender, reg.Name+" is already registered to "+reg.Founder)
+		} else if !exists || !ch.hasMemberMode(sender, "o") {
+			service.notice(sender, "You must be an op in "+name+" to register it")
+		} else {
+			reg, err := s.registered.register(ch.Name, sender.Account)
+			if err != nil {
+				log.Println("Couldn't register channel", ch.Name, err)
+				service.notice(sender, "Couldn't register "+ch.Name)
+				return
+			}
+
+			reg.Topic = ch.Topic
+			s.registered.save()
+
+			log.Println(sender.Account, "registered", ch.Name)
+			service.notice(sender, ch.Name+" is now registered to "+sender.Account)
+			reg.applyMLock(s, service, ch)
+		}
+	case "DROP":
+		if !strings.EqualFold(sender.Account, reg.Founder) && !sender.hasMode("o") {
+			service.notice(sender, "Only the founder of "+reg.Name+" may drop it")
+			return
+		}
+
+		s.registered.drop(reg)
+		service.notice(sender, reg.Name+" has been dropped")
+	case "INFO":
+		topicLock := "OFF"
+		if reg.TopicLock {
+			topicLock = "ON"
+		}
+
+		service.notice(sender, "Information on "+reg.Name+":")
+		service.notice(sender, "  Founder: "+reg.Founder)
+		service.notice(sender, "  Registered: "+time.Unix(reg.Registered, 0).Format(TIMEFORMAT))
+		service.notice(sender, "  Mode lock: "+reg.MLock)
+		service.notice(sender, "  Topic lock: "+topicLock)
+	case "ACCESS":
+		chanServAccess(s, service, sender, reg, params[1:])
+	case "SET":
+		if !reg.isOp(sender) {
+			service.notice(sender, "Access denied")
+			return
+		}
+
+		if len(params) != 3 {
+			service.notice(sender, "Syntax: SET <#channel> <MLOCK|TOPICLOCK> <value>")
+			return
+		}
+
+		switch strings.ToUpper(params[1]) {
+		case "MLOCK":
+			reg.MLock = params[2]
+			on, off := reg.lockedModes()
+			reg.MLock = ""
+			if len(on) > 0 {
+				reg.MLock += "+" + on
+			}
+			if len(off) > 0 {
+				reg.MLock += "-" + off
+			}
+
+			s.registered.save()
+			service.notice(sender, "Mode lock for "+reg.Name+" is now "+reg.MLock)
+
+			if ch, exists := channels[reg.Name]; exists {
+				reg.applyMLock(s, service, ch)
+			}
+		case "TOPICLOCK":
+			switch strings.ToUpper(params[2]) {
+			case "ON":
+				reg.TopicLock = true
+			case "OFF":
+				reg.TopicLock = false
+			default:
+				service.notice(sender, "Syntax: SET <#channel> TOPICLOCK <ON|OFF>")
+				return
+			}
+
+			s.registered.save()
+			service.notice(sender, "Topic lock for "+reg.Name+" is now "+strings.ToUpper(params[2]))
+		default:
+			service.notice(sender, "Syntax: SET <#channel> <MLOCK|TOPICLOCK> <value>")
+		}
+	default:
+		service.notice(sender, "Unknown command "+command+". Send HELP for a list of commands.")
+	}
+}
+
+// Handle ACCESS <#channel> <LIST|ADD|DEL> [mask] [level]. Ops may change
+// voice and autokick entries, but only the founder may change ops.
+func chanServAccess(s *ServerInfo, service, sender *Client, reg *ChannelReg, params []string) {
+	if len(params) == 0 {
+		params = []string{"LIST"}
+	}
+
+	if !reg.isOp(sender) {
+		service.notice(sender, "Access denied")
+		return
+	}
+	founder := reg.accessLevel(sender) == ACCESS_FOUNDER
+
+	switch strings.ToUpper(params[0]) {
+	case "LIST":
+		service.notice(sender, "Access list for "+reg.Name+":")
+		service.notice(sender, "  "+reg.Founder+" "+ACCESS_FOUNDER)
+		for _, entry := range reg.Access {
+			service.notice(sender, "  "+entry.Mask+" "+entry.Level)
+		}
+		service.notice(sender, "End of access list")
+	case "ADD":
+		if len(params) != 3 {
+			service.notice(sender, "Syntax: ACCESS <#channel> ADD <account|mask> <op|voice|autokick>")
+			return
+		}
+
+		mask, level := params[1], strings.ToLower(params[2])
+		if level != ACCESS_OP && level != ACCESS_VOICE && level != ACCESS_AUTOKICK {
+			service.notice(sender, "Access level must be op, voice or autokick")
+			return
+		}
+
+		i := reg.findAccess(mask)
+		if (level == ACCESS_OP || (i != -1 && reg.Access[i].Level == ACCESS_OP)) && !founder {
+			service.notice(sender, "Only the founder may change ops")
+			return
+		}
+
+		if i == -1 {
+			reg.Access = append(reg.Access, AccessEntry{Mask: mask, Level: level, Added: time.Now().Unix()})
+		} else {
+			reg.Access[i].Level = level
+		}
+
+		s.registered.save()
+		service.notice(sender, mask+" now has "+level+" access in "+reg.Name)
+	case "DEL":
+		if len(params) != 2 {
+			service.notice(sender, "Syntax: ACCESS <#channel> DEL <account|mask>")
+			return
+		}
+
+		i := reg.findAccess(params[1])
+		if i == -1 {
+			service.notice(sender, params[1]+" isn't on the access list")
+			return
+		} else if reg.Access[i].Level == ACCESS_OP && !founder {
+			service.notice(sender, "Only the founder may change ops")
+			return
+		}
+
+		reg.Access = append(reg.Access[:i], reg.Access[i+1:]...)
+		s.registered.save()
+		service.notice(sender, params[1]+" has been removed from the access list of "+reg.Name)
+	default:
+		service.notice(sender, "Syntax: ACCESS <#channel> <LIST|ADD|DEL> [account|mask] [level]")
+	}
+}
+
+// Set up a channel which is being created. Registered channels get back
+// their topic and locked modes, and anyone else's channel is run by the
+// first user to join it.
+func setupChannel(s *ServerInfo, ch *Channel, founder *Client) {
+	reg, registered := s.registered.get(ch.Name)
+	if !registered {
+		ch.setMemberMode(founder, "o", true)
+		return
+	}
+
+	if len(reg.Topic) > 0 {
+		ch.Topic = reg.Topic
+	}
+	reg.enforceModes(ch)
+}
+
+// Check if a user may join a registered channel, which they can't if they
+// match an autokick entry.
+func canJoin(s *ServerInfo, ch string, cl *Client) bool {
+	reg, registered := s.registered.get(ch)
+	return !registered || reg.accessLevel(cl) != ACCESS_AUTOKICK
+}
+
+// Give ops or voice to a user who has just joined a registered channel
+func autoOp(s *ServerInfo, ch *Channel, cl *Client, users map[string]*Client) {
+	reg, registered := s.registered.get(ch.Name)
+	chanserv, exists := users["chanserv"]
+	if !registered || !exists {
+		return
+	}
+
+	switch reg.accessLevel(cl) {
+	case ACCESS_FOUNDER, ACCESS_OP:
+		ch.applyModes(s, chanserv.String(), nil, "+o", []string{cl.Nick})
+	case ACCESS_VOICE:
+		ch.applyModes(s, chanserv.String(), nil, "+v", []string{cl.Nick})
+	}
+}
+
+// Check if a user may change the topic of a channel, according to +t and
+// TOPICLOCK
+func canChangeTopic(s *ServerInfo, ch *Channel, cl *Client) bool {
+	if reg, registered := s.registered.get(ch.Name); registered && reg.TopicLock && !reg.isOp(cl) {
+		return false
+	}
+
+	return !ch.hasMode(OPS_TOPIC) || ch.hasMemberMode(cl, "o")
+}
+
+// Set the modes locked by MLOCK on a channel, announced by ChanServ
+func (reg *ChannelReg) applyMLock(s *ServerInfo, chanserv *Client, ch *Channel) {
+	on, off := reg.lockedModes()
+	ch.applyModes(s, chanserv.String(), nil, "+"+on+"-"+off, nil)
+}
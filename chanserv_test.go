@@ -0,0 +1,88 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestChanServ(t *testing.T) {
+	s := &ServerInfo{
+		Hostname:   "irc.example.com",
+		registered: &ChannelStore{Channels: make(map[string]*ChannelReg)},
+	}
+	users := make(map[string]*Client)
+	channels := make(map[string]*Channel)
+
+	chanserv := newService(s, "ChanServ", chanServ)
+	addService(users, chanserv)
+
+	founder := newTestClient()
+	founder.Account = "tester"
+
+	ch := NewChannel("#test")
+	ch.Users.PushBack(founder)
+	setupChannel(s, ch, founder)
+	channels["#test"] = ch
+
+	if !ch.hasMemberMode(founder, "o") {
+		t.Fatal("First user in an unregistered channel wasn't opped")
+	}
+
+	chanServ(s, chanserv, founder, "REGISTER #test", users, channels)
+	reg, registered := s.registered.get("#TEST")
+	if !registered || reg.Founder != "tester" {
+		t.Fatal("REGISTER didn't register the channel")
+	}
+
+	// MLOCK stops ops from removing locked modes
+	ch.applyModes(s, founder.String(), founder, "-t+m", nil)
+	if !ch.hasMode(OPS_TOPIC) || !ch.hasMode(MODERATED) {
+		t.Errorf("MLOCK wasn't enforced, modes are +%s", ch.Mode)
+	}
+
+	chanServ(s, chanserv, founder, "SET #test MLOCK +ns-m", users, channels)
+	if reg.MLock != "+ns-m" || ch.hasMode(MODERATED) || !ch.hasMode(SECRET) {
+		t.Errorf("SET MLOCK wasn't applied, lock is %s and modes are +%s", reg.MLock, ch.Mode)
+	}
+
+	other := newTestClient()
+	other.Nick = "other"
+	other.Username = "someone"
+	other.Cloak = "example.com"
+
+	chanServ(s, chanserv, founder, "ACCESS #test ADD other!*@* autokick", users, channels)
+	if canJoin(s, "#test", other) {
+		t.Error("Autokicked user may join")
+	}
+
+	other.Account = "friend"
+	chanServ(s, chanserv, founder, "ACCESS #test ADD friend op", users, channels)
+	if reg.accessLevel(other) != ACCESS_OP || !canJoin(s, "#test", other) {
+		t.Error("Op access didn't override autokick")
+	}
+
+	// the topic and modes come back when the channel is created again
+	reg.Topic = "Saved topic"
+	recreated := NewChannel("#test")
+	setupChannel(s, recreated, other)
+	if recreated.Topic != "Saved topic" || !recreated.hasMode(SECRET) || recreated.hasMemberMode(other, "o") {
+		t.Errorf("Registered channel wasn't restored: topic %q, modes +%s", recreated.Topic, recreated.Mode)
+	}
+}
@@ -0,0 +1,275 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max messages returned by a single CHATHISTORY command
+const CHATHISTORY_LIMIT = 100
+
+// A message reference in a CHATHISTORY command: a timestamp or a msgid
+type historyRef struct {
+	time  time.Time
+	msgid string
+}
+
+// Handle CHATHISTORY <subcommand> <target> <references...> <limit>
+func (c *Client) chatHistory(s *ServerInfo, subcommand string, params []string, users map[string]*Client, channels map[string]*Channel) {
+	needed := map[string]int{"LATEST": 3, "BEFORE": 3, "AFTER": 3, "AROUND": 3, "BETWEEN": 4, "TARGETS": 3}
+	count, known := needed[subcommand]
+	if !known {
+		c.sendFail(s, "CHATHISTORY", "INVALID_PARAMS", subcommand, "Unknown subcommand")
+		return
+	} else if len(params) < count {
+		c.sendFail(s, "CHATHISTORY", "NEED_MORE_PARAMS", subcommand, "Need more parameters")
+		return
+	}
+
+	limit, err := strconv.Atoi(params[count-1])
+	if err != nil || limit < 1 {
+		c.sendFail(s, "CHATHISTORY", "INVALID_PARAMS", params[count-1], "Invalid limit")
+		return
+	} else if limit > CHATHISTORY_LIMIT {
+		limit = CHATHISTORY_LIMIT
+	}
+
+	if subcommand == "TARGETS" {
+		c.chatHistoryTargets(s, params[0], params[1], limit)
+		return
+	}
+
+	target := params[0]
+	key, ok := c.historyKey(s, target, users, channels)
+	if !ok {
+		c.sendFail(s, "CHATHISTORY", "INVALID_TARGET", subcommand+" "+target, "Messages could not be retrieved")
+		return
+	}
+
+	refs := []historyRef{}
+	for _, param := range params[1 : count-1] {
+		if subcommand == "LATEST" && param == "*" {
+			continue
+		}
+
+		ref, ok := parseHistoryRef(param)
+		if !ok {
+			c.sendFail(s, "CHATHISTORY", "INVALID_PARAMS", param, "Invalid message reference")
+			return
+		}
+		refs = append(refs, ref)
+	}
+
+	items := s.history.get(key)
+	var found []HistoryItem
+
+	switch subcommand {
+	case "LATEST":
+		if len(refs) == 0 {
+			found = latest(items, limit)
+		} else {
+			_, hi := refBounds(items, refs[0])
+			found = latest(items[hi:], limit)
+		}
+	case "BEFORE":
+		lo, _ := refBounds(items, refs[0])
+		found = latest(items[:lo], limit)
+	case "AFTER":
+		_, hi := refBounds(items, refs[0])
+		found = earliest(items[hi:], limit)
+	case "AROUND":
+		lo, _ := refBounds(items, refs[0])
+		found = latest(items[:lo], limit/2)
+		found = append(found, earliest(items[lo:], limit-len(found))...)
+	case "BETWEEN":
+		loA, hiA := refBounds(items, refs[0])
+		loB, hiB := refBounds(items, refs[1])
+		if loA <= loB {
+			found = earliest(items[hiA:max(hiA, loB)], limit)
+		} else {
+			found = latest(items[hiB:max(hiB, loA)], limit)
+		}
+	}
+
+	batch := c.startBatch(s, "chathistory", target)
+	for _, item := range found {
+		c.sendHistoryItem(item, batch)
+	}
+	c.endBatch(s, batch)
+}
+
+// Find the history buffer a client may read for a target. Clients can read
+// channels they're in, and conversations with other accounts while they're
+// logged in.
+func (c *Client) historyKey(s *ServerInfo, target string, users map[string]*Client, channels map[string]*Channel) (string, bool) {
+	if target[0] == '#' || target[0] == '&' {
+		ch, exists := channels[target]
+		if !exists || binarySearch(ch.Name, c.Channels) == -1 {
+			return "", false
+		}
+
+		return strings.ToLower(ch.Name), true
+	}
+
+	if len(c.Account) == 0 {
+		return "", false
+	}
+
+	if user, online := users[strings.ToLower(target)]; online && len(user.Account) > 0 {
+		return conversationKey(c.Account, user.Account), true
+	} else if acct, registered := s.accounts.getByNick(target); registered {
+		return conversationKey(c.Account, acct.Name), true
+	}
+
+	return "", false
+}
+
+// Handle CHATHISTORY TARGETS, which lists channels and conversations with
+// messages between two timestamps, oldest first
+func (c *Client) chatHistoryTargets(s *ServerInfo, from, to string, limit int) {
+	refA, okA := parseHistoryRef(from)
+	refB, okB := parseHistoryRef(to)
+	if !okA || !okB || len(refA.msgid) > 0 || len(refB.msgid) > 0 {
+		c.sendFail(s, "CHATHISTORY", "INVALID_PARAMS", "TARGETS", "TARGETS needs two timestamps")
+		return
+	}
+
+	start, end := refA.time, refB.time
+	if start.After(end) {
+		start, end = end, start
+	}
+
+	type target struct {
+		name   string
+		latest time.Time
+	}
+	targets := []target{}
+
+	add := func(name, key string) {
+		items := s.history.get(key)
+		if len(items) == 0 {
+			return
+		}
+
+		last := items[len(items)-1].Time
+		if !last.Before(start) && !last.After(end) {
+			targets = append(targets, target{name, last})
+		}
+	}
+
+	for _, name := range c.Channels {
+		add(name, strings.ToLower(name))
+	}
+	if len(c.Account) > 0 {
+		for key, other := range s.history.conversations(c.Account) {
+			add(other, key)
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool { return targets[i].latest.Before(targets[j].latest) })
+	if len(targets) > limit {
+		targets = targets[:limit]
+	}
+
+	batch := c.startBatch(s, "draft/chathistory-targets")
+	for _, t := range targets {
+		line := ":" + s.Hostname + " CHATHISTORY TARGETS " + t.name + " " + serverTime(t.latest)
+		if len(batch) > 0 {
+			c.sendTagged(map[string]string{"batch": batch}, line)
+		} else {
+			c.sendRaw(line)
+		}
+	}
+	c.endBatch(s, batch)
+}
+
+// Parse "timestamp=2019-01-04T14:33:26.123Z" or "msgid=abc"
+func parseHistoryRef(param string) (historyRef, bool) {
+	pair := strings.SplitN(param, "=", 2)
+	if len(pair) != 2 || len(pair[1]) == 0 {
+		return historyRef{}, false
+	}
+
+	switch pair[0] {
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339Nano, pair[1])
+		return historyRef{time: t}, err == nil
+	case "msgid":
+		return historyRef{msgid: pair[1]}, true
+	}
+
+	return historyRef{}, false
+}
+
+// Find where a reference falls in history. Messages before `lo` are before
+// the reference, and messages from `hi` on are after it. An unknown msgid
+// falls after every message.
+func refBounds(items []HistoryItem, ref historyRef) (lo, hi int) {
+	if len(ref.msgid) > 0 {
+		for i, item := range items {
+			if item.MsgID == ref.msgid {
+				return i, i + 1
+			}
+		}
+		return len(items), len(items)
+	}
+
+	lo = sort.Search(len(items), func(i int) bool { return !items[i].Time.Before(ref.time) })
+	hi = sort.Search(len(items), func(i int) bool { return items[i].Time.After(ref.time) })
+	return lo, hi
+}
+
+// The last `limit` messages
+func latest(items []HistoryItem, limit int) []HistoryItem {
+	if len(items) > limit {
+		items = items[len(items)-limit:]
+	}
+	return append([]HistoryItem(nil), items...)
+}
+
+// The first `limit` messages
+func earliest(items []HistoryItem, limit int) []HistoryItem {
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return append([]HistoryItem(nil), items...)
+}
+
+// Send the last few messages in a channel to a user who just joined it,
+// unless their client fetches history itself with CHATHISTORY
+func playHistory(s *ServerInfo, ch *Channel, cl *Client) {
+	if s.HistoryPlayback <= 0 || cl.hasCap("draft/chathistory") {
+		return
+	}
+
+	items := latest(s.history.get(strings.ToLower(ch.Name)), s.HistoryPlayback)
+	if len(items) == 0 {
+		return
+	}
+
+	batch := cl.startBatch(s, "chathistory", ch.Name)
+	for _, item := range items {
+		cl.sendHistoryItem(item, batch)
+	}
+	cl.endBatch(s, batch)
+}
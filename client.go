@@ -22,11 +22,37 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// Max number of messages waiting to be sent to a client
+const SENDQ = 1024
+
+// Seconds a leaving client has to take the rest of its messages, such as
+// the ERROR saying why it was disconnected
+const CLOSE_TIMEOUT = 5
+
+// Every user mode this server knows about, as sent in RPL_MYINFO
+const USER_MODES = "iorswZ"
+
+// User modes which only the server may set. Users may remove +o from
+// themselves, but only OPER grants it.
+const SERVER_USER_MODES = "orZ"
+
+// Server notice mask letters for user mode +s:
+// c - client connects and exits
+// f - flood disconnects
+// k - kills
+// n - nick changes
+// o - OPER attempts
+// x - server bans being set and lifted
+const SNOMASK_LETTERS = "cfknox"
+
 type Client struct {
 	Conn       net.Conn
 	Cloak      string
+	Hostname   string // checked reverse DNS name, if it has one
 	Channels   []string
 	Nick       string
 	Username   string
@@ -34,8 +60,49 @@ type Client struct {
 	LastSeen   int64 // TODO: Update on PINGs, PRIVMSG, JOIN, etc.
 	Realname   string
 	Mode       string
-	Alive      bool // NOTE: Is this even needed? It is hardly ever used
+	Snomask    string // server notices subscribed to with +s
+	Account    string // account logged into with SASL, if any
+	CertFP     string // SHA-256 fingerprint of the TLS client certificate, if any
+	Caps       map[string]bool
 	Registered bool
+	Signon     int64
+	Away       string // away message, if the user is away
+	exited     bool   // set once the client has been removed from the server
+
+	outgoing chan string // messages waiting to be written by writeLoop
+
+	// 1 while the connection is open. The connection and writer goroutines
+	// check it too, so use isAlive and markDead.
+	alive   int32
+	flood   *floodLimiter
+	limitIP net.IP // counted against per-IP connection limits until removed
+
+	capNegotiating bool   // registration waits until CAP END
+	lookups        int    // registration also waits for DNS, ident and DNSBL lookups
+	dnsblZone      string // blocklist the client's IP is listed in
+	requireSASL    bool   // the client must log in before registering
+	identUser      string
+	capVersion     int
+	sasl           *saslSession
+	passCheck      *passwordCheck // password being checked outside the event handler
+	authFailures   int            // failed password attempts on this connection
+	lastMemo       int64          // when the client last sent a memo
+
+	service serviceHandler // handles messages to internal services like NickServ
+
+	monitoring map[string]bool // lowercase nicks watched with MONITOR
+
+	// replies being collected for a command sent with a label tag
+	label    string
+	labeling bool
+	labeled  []string
+
+	// traffic counters reported by STATS l. These are touched from both the
+	// connection goroutine and the event handler, so use sync/atomic.
+	sentMsgs  int64
+	sentBytes int64
+	recvMsgs  int64
+	recvBytes int64
 }
 
 func (c *Client) sendMessage(message string) {
@@ -44,25 +111,89 @@ func (c *Client) sendMessage(message string) {
 
 // Send message to user and append CRLF to the end of the message.
 // Checks if user's connection is active as a double-check
+//
+// Messages are queued and written in order by writeLoop. A client which
+// stops reading and fills its queue is disconnected rather than blocking
+// the event handler.
 func (c *Client) sendRaw(message string) {
-	go func(cl *Client) {
-		if cl.Alive {
-			log.Println(message)
-			c.Conn.Write([]byte(message + CRLF))
-		}
-	}(c)
+	if !c.isAlive() {
+		return
+	}
+
+	if c.labeling {
+		c.labeled = append(c.labeled, message)
+		return
+	}
+
+	select {
+	case c.outgoing <- message:
+	default:
+		log.Println("SendQ exceeded for", c.String())
+		c.Conn.Close()
+	}
+}
+
+// Write queued messages to the client's connection until the queue is
+// closed, then close the connection. Messages queued before the client was
+// removed are still sent, so it gets told why it was disconnected.
+func (c *Client) writeLoop() {
+	for message := range c.outgoing {
+		log.Println(redactLine(message))
+		n, _ := c.Conn.Write([]byte(message + CRLF))
+		atomic.AddInt64(&c.sentMsgs, 1)
+		atomic.AddInt64(&c.sentBytes, int64(n))
+	}
+
+	c.Conn.Close()
+}
+
+// Whether the client's connection is still open
+func (c *Client) isAlive() bool {
+	return atomic.LoadInt32(&c.alive) == 1
+}
+
+// Stop sending anything more to the client
+func (c *Client) markDead() {
+	atomic.StoreInt32(&c.alive, 0)
+}
+
+// Queue an ERROR message before the client is removed. It skips any labeled
+// response, since the client will be gone by the time that's sent.
+func (c *Client) sendError(message string) {
+	if !c.isAlive() {
+		return
+	}
+
+	select {
+	case c.outgoing <- "ERROR :" + message:
+	default: // the SendQ is full, and the connection is closed already
+	}
 }
 
 // Send a simple server numeric message in the format of
 // :HOSTNAME 123 USERNICK :MESSAGE
 func (c *Client) sendServerMessage(s *ServerInfo, numeric int, message string) {
-	c.sendMessage(s.Hostname + " " + padNumeric(numeric) + " " + c.Nick + " :" + message)
+	c.sendMessage(s.Hostname + " " + padNumeric(numeric) + " " + c.nickOrStar() + " :" + message)
 }
 
 // Send a user information (such as a topic, user list, or ERR_NOSUCHNICK error) about a
 // target, which can be either a Channel, Nickname, or Server
 func (c *Client) sendServerTargetInfo(s *ServerInfo, numeric int, target, message string) {
-	c.sendMessage(s.Hostname + " " + padNumeric(numeric) + " " + c.Nick + " " + target + " :" + message)
+	c.sendMessage(s.Hostname + " " + padNumeric(numeric) + " " + c.nickOrStar() + " " + target + " :" + message)
+}
+
+// Send an IRCv3 standard reply FAIL message
+func (c *Client) sendFail(s *ServerInfo, command, code, context, description string) {
+	c.sendMessage(s.Hostname + " FAIL " + command + " " + code + " " + context + " :" + description)
+}
+
+// Clients without a nick yet are addressed as "*" in numeric replies
+func (c *Client) nickOrStar() string {
+	if len(c.Nick) == 0 {
+		return "*"
+	}
+
+	return c.Nick
 }
 
 func (c *Client) String() string {
@@ -75,16 +206,158 @@ func (c *Client) String() string {
 
 // Print out a user's nick, username, and host exposing personally-identifiable information
 func (c *Client) NoCloakString() string {
-	return c.Nick + "!" + c.Username + "@" + strings.Split(c.Conn.RemoteAddr().String(), COLON)[0]
+	return c.Nick + "!" + c.Username + "@" + c.RealHost()
+}
+
+// The host shown to other users, which is the cloak if there is one
+func (c *Client) Host() string {
+	if len(c.Cloak) > 0 {
+		return c.Cloak
+	}
+
+	return c.RealHost()
+}
+
+// The user's hostname if reverse DNS found one, otherwise their IP
+func (c *Client) RealHost() string {
+	if len(c.Hostname) > 0 {
+		return c.Hostname
+	}
+
+	return c.IP()
+}
+
+// The IP address a user is connecting from
+func (c *Client) IP() string {
+	if c.Conn == nil { // services don't have a connection
+		return "127.0.0.1"
+	}
+
+	host, _, err := net.SplitHostPort(c.Conn.RemoteAddr().String())
+	if err != nil {
+		return c.Conn.RemoteAddr().String()
+	}
+
+	return host
 }
 
 func NewClient(connection net.Conn) Client {
 	log.Println("New client: ", connection.RemoteAddr().String())
 	c := Client{
-		Conn:  connection,
-		Cloak: "",
-		Alive: true,
+		Conn:   connection,
+		Cloak:  "",
+		alive:  1,
+		Signon: time.Now().Unix(),
+		Caps:   make(map[string]bool),
+
+		outgoing: make(chan string, SENDQ),
 	}
 
 	return c
 }
+
+func (c *Client) hasMode(mode string) bool {
+	return strings.Index(c.Mode, mode) != -1
+}
+
+// Add a single user mode flag if the user doesn't already have it
+func (c *Client) addMode(mode string) {
+	if !c.hasMode(mode) {
+		c.Mode += mode
+	}
+}
+
+func (c *Client) hasSnomask(letter string) bool {
+	return strings.Index(c.Snomask, letter) != -1
+}
+
+// Remove a single user mode flag
+func (c *Client) removeMode(mode string) {
+	c.Mode = strings.Replace(c.Mode, mode, "", -1)
+}
+
+// Remove this client from a channel, deleting the channel if it's now empty
+func (c *Client) leaveChannel(ch *Channel, channels map[string]*Channel) {
+	if i := binarySearch(ch.Name, c.Channels); i != -1 {
+		c.Channels = append(c.Channels[:i], c.Channels[i+1:]...)
+	}
+
+	ch.removeUser(c.Nick)
+	if ch.Users.Len() == 0 {
+		delete(channels, ch.Name)
+	}
+}
+
+// Check if two clients are in at least one channel together
+func (c *Client) sharesChannel(other *Client) bool {
+	for _, ch := range c.Channels {
+		if binarySearch(ch, other.Channels) != -1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get every other client sharing a channel with this client. Each client is
+// only listed once, no matter how many channels they share.
+func (c *Client) peers(channels map[string]*Channel) []*Client {
+	seen := make(map[*Client]bool)
+	peers := []*Client{}
+
+	for _, name := range c.Channels {
+		ch, exists := channels[name]
+		if !exists {
+			continue
+		}
+
+		for u := ch.Users.Front(); u != nil; u = u.Next() {
+			if cl, ok := (u.Value).(*Client); ok && cl != c && !seen[cl] {
+				seen[cl] = true
+				peers = append(peers, cl)
+			}
+		}
+	}
+
+	return peers
+}
+
+// Tell a client and everyone sharing a channel with them about a nick change.
+// This must be called before Nick is updated.
+func (c *Client) sendNickChange(nick string, channels map[string]*Channel) {
+	message := ":" + c.String() + " NICK :" + nick
+	tags := messageTags(c, nil)
+
+	c.sendTagged(tags, message)
+	for _, peer := range c.peers(channels) {
+		peer.sendTagged(tags, message)
+	}
+}
+
+// Check if this client is allowed to see another client in WHO and NAMES
+// replies. Invisible users are only visible to users sharing a channel
+// with them, opers, and themselves.
+func (c *Client) canSee(other *Client) bool {
+	return c == other || !other.hasMode("i") || c.hasMode("o") || c.sharesChannel(other)
+}
+
+// Check if a client matches a mask. Masks may be a nick, a full
+// nick!user@host mask, or an account mask: "$a" matches any logged in
+// client and "$a:name" matches clients logged into the account "name".
+func (c *Client) matchesMask(mask string) bool {
+	if mask == "$a" {
+		return len(c.Account) > 0
+	} else if strings.HasPrefix(mask, "$a:") {
+		return len(c.Account) > 0 && matchMask(mask[3:], c.Account)
+	} else if strings.ContainsAny(mask, "!@") {
+		return matchMask(mask, c.String())
+	}
+
+	return matchMask(mask, c.Nick)
+}
+
+// Record an incoming line of `size` bytes for STATS l
+func (c *Client) countReceived(size int) {
+	atomic.AddInt64(&c.recvMsgs, 1)
+	atomic.AddInt64(&c.recvBytes, int64(size))
+}
@@ -0,0 +1,60 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendErrorWithoutReader(t *testing.T) {
+	s := &ServerInfo{
+		Hostname: "irc.example.com",
+		accounts: &AccountStore{Accounts: make(map[string]*Account)},
+	}
+	users := make(map[string]*Client)
+	channels := make(map[string]*Channel)
+
+	cl, readLine := newPipeClient(t, "tester")
+	users["tester"] = cl
+
+	// nothing reads this yet, so writeLoop is stuck writing it
+	cl.sendRaw(":irc.example.com NOTICE tester :hello")
+
+	done := make(chan struct{})
+	go func() {
+		cl.sendError("Closing Link: example.com (Killed)")
+		removeClient(s, cl, "Killed", users, channels)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Disconnecting a client which isn't reading blocked the event handler")
+	}
+
+	// what was queued is still sent before the connection closes
+	if line := readLine(); line != ":irc.example.com NOTICE tester :hello" {
+		t.Errorf("Queued message sent as %q", line)
+	}
+	if line := readLine(); line != "ERROR :Closing Link: example.com (Killed)" {
+		t.Errorf("ERROR sent as %q", line)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// Last part of every IP cloak, so cloaks are easy to recognize in bans
+const CLOAK_SUFFIX = "IP"
+
+// Make a cloak for an IP address which can't be reversed without the secret.
+// The cloak has a part for the whole address and parts for the networks it
+// belongs to, so a ban can still cover a whole network:
+//
+//	IPv4 192.0.2.10 => <address>.<192.0.2>.<192.0>.IP
+//	IPv6            => <address>:<64 bits>:<48 bits>:IP
+func cloakIP(secret, address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return cloakPart(secret, address) + "." + CLOAK_SUFFIX
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.Join([]string{
+			cloakPart(secret, ip4.String()),
+			cloakPart(secret, ip4.Mask(net.CIDRMask(24, 32)).String()+"/24"),
+			cloakPart(secret, ip4.Mask(net.CIDRMask(16, 32)).String()+"/16"),
+			CLOAK_SUFFIX,
+		}, ".")
+	}
+
+	return strings.Join([]string{
+		cloakPart(secret, ip.String()),
+		cloakPart(secret, ip.Mask(net.CIDRMask(64, 128)).String()+"/64"),
+		cloakPart(secret, ip.Mask(net.CIDRMask(48, 128)).String()+"/48"),
+		CLOAK_SUFFIX,
+	}, ":")
+}
+
+// A short keyed hash of part of an address
+func cloakPart(secret, data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil))[:8])
+}
+
+// The host a client should have: their account's vhost if it's on, or
+// "user/<account>" for logged in users if account cloaks are on, otherwise a
+// cloak of their IP if there's a secret to make one with, otherwise their
+// real IP.
+func (s *ServerInfo) cloakFor(c *Client) string {
+	if s.accounts != nil && len(c.Account) > 0 {
+		if acct, exists := s.accounts.get(c.Account); exists && acct.VHostOn && len(acct.VHost) > 0 {
+			return acct.VHost
+		}
+	}
+
+	if s.AccountCloaks && len(c.Account) > 0 {
+		return "user/" + c.Account
+	}
+
+	if len(s.CloakSecret) > 0 {
+		return cloakIP(s.CloakSecret, c.IP())
+	}
+
+	return ""
+}
+
+// Give a client the host it should have, such as after logging in or out
+func (c *Client) updateCloak(s *ServerInfo, channels map[string]*Channel) {
+	c.changeHost(s, c.Username, s.cloakFor(c), channels)
+}
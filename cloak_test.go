@@ -0,0 +1,85 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCloakIP(t *testing.T) {
+	cloak := cloakIP("secret", "192.0.2.10")
+	if cloak != cloakIP("secret", "192.0.2.10") {
+		t.Error("Cloaks for the same IP are different")
+	}
+	if strings.Contains(cloak, "192") {
+		t.Error("Cloak shows the IP:", cloak)
+	}
+	if cloak == cloakIP("other", "192.0.2.10") {
+		t.Error("Cloak doesn't depend on the secret")
+	}
+
+	parts := strings.Split(cloak, ".")
+	if len(parts) != 4 || parts[3] != CLOAK_SUFFIX {
+		t.Fatal("Wrong IPv4 cloak format:", cloak)
+	}
+
+	// same /24 shares the network parts, a different /16 shares nothing
+	same := strings.Split(cloakIP("secret", "192.0.2.99"), ".")
+	if same[0] == parts[0] || same[1] != parts[1] || same[2] != parts[2] {
+		t.Error("Wrong cloak for an address in the same /24:", same)
+	}
+	other := strings.Split(cloakIP("secret", "198.51.100.10"), ".")
+	if other[1] == parts[1] || other[2] == parts[2] {
+		t.Error("Cloak for another network shares a part:", other)
+	}
+
+	v6 := strings.Split(cloakIP("secret", "2001:db8:1:2::1"), ":")
+	near := strings.Split(cloakIP("secret", "2001:db8:1:2::2"), ":")
+	if len(v6) != 4 || v6[3] != CLOAK_SUFFIX {
+		t.Fatal("Wrong IPv6 cloak format:", v6)
+	}
+	if v6[0] == near[0] || v6[1] != near[1] || v6[2] != near[2] {
+		t.Error("Wrong cloak for an address in the same /64:", near)
+	}
+}
+
+func TestCloakFor(t *testing.T) {
+	s := &ServerInfo{}
+	cl := &Client{}
+
+	if cloak := s.cloakFor(cl); cloak != "" {
+		t.Error("Cloaked without a secret:", cloak)
+	}
+
+	s.CloakSecret = "secret"
+	if cloak := s.cloakFor(cl); cloak != cloakIP("secret", "127.0.0.1") {
+		t.Error("Wrong IP cloak:", cloak)
+	}
+
+	cl.Account = "alice"
+	if cloak := s.cloakFor(cl); cloak != cloakIP("secret", "127.0.0.1") {
+		t.Error("Used an account cloak when they're off:", cloak)
+	}
+
+	s.AccountCloaks = true
+	if cloak := s.cloakFor(cl); cloak != "user/alice" {
+		t.Error("Wrong account cloak:", cloak)
+	}
+}
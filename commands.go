@@ -19,7 +19,13 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"crypto/subtle"
+	"fmt"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,3 +38,444 @@ func (cl *Client) sendVersion(s *ServerInfo) {
 		"gochat version "+VERSION+" "+s.Hostname,
 		"(c) Copyright 2015 Camreon Conn; Licensed GNU Public License, Version 3 or Later")
 }
+
+func (cl *Client) sendTime(s *ServerInfo) {
+	cl.sendServerTargetInfo(s, RPL_TIME, s.Hostname, time.Now().Format(TIMEFORMAT))
+}
+
+func (cl *Client) sendAdmin(s *ServerInfo) {
+	cl.sendServerTargetInfo(s, RPL_ADMINME, s.Hostname, "Administrative info")
+	cl.sendServerMessage(s, RPL_ADMINLOC1, s.Admin.Location1)
+	cl.sendServerMessage(s, RPL_ADMINLOC2, s.Admin.Location2)
+	cl.sendServerMessage(s, RPL_ADMINEMAIL, s.Admin.Email)
+}
+
+func (cl *Client) sendInfo(s *ServerInfo) {
+	info := []string{
+		"gochat -- A light and speedy IRC server.",
+		"Version " + VERSION + ", built with " + runtime.Version() + " for " + runtime.GOOS + "/" + runtime.GOARCH,
+		"Copyright (C) 2015 Cameron Conn",
+		"Licensed under the GNU Public License, Version 3 or Later",
+		"https://github.com/camconn/gochat",
+		"",
+		"Running on " + s.Hostname + " since " + s.started.Format(TIMEFORMAT),
+	}
+
+	for _, line := range info {
+		cl.sendServerMessage(s, RPL_INFO, line)
+	}
+	cl.sendServerMessage(s, RPL_ENDOFINFO, "End of INFO list")
+}
+
+// Send user and channel counts. This is part of the welcome burst, but may
+// also be requested at any time with LUSERS.
+func (cl *Client) sendLusers(s *ServerInfo, users map[string]*Client, channels map[string]*Channel) {
+	total, invisible, opers := 0, 0, 0
+	for _, u := range users {
+		if !u.Registered || u.service != nil {
+			continue
+		}
+
+		total++
+		if u.hasMode("i") {
+			invisible++
+		}
+		if u.hasMode("o") {
+			opers++
+		}
+	}
+
+	if total > s.maxUsers {
+		s.maxUsers = total
+	}
+
+	current := strconv.Itoa(total)
+	max := strconv.Itoa(s.maxUsers)
+
+	cl.sendServerMessage(s, RPL_LUSERCLIENT, fmt.Sprintf("There are %d users and %d invisible on 1 servers",
+		total-invisible, invisible))
+	cl.sendServerTargetInfo(s, RPL_LUSEROP, strconv.Itoa(opers), "operator(s) online")
+	cl.sendServerTargetInfo(s, RPL_LUSERCHANNELS, strconv.Itoa(len(channels)), "channels formed")
+	cl.sendServerMessage(s, RPL_LUSERME, "I have "+current+" clients and 0 servers")
+	cl.sendServerTargetInfo(s, RPL_LOCALUSERS, current+" "+max,
+		"Current local users "+current+", max "+max)
+	cl.sendServerTargetInfo(s, RPL_GLOBALUSERS, current+" "+max,
+		"Current global users "+current+", max "+max)
+}
+
+// Send a list of users logged into the server. Invisible users are only
+// shown to opers.
+func (cl *Client) sendUsers(s *ServerInfo, users map[string]*Client) {
+	nicks := []string{}
+	for nick, u := range users {
+		if u.Registered && u.service == nil && (!u.hasMode("i") || cl.hasMode("o")) {
+			nicks = append(nicks, nick)
+		}
+	}
+	sort.Strings(nicks)
+
+	cl.sendServerMessage(s, RPL_USERSSTART, "UserID   Terminal  Host")
+	if len(nicks) == 0 {
+		cl.sendServerMessage(s, RPL_NOUSERS, "Nobody logged in")
+	}
+	for _, nick := range nicks {
+		u := users[nick]
+		cl.sendServerMessage(s, RPL_USERS, fmt.Sprintf("%-8s %-9s %-8s", u.Nick, "*", u.Host()))
+	}
+	cl.sendServerMessage(s, RPL_ENDOFUSERS, "End of users")
+}
+
+// Send server statistics for a single query letter. Only opers may use STATS.
+func (cl *Client) sendStats(s *ServerInfo, query string, users map[string]*Client) {
+	if !cl.hasMode("o") {
+		cl.sendServerMessage(s, ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+		return
+	}
+
+	if len(query) == 0 {
+		cl.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "STATS", "Need more parameters")
+		return
+	}
+	query = query[:1]
+
+	switch query {
+	case "u":
+		up := int64(time.Since(*s.started).Seconds())
+		cl.sendServerMessage(s, RPL_STATSUPTIME, fmt.Sprintf("Server Up %d days %d:%02d:%02d",
+			up/86400, (up%86400)/3600, (up%3600)/60, up%60))
+	case "m":
+		commands := []string{}
+		for name := range s.commandStats {
+			commands = append(commands, name)
+		}
+		sort.Strings(commands)
+
+		for _, name := range commands {
+			stat := s.commandStats[name]
+			cl.sendServerTargetInfo(s, RPL_STATSCOMMANDS,
+				name+" "+strconv.Itoa(stat.Count)+" "+strconv.Itoa(stat.Bytes), "0")
+		}
+	case "o":
+		names := []string{}
+		for name := range s.Opers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			cl.sendServerTargetInfo(s, RPL_STATSOLINE, "O * *", name)
+		}
+	case "b":
+		if s.dnsbl != nil {
+			for _, line := range s.dnsbl.stats() {
+				cl.sendServerTargetInfo(s, RPL_STATSDEBUG, "b", line)
+			}
+		}
+	case "k":
+		for _, ban := range s.bans.klines() {
+			pair := strings.SplitN(ban.Mask, "@", 2)
+			cl.sendServerTargetInfo(s, RPL_STATSKLINE, "K "+pair[1]+" * "+pair[0]+" "+ban.SetBy+" "+banExpiry(ban), ban.Reason)
+		}
+	case "z":
+		for _, ban := range s.bans.zlines() {
+			cl.sendServerTargetInfo(s, RPL_STATSDLINE, "Z "+ban.Mask+" "+ban.SetBy+" "+banExpiry(ban), ban.Reason)
+		}
+	case "l":
+		now := time.Now().Unix()
+		for _, u := range users {
+			if u.service != nil {
+				continue
+			}
+
+			cl.sendServerTargetInfo(s, RPL_STATSLINKINFO, fmt.Sprintf("%s[%s] %d %d %d %d %d",
+				u.Nick, u.NoCloakString(), len(u.outgoing),
+				atomic.LoadInt64(&u.sentMsgs), atomic.LoadInt64(&u.sentBytes)/1024,
+				atomic.LoadInt64(&u.recvMsgs), atomic.LoadInt64(&u.recvBytes)/1024),
+				strconv.FormatInt(now-u.Signon, 10))
+		}
+	}
+
+	cl.sendServerTargetInfo(s, RPL_ENDOFSTATS, query, "End of STATS report")
+}
+
+// Attempt to gain operator privileges with a name and password from the
+// [Opers] section of the configuration. Returns whether the attempt succeeded.
+func (cl *Client) oper(s *ServerInfo, name, password string) bool {
+	expected, exists := s.Opers[name]
+	if !exists {
+		cl.sendServerMessage(s, ERR_NOOPERHOST, "No O-lines for your host")
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		cl.sendServerMessage(s, ERR_PASSWDMISMATCH, "Password incorrect")
+		return false
+	}
+
+	cl.addMode("o")
+	cl.sendServerMessage(s, RPL_YOUREOPER, "You are now an IRC operator")
+	cl.sendRaw(":" + cl.Nick + " MODE " + cl.Nick + " :+o")
+	return true
+}
+
+// Apply a user mode string such as "+iw-s" to this client. A mode string
+// setting +s may be followed by a server notice mask such as "+ck".
+func (cl *Client) setUserModes(s *ServerInfo, modes string, params []string) {
+	adding := true
+	added, removed := "", ""
+	unknown := false
+
+	for _, m := range modes {
+		mode := string(m)
+
+		switch {
+		case m == '+':
+			adding = true
+		case m == '-':
+			adding = false
+		case !strings.Contains(USER_MODES, mode):
+			unknown = true
+		case adding && strings.Contains(SERVER_USER_MODES, mode):
+			// only the server may grant these modes
+		case !adding && mode != "o" && strings.Contains(SERVER_USER_MODES, mode):
+			// and only the server may remove them, except for +o
+		case adding:
+			if mode == "s" {
+				if !cl.hasMode("o") {
+					continue
+				}
+
+				snomask := SNOMASK_LETTERS
+				if len(params) > 0 {
+					snomask = params[0]
+					params = params[1:]
+				}
+				cl.setSnomask(s, snomask)
+			}
+
+			if !cl.hasMode(mode) {
+				cl.addMode(mode)
+				added += mode
+			}
+		default:
+			if cl.hasMode(mode) {
+				cl.removeMode(mode)
+				removed += mode
+			}
+
+			if mode == "s" || mode == "o" {
+				cl.Snomask = ""
+				if mode == "o" && cl.hasMode("s") {
+					cl.removeMode("s")
+					removed += "s"
+				}
+			}
+		}
+	}
+
+	if unknown {
+		cl.sendServerMessage(s, ERR_UMODEUNKNOWNFLAG, "Unknown MODE flag")
+	}
+
+	change := ""
+	if len(added) > 0 {
+		change += "+" + added
+	}
+	if len(removed) > 0 {
+		change += "-" + removed
+	}
+
+	if len(change) > 0 {
+		cl.sendRaw(":" + cl.Nick + " MODE " + cl.Nick + " :" + change)
+	}
+}
+
+// Update the server notice mask from a string such as "+ck-n". A mask
+// without a leading + or - replaces the current mask.
+func (cl *Client) setSnomask(s *ServerInfo, mask string) {
+	adding := true
+	if len(mask) > 0 && mask[0] != '+' && mask[0] != '-' {
+		cl.Snomask = ""
+	}
+
+	for _, m := range mask {
+		letter := string(m)
+
+		switch {
+		case m == '+':
+			adding = true
+		case m == '-':
+			adding = false
+		case !strings.Contains(SNOMASK_LETTERS, letter):
+			continue
+		case adding && !strings.Contains(cl.Snomask, letter):
+			cl.Snomask += letter
+		case !adding:
+			cl.Snomask = strings.Replace(cl.Snomask, letter, "", -1)
+		}
+	}
+
+	cl.sendServerTargetInfo(s, RPL_SNOMASK, "+"+cl.Snomask, "Server notice mask")
+}
+
+// Send WHO replies for a channel, or for every user whose nick matches a
+// mask. Invisible users are left out unless the requester can see them.
+func (cl *Client) sendWho(s *ServerInfo, mask string, users map[string]*Client, channels map[string]*Channel) {
+	if len(mask) == 0 {
+		mask = "*"
+	}
+
+	if ch, exists := channels[mask]; exists {
+		member := binarySearch(ch.Name, cl.Channels) != -1
+
+		for u := ch.Users.Front(); u != nil; u = u.Next() {
+			if user, ok := (u.Value).(*Client); ok && (member || cl.canSee(user)) {
+				cl.sendWhoReply(s, ch.Name, ch.prefix(user), user)
+			}
+		}
+	} else if mask[0] != '#' && mask[0] != '&' {
+		nicks := []string{}
+		for nick, user := range users {
+			if user.Registered && user.matchesMask(mask) && cl.canSee(user) {
+				nicks = append(nicks, nick)
+			}
+		}
+		sort.Strings(nicks)
+
+		for _, nick := range nicks {
+			cl.sendWhoReply(s, "*", "", users[nick])
+		}
+	}
+
+	cl.sendServerTargetInfo(s, RPL_ENDOFWHO, mask, "End of WHO list")
+}
+
+func (cl *Client) sendWhoReply(s *ServerInfo, channel, prefix string, user *Client) {
+	status := "H"
+	if len(user.Away) > 0 {
+		status = "G"
+	}
+	if user.hasMode("o") {
+		status += "*"
+	}
+	status += prefix
+
+	cl.sendServerTargetInfo(s, RPL_WHOREPLY,
+		strings.Join([]string{channel, user.Username, user.Host(), s.Hostname, user.Nick, status}, SPACE),
+		"0 "+user.Realname)
+}
+
+func (cl *Client) sendWhois(s *ServerInfo, nick string, users map[string]*Client) {
+	user, exists := users[strings.ToLower(nick)]
+	if !exists || !user.Registered {
+		cl.sendServerTargetInfo(s, ERR_NOSUCHNICK, nick, "No such nick")
+		cl.sendServerTargetInfo(s, RPL_ENDOFWHOIS, nick, "End of WHOIS list")
+		return
+	}
+
+	cl.sendServerTargetInfo(s, RPL_WHOISUSER, user.Nick+" "+user.Username+" "+user.Host()+" *", user.Realname)
+
+	// channels are hidden for invisible users unless they're shared
+	chans := []string{}
+	for _, ch := range user.Channels {
+		if cl == user || !user.hasMode("i") || binarySearch(ch, cl.Channels) != -1 {
+			chans = append(chans, ch)
+		}
+	}
+	if len(chans) > 0 {
+		cl.sendServerTargetInfo(s, RPL_WHOISCHANNELS, user.Nick, strings.Join(chans, SPACE))
+	}
+
+	cl.sendServerTargetInfo(s, RPL_WHOISSERVER, user.Nick+" "+s.Hostname, s.Network)
+
+	if len(user.Away) > 0 {
+		cl.sendServerTargetInfo(s, RPL_AWAY, user.Nick, user.Away)
+	}
+
+	// only opers and the user themselves can see where they really connect from
+	if cl == user || cl.hasMode("o") {
+		cl.sendServerTargetInfo(s, RPL_WHOISHOST, user.Nick, "is connecting from *@"+user.RealHost()+" "+user.IP())
+
+		if len(user.dnsblZone) > 0 && cl.hasMode("o") {
+			cl.sendServerTargetInfo(s, RPL_WHOISSPECIAL, user.Nick, "is connecting from an IP listed in "+user.dnsblZone)
+		}
+	}
+
+	if user.hasMode("o") {
+		cl.sendServerTargetInfo(s, RPL_WHOISOPERATOR, user.Nick, "is an IRC operator")
+	}
+
+	if user.hasMode("Z") {
+		cl.sendServerTargetInfo(s, RPL_WHOISSECURE, user.Nick, "is using a secure connection")
+	}
+
+	if len(user.Account) > 0 {
+		cl.sendServerTargetInfo(s, RPL_WHOISACCOUNT, user.Nick+" "+user.Account, "is logged in as")
+	}
+
+	cl.sendServerTargetInfo(s, RPL_ENDOFWHOIS, user.Nick, "End of WHOIS list")
+}
+
+// Set or clear (with an empty message) an away message
+func (cl *Client) setAway(s *ServerInfo, message string) {
+	if len(message) > AWAYLEN {
+		message = message[:AWAYLEN]
+	}
+
+	cl.Away = message
+	if len(message) > 0 {
+		cl.sendServerMessage(s, RPL_NOWAWAY, "You have been marked as being away")
+	} else {
+		cl.sendServerMessage(s, RPL_UNAWAY, "You are no longer marked as being away")
+	}
+}
+
+// Reply to ISON with the nicks which are online
+func (cl *Client) sendIson(s *ServerInfo, nicks []string, users map[string]*Client) {
+	online := []string{}
+	for _, nick := range nicks {
+		if user, exists := users[strings.ToLower(nick)]; exists && user.Registered {
+			online = append(online, user.Nick)
+		}
+	}
+
+	cl.sendServerMessage(s, RPL_ISON, strings.Join(online, SPACE))
+}
+
+// Reply to USERHOST with nick[*]=<+|->user@host for up to 5 nicks, where *
+// marks an operator and - marks someone who is away
+func (cl *Client) sendUserhost(s *ServerInfo, nicks []string, users map[string]*Client) {
+	if len(nicks) > 5 {
+		nicks = nicks[:5]
+	}
+
+	replies := []string{}
+	for _, nick := range nicks {
+		user, exists := users[strings.ToLower(nick)]
+		if !exists || !user.Registered {
+			continue
+		}
+
+		reply := user.Nick
+		if user.hasMode("o") {
+			reply += "*"
+		}
+
+		if len(user.Away) > 0 {
+			reply += "=-"
+		} else {
+			reply += "=+"
+		}
+
+		// users can see their own real host
+		if user == cl {
+			reply += user.Username + "@" + user.RealHost()
+		} else {
+			reply += user.Username + "@" + user.Host()
+		}
+
+		replies = append(replies, reply)
+	}
+
+	cl.sendServerMessage(s, RPL_USERHOST, strings.Join(replies, SPACE))
+}
@@ -0,0 +1,50 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSetUserModes(t *testing.T) {
+	s := new(ServerInfo)
+	cl := &Client{Nick: "tester"}
+
+	cl.setUserModes(s, "+iwo", nil)
+	if cl.Mode != "iw" {
+		t.Errorf("Expected modes iw, got %s", cl.Mode)
+	}
+
+	// +s requires oper
+	cl.setUserModes(s, "+s", []string{"+ck"})
+	if cl.hasMode("s") {
+		t.Error("Non-oper was able to set +s")
+	}
+
+	cl.addMode("o")
+	cl.setUserModes(s, "-i+s", []string{"+ck"})
+	if cl.hasMode("i") || !cl.hasMode("s") || cl.Snomask != "ck" {
+		t.Errorf("Bad modes after -i+s: %s +%s", cl.Mode, cl.Snomask)
+	}
+
+	cl.setUserModes(s, "-o", nil)
+	if cl.hasMode("o") || cl.hasMode("s") || cl.Snomask != "" {
+		t.Errorf("Deoper didn't remove server notices: %s +%s", cl.Mode, cl.Snomask)
+	}
+}
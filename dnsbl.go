@@ -0,0 +1,280 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What happens to a client whose IP is listed in a DNS blocklist, weakest
+// first
+const (
+	DNSBL_MARK   = "mark"         // let them in, but tell opers
+	DNSBL_SASL   = "require-sasl" // only let them in if they log in with SASL
+	DNSBL_REJECT = "reject"       // don't let them in
+)
+
+// Seconds to remember whether an IP is listed, if not set in config.ini
+const DEFAULT_DNSBL_CACHE_TIME = 3600
+
+// A DNS blocklist and what to do for each reply it can give. The reply "*"
+// matches any reply without its own action.
+type DNSBLZone struct {
+	Zone    string
+	Actions map[string]string // reply IP => action
+}
+
+// The strongest action any blocklist gave for an IP
+type dnsblResult struct {
+	Action string
+	Zone   string
+	Reply  string
+}
+
+type dnsblCacheEntry struct {
+	result  dnsblResult
+	expires time.Time
+}
+
+// Checks connecting IPs against DNS blocklists. Checks happen outside the
+// event handler, so the cache and hit counts are locked while they're used.
+type DNSBLChecker struct {
+	mu        sync.Mutex
+	zones     []DNSBLZone
+	cacheTime time.Duration
+	cache     map[string]dnsblCacheEntry // IP => result
+	hits      map[string]int             // zone => times an IP was listed
+}
+
+// Load blocklists from the [DNSBL] section of config.ini, where each key is a
+// zone and each value is a list of reply:action pairs, such as
+// "127.0.0.2:reject, 127.0.0.10:mark, *:require-sasl"
+func loadDNSBL(section map[string]string, cacheTime int) *DNSBLChecker {
+	d := &DNSBLChecker{
+		cacheTime: time.Duration(cacheTime) * time.Second,
+		cache:     make(map[string]dnsblCacheEntry),
+		hits:      make(map[string]int),
+	}
+	if d.cacheTime <= 0 {
+		d.cacheTime = DEFAULT_DNSBL_CACHE_TIME * time.Second
+	}
+
+	for zone, value := range section {
+		z := DNSBLZone{Zone: strings.Trim(strings.ToLower(zone), "."), Actions: make(map[string]string)}
+
+		for _, pair := range strings.Split(value, ",") {
+			// split on the last colon, since replies could be IPv6
+			i := strings.LastIndex(pair, ":")
+			if i < 0 {
+				log.Fatal("Invalid DNSBL action for ", zone, ": ", pair)
+			}
+
+			reply, action := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+			if action != DNSBL_MARK && action != DNSBL_SASL && action != DNSBL_REJECT {
+				log.Fatal("Unknown DNSBL action for ", zone, ": ", action)
+			}
+			z.Actions[reply] = action
+		}
+
+		d.zones = append(d.zones, z)
+	}
+
+	sort.Slice(d.zones, func(i, j int) bool { return d.zones[i].Zone < d.zones[j].Zone })
+	return d
+}
+
+// Check an IP against every blocklist at once. Results are cached, so a
+// client reconnecting doesn't cause another round of lookups.
+func (d *DNSBLChecker) check(ctx context.Context, resolver Resolver, ip net.IP) dnsblResult {
+	key := ip.String()
+
+	d.mu.Lock()
+	entry, cached := d.cache[key]
+	d.mu.Unlock()
+
+	if cached && time.Now().Before(entry.expires) {
+		d.countHit(entry.result)
+		return entry.result
+	}
+
+	results := make([]dnsblResult, len(d.zones))
+	answered := make([]bool, len(d.zones))
+	var wg sync.WaitGroup
+	for i, zone := range d.zones {
+		wg.Add(1)
+		go func(i int, zone DNSBLZone) {
+			defer wg.Done()
+			results[i], answered[i] = zone.lookup(ctx, resolver, ip)
+		}(i, zone)
+	}
+	wg.Wait()
+
+	var result dnsblResult
+	definite := true
+	for i, r := range results {
+		if actionStrength(r.Action) > actionStrength(result.Action) {
+			result = r
+		}
+		definite = definite && answered[i]
+	}
+
+	d.mu.Lock()
+	// a zone which timed out or failed might list the IP, so ask again
+	// next time
+	if definite {
+		d.cache[key] = dnsblCacheEntry{result: result, expires: time.Now().Add(d.cacheTime)}
+	}
+	for k, e := range d.cache {
+		if time.Now().After(e.expires) {
+			delete(d.cache, k)
+		}
+	}
+	d.mu.Unlock()
+
+	d.countHit(result)
+	return result
+}
+
+func (d *DNSBLChecker) countHit(result dnsblResult) {
+	if len(result.Zone) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	d.hits[result.Zone]++
+	d.mu.Unlock()
+}
+
+// Lines for STATS b: each zone and how many connecting IPs it listed
+func (d *DNSBLChecker) stats() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	lines := make([]string, len(d.zones))
+	for i, zone := range d.zones {
+		lines[i] = fmt.Sprintf("%s %d", zone.Zone, d.hits[zone.Zone])
+	}
+	return lines
+}
+
+// Look an IP up in one blocklist. An unlisted IP gives an empty result. The
+// bool is false if the blocklist didn't answer, e.g. because of a timeout, so
+// the IP may or may not be listed.
+func (z DNSBLZone) lookup(ctx context.Context, resolver Resolver, ip net.IP) (dnsblResult, bool) {
+	addrs, err := resolver.LookupHost(ctx, dnsblQuery(ip, z.Zone))
+	if err != nil {
+		var dnsErr *net.DNSError
+		return dnsblResult{}, errors.As(err, &dnsErr) && dnsErr.IsNotFound
+	}
+
+	var result dnsblResult
+	for _, reply := range addrs {
+		action, exists := z.Actions[reply]
+		if !exists {
+			action = z.Actions["*"]
+		}
+
+		if actionStrength(action) > actionStrength(result.Action) {
+			result = dnsblResult{Action: action, Zone: z.Zone, Reply: reply}
+		}
+	}
+
+	return result, true
+}
+
+// The name to look up for an IP in a blocklist: the IPv4 octets or IPv6
+// nibbles in reverse order, followed by the zone
+func dnsblQuery(ip net.IP, zone string) string {
+	var parts []string
+
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			parts = append(parts, fmt.Sprintf("%d", ip4[i]))
+		}
+	} else {
+		ip16 := ip.To16()
+		for i := len(ip16) - 1; i >= 0; i-- {
+			parts = append(parts, fmt.Sprintf("%x.%x", ip16[i]&0xf, ip16[i]>>4))
+		}
+	}
+
+	return strings.Join(parts, ".") + "." + zone
+}
+
+func actionStrength(action string) int {
+	switch action {
+	case DNSBL_MARK:
+		return 1
+	case DNSBL_SASL:
+		return 2
+	case DNSBL_REJECT:
+		return 3
+	}
+	return 0
+}
+
+// Check a new connection against the blocklists and send the result to the
+// event handler as a DNSBL event
+func (s *ServerInfo) checkDNSBL(cl *Client, events chan<- *Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.lookupTimeout())
+	defer cancel()
+
+	var result dnsblResult
+	if ip := net.ParseIP(cl.IP()); ip != nil && s.resolver != nil {
+		result = s.dnsbl.check(ctx, s.resolver, ip)
+	}
+
+	e := NewEvent(cl, "")
+	e.Type = DNSBL
+	e.Target = result.Action
+	e.Body = result.Zone + SPACE + result.Reply
+	events <- e
+}
+
+// Act on a client's blocklist result, then carry on registering them
+func (c *Client) finishDNSBL(s *ServerInfo, action, zoneReply string,
+	users map[string]*Client, channels map[string]*Channel) {
+	c.lookups--
+
+	zone := strings.SplitN(zoneReply, SPACE, 2)[0]
+	switch action {
+	case DNSBL_REJECT:
+		serverNotice(s, users, SNO_CONNECTS, "Rejected "+c.IP()+", listed in "+zone+" ("+zoneReply+")")
+
+		reason := "Your IP is listed in " + zone
+		c.sendError("Closing Link: " + c.IP() + " (" + reason + ")")
+		removeClient(s, c, reason, users, channels)
+		return
+	case DNSBL_SASL:
+		c.dnsblZone = zone
+		c.requireSASL = true
+	case DNSBL_MARK:
+		c.dnsblZone = zone
+	}
+
+	completeRegistration(s, c, users, channels)
+}
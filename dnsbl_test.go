@@ -0,0 +1,103 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDNSBLQuery(t *testing.T) {
+	if q := dnsblQuery(net.ParseIP("192.0.2.1"), "dnsbl.example"); q != "1.2.0.192.dnsbl.example" {
+		t.Error("Wrong IPv4 query:", q)
+	}
+
+	q := dnsblQuery(net.ParseIP("2001:db8::567:89ab"), "dnsbl.example")
+	if q != "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.dnsbl.example" {
+		t.Error("Wrong IPv6 query:", q)
+	}
+}
+
+// Counts lookups so tests can tell when results come from the cache. While
+// failing is set, every lookup fails like a DNS server which isn't answering.
+type countingResolver struct {
+	testResolver
+	lookups int64
+	failing bool
+}
+
+func (r *countingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	atomic.AddInt64(&r.lookups, 1)
+	if r.failing {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	return r.testResolver.LookupHost(ctx, host)
+}
+
+func TestDNSBLCheck(t *testing.T) {
+	d := loadDNSBL(map[string]string{
+		"first.example":  "127.0.0.2:reject, *:mark",
+		"second.example": "*:require-sasl",
+	}, 0)
+
+	resolver := &countingResolver{testResolver: testResolver{forward: map[string][]string{
+		"1.2.0.192.first.example":  {"127.0.0.9"},
+		"1.2.0.192.second.example": {"127.0.0.4"},
+		"2.2.0.192.first.example":  {"127.0.0.2"},
+		"3.2.0.192.first.example":  {"127.0.0.7"},
+	}}}
+	ctx := context.Background()
+
+	// the strongest action from any zone wins
+	if r := d.check(ctx, resolver, net.ParseIP("192.0.2.1")); r.Action != DNSBL_SASL || r.Zone != "second.example" {
+		t.Errorf("Wrong result for a listed IP: %+v", r)
+	}
+	if r := d.check(ctx, resolver, net.ParseIP("192.0.2.2")); r.Action != DNSBL_REJECT {
+		t.Errorf("Wrong result for a rejected IP: %+v", r)
+	}
+	if r := d.check(ctx, resolver, net.ParseIP("192.0.2.3")); r.Action != DNSBL_MARK || r.Reply != "127.0.0.7" {
+		t.Errorf("Wrong result for a marked IP: %+v", r)
+	}
+	if r := d.check(ctx, resolver, net.ParseIP("192.0.2.4")); r.Action != "" {
+		t.Errorf("Unlisted IP has a result: %+v", r)
+	}
+
+	lookups := atomic.LoadInt64(&resolver.lookups)
+	if r := d.check(ctx, resolver, net.ParseIP("192.0.2.2")); r.Action != DNSBL_REJECT || atomic.LoadInt64(&resolver.lookups) != lookups {
+		t.Error("Cached result wasn't used")
+	}
+
+	// failed lookups aren't remembered as unlisted
+	resolver.failing = true
+	if r := d.check(ctx, resolver, net.ParseIP("192.0.2.5")); r.Action != "" {
+		t.Errorf("Failed lookup has a result: %+v", r)
+	}
+	resolver.failing = false
+	resolver.forward["5.2.0.192.first.example"] = []string{"127.0.0.2"}
+	if r := d.check(ctx, resolver, net.ParseIP("192.0.2.5")); r.Action != DNSBL_REJECT {
+		t.Errorf("Failed lookup was cached: %+v", r)
+	}
+
+	stats := d.stats()
+	if len(stats) != 2 || stats[0] != "first.example 4" || stats[1] != "second.example 1" {
+		t.Errorf("Wrong hit counts: %v", stats)
+	}
+}
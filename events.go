@@ -28,33 +28,74 @@ import (
 )
 
 type Event struct {
-	Type   int
-	Sender *Client
-	Target string
-	Body   string
-	Valid  bool
+	Type    int
+	Sender  *Client
+	Command string // upper-case command name as sent by the client
+	Raw     string
+	Tags    map[string]string // IRCv3 message tags, unescaped
+	Target  string
+	Body    string
+	Valid   bool
 }
 
 const (
 	UNKNOWN = iota
 
+	ADMIN
+	AUTHENTICATE
+	AWAY
+	CAP
+	CHATHISTORY
+	CHGHOST
 	CONNECT
+	DNSBL       // internal: blocklist lookups for Sender have finished
+	ENFORCE     // internal: the nick grace period for Sender has run out
+	EXCESSFLOOD // internal: the client sent too much while being slowed down
 	HELP
+	INFO
+	INPUTTOOLONG // internal: the client sent too many message tags
+	ISON
 	JOIN
+	KILL
+	KLINE
+	LIST
+	LOOKUP // internal: DNS and ident lookups for Sender have finished
+	LUSERS
 	MODE
+	MONITOR
 	MOTD
 	MSG
+	NAMES
 	NICK
+	NOTICE
+	OPER
 	PART
 	PASS
+	PASSCHECK // internal: a password check for Sender has finished
 	PING
 	PONG
 	QUIT
+	REGISTER
 	REGISTERED
+	REHASH
 	RULES
+	SETNAME
+	STATS
+	TAGMSG
+	TIME
+	TLS // internal: Sender's TLS handshake has finished, Body is its certificate fingerprint
 	TOPIC
+	UNKLINE
+	UNZLINE
 	USER
+	USERHOST
+	USERS
+	VERIFY
 	VERSION_SERVER
+	WALLOPS
+	WHO
+	WHOIS
+	ZLINE
 )
 
 const SPACE = " "
@@ -66,6 +107,55 @@ const COMMA = ","
 // Max nick length: 16 characters
 const NICKREGEX = "^[A-Za-z0-9]([A-Za-z0-9\\.\\[\\]\\(\\)\\-\\_]){0,15}$"
 
+// Length limits advertised in RPL_ISUPPORT. NICKLEN must agree with NICKREGEX.
+const (
+	NICKLEN  = 16
+	AWAYLEN  = 390
+	TOPICLEN = 390
+	KICKLEN  = 390
+)
+
+// Commands whose parameters are passwords or codes
+var secretCommands = map[string]bool{
+	"authenticate": true,
+	"oper":         true,
+	"pass":         true,
+	"register":     true,
+	"verify":       true,
+}
+
+// Services take passwords in messages, e.g. NickServ IDENTIFY
+var serviceNicks = map[string]bool{
+	"chanserv": true,
+	"hostserv": true,
+	"memoserv": true,
+	"nickserv": true,
+}
+
+// Hide passwords in a raw line, sent or received, so it can be logged
+func redactLine(raw string) string {
+	line, prefix := raw, ""
+	for _, mark := range []string{"@", COLON} { // skip tags and source
+		if strings.HasPrefix(line, mark) {
+			end := strings.Index(line+SPACE, SPACE)
+			prefix += line[:end] + SPACE
+			line = strings.TrimLeft(line[end:], SPACE)
+		}
+	}
+
+	words := strings.SplitN(line, SPACE, 3)
+	command := strings.ToLower(words[0])
+
+	if secretCommands[command] && len(words) > 1 {
+		return prefix + words[0] + " ***"
+	} else if (command == "privmsg" || command == "notice") && len(words) == 3 &&
+		serviceNicks[strings.ToLower(words[1])] {
+		return prefix + words[0] + " " + words[1] + " :***"
+	}
+
+	return raw
+}
+
 // Create a new Event from a sending client and the raw command string
 // The sole purpose of this function is the create an Event object and
 // specify the proper body, target, and do a simple preliminary check of
@@ -74,6 +164,7 @@ func NewEvent(cl *Client, raw string) *Event {
 	e := Event{
 		Type:   UNKNOWN,
 		Sender: cl,
+		Raw:    raw,
 		Target: "",
 		Body:   "",
 		Valid:  true,
@@ -84,7 +175,14 @@ func NewEvent(cl *Client, raw string) *Event {
 		return &e
 	}
 
-	log.Println(raw)
+	log.Println(redactLine(raw))
+
+	tags, raw, ok := parseTags(raw)
+	if !ok {
+		e.Type = INPUTTOOLONG
+		return &e
+	}
+	e.Tags = tags
 
 	words := strings.Split(raw, SPACE)
 	start := len(words[0]) + 1 // index of first char of first word
@@ -97,18 +195,103 @@ func NewEvent(cl *Client, raw string) *Event {
 		command = strings.ToLower(raw)
 	}
 
-	fmt.Printf("Words: %v\n", words)
+	fmt.Printf("Words: %v\n", strings.Split(redactLine(raw), SPACE))
+
+	e.Command = strings.ToUpper(command)
 
 	switch command {
+	case "admin":
+		e.Type = ADMIN
+	case "authenticate":
+		e.Type = AUTHENTICATE
+
+		if len(words) == 2 {
+			e.Body = words[1]
+		} else {
+			e.Valid = false
+		}
+	case "away":
+		e.Type = AWAY
+
+		// AWAY without a message means the user is back
+		if len(words) >= 2 {
+			e.Body = strings.TrimLeft(strings.Trim(raw[start:], SPACE), COLON)
+		}
+	case "cap":
+		e.Type = CAP
+
+		if len(words) >= 2 {
+			e.Target = strings.ToUpper(words[1])
+			e.Body = strings.TrimLeft(strings.Join(words[2:], SPACE), COLON)
+		} else {
+			e.Valid = false
+		}
+	case "chathistory":
+		e.Type = CHATHISTORY
+
+		if len(words) >= 2 {
+			e.Target = strings.ToUpper(words[1])
+			e.Body = strings.Join(words[2:], SPACE)
+		} else {
+			e.Valid = false
+		}
+	case "chghost":
+		e.Type = CHGHOST
+
+		if len(words) >= 4 {
+			e.Target = words[1]
+			e.Body = words[2] + SPACE + words[3]
+		} else {
+			e.Valid = false
+		}
 	case "help":
 		e.Type = HELP
 
 		if len(words) >= 2 {
 			e.Body = strings.Trim(raw[start:], SPACE+COLON)
 		}
+	case "info":
+		e.Type = INFO
+	case "ison":
+		e.Type = ISON
+
+		if len(words) >= 2 {
+			e.Body = strings.TrimLeft(strings.Trim(raw[start:], SPACE), COLON)
+		} else {
+			e.Valid = false
+		}
 	case "join":
 		e.Type = JOIN
 		e.Body = strings.Trim(raw[start:], SPACE)
+	case "kill":
+		e.Type = KILL
+
+		pair := strings.SplitN(strings.Trim(raw[start:], SPACE), SPACE, 2)
+		e.Target = pair[0]
+		if len(pair) == 2 {
+			e.Body = strings.TrimLeft(pair[1], COLON)
+		}
+
+		if len(e.Target) == 0 {
+			e.Valid = false
+		}
+	case "kline":
+		e.Type = KLINE
+
+		if len(words) >= 2 {
+			e.Target = words[1]
+			e.Body = strings.Join(words[2:], SPACE)
+		} else {
+			e.Valid = false
+		}
+	case "list":
+		e.Type = LIST
+
+		if len(words) >= 2 {
+			e.Body = strings.Trim(raw[start:], SPACE+COLON)
+		}
+	case "lusers":
+		e.Type = LUSERS
 	case "mode":
 		e.Type = MODE
 		e.Body = strings.Trim(raw[start:], SPACE)
@@ -119,8 +302,26 @@ func NewEvent(cl *Client, raw string) *Event {
 			e.Valid = false
 		}
 
+	case "monitor":
+		e.Type = MONITOR
+
+		if len(words) >= 2 {
+			e.Target = strings.ToUpper(words[1])
+		} else {
+			e.Valid = false
+		}
+
+		if len(words) >= 3 {
+			e.Body = strings.TrimLeft(words[2], COLON)
+		}
 	case "motd":
 		e.Type = MOTD
+	case "names":
+		e.Type = NAMES
+
+		if len(words) >= 2 {
+			e.Target = strings.Trim(words[1], COLON)
+		}
 	case "nick":
 		e.Type = NICK
 
@@ -129,6 +330,15 @@ func NewEvent(cl *Client, raw string) *Event {
 		} else {
 			e.Valid = false
 		}
+	case "oper":
+		e.Type = OPER
+
+		if len(words) == 3 {
+			e.Target = words[1]
+			e.Body = strings.TrimLeft(words[2], COLON)
+		} else {
+			e.Valid = false
+		}
 	case "part":
 		e.Type = PART
 
@@ -160,9 +370,12 @@ func NewEvent(cl *Client, raw string) *Event {
 				e.Body = "Y"
 			}
 		}
-	case "privmsg":
+	case "privmsg", "notice":
 		e.Type = MSG
-		fmt.Printf("Private message: %s\n", raw[start:])
+		if command == "notice" {
+			e.Type = NOTICE
+		}
+		fmt.Printf("Private message: %s\n", redactLine(raw))
 		targetMessagePair := strings.SplitAfterN(raw[start:], COLON, 2)
 
 		if len(targetMessagePair) != 2 {
@@ -180,8 +393,43 @@ func NewEvent(cl *Client, raw string) *Event {
 		if len(pair) == 2 {
 			e.Body = strings.Trim(pair[1], COLON+SPACE)
 		}
+	case "register":
+		e.Type = REGISTER
+
+		if len(words) == 4 {
+			e.Target = words[1]
+			e.Body = strings.Join(words[2:], SPACE)
+		} else {
+			e.Valid = false
+		}
+	case "rehash":
+		e.Type = REHASH
 	case "rules":
 		e.Type = RULES
+	case "setname":
+		e.Type = SETNAME
+
+		if len(words) >= 2 {
+			e.Body = strings.TrimLeft(strings.Trim(raw[start:], SPACE), COLON)
+		} else {
+			e.Valid = false
+		}
+	case "stats":
+		e.Type = STATS
+
+		if len(words) >= 2 {
+			e.Body = strings.Trim(words[1], COLON)
+		}
+	case "tagmsg":
+		e.Type = TAGMSG
+
+		if len(words) >= 2 {
+			e.Target = strings.Trim(words[1], COLON)
+		} else {
+			e.Valid = false
+		}
+	case "time":
+		e.Type = TIME
 	case "topic":
 		e.Type = TOPIC
 
@@ -196,6 +444,22 @@ func NewEvent(cl *Client, raw string) *Event {
 		} else {
 			e.Valid = false
 		}
+	case "unkline":
+		e.Type = UNKLINE
+
+		if len(words) == 2 {
+			e.Target = words[1]
+		} else {
+			e.Valid = false
+		}
+	case "unzline", "undline":
+		e.Type = UNZLINE
+
+		if len(words) == 2 {
+			e.Target = words[1]
+		} else {
+			e.Valid = false
+		}
 	case "user":
 		e.Type = USER
 		log.Println("User received")
@@ -208,8 +472,61 @@ func NewEvent(cl *Client, raw string) *Event {
 			e.Valid = false
 			// TODO: Send invalid USER param code
 		}
+	case "userhost":
+		e.Type = USERHOST
+
+		if len(words) >= 2 {
+			e.Body = strings.Trim(raw[start:], SPACE)
+		} else {
+			e.Valid = false
+		}
+	case "users":
+		e.Type = USERS
+	case "verify":
+		e.Type = VERIFY
+
+		if len(words) == 3 {
+			e.Target = words[1]
+			e.Body = strings.TrimLeft(words[2], COLON)
+		} else {
+			e.Valid = false
+		}
 	case "version":
 		e.Type = VERSION_SERVER
+	case "wallops":
+		e.Type = WALLOPS
+
+		if len(words) >= 2 {
+			e.Body = strings.TrimLeft(strings.Trim(raw[start:], SPACE), COLON)
+		}
+
+		if len(e.Body) == 0 {
+			e.Valid = false
+		}
+	case "who":
+		e.Type = WHO
+
+		if len(words) >= 2 {
+			e.Target = strings.Trim(words[1], COLON)
+		}
+	case "whois":
+		e.Type = WHOIS
+
+		// the nick is always the last parameter, since a server may come first
+		if len(words) >= 2 {
+			e.Target = strings.Trim(words[len(words)-1], COLON)
+		} else {
+			e.Valid = false
+		}
+	case "zline", "dline":
+		e.Type = ZLINE
+
+		if len(words) >= 2 {
+			e.Target = words[1]
+			e.Body = strings.Join(words[2:], SPACE)
+		} else {
+			e.Valid = false
+		}
 	default:
 		e.Type = UNKNOWN
 	}
@@ -223,271 +540,804 @@ func eventHandler(s *ServerInfo, events <-chan *Event) {
 
 	nickRegex, _ := regexp.Compile(NICKREGEX)
 
+	addService(users, newService(s, "NickServ", nickServ))
+	addService(users, newService(s, "ChanServ", chanServ))
+	addService(users, newService(s, "MemoServ", memoServ))
+	addService(users, newService(s, "HostServ", hostServ))
+
+	saveTicker := time.NewTicker(ACCOUNT_SAVE_INTERVAL * time.Second)
+
 	for {
-		e := <-events
-		fmt.Printf("Got event %v\n", e)
+		var e *Event
+		select {
+		case e = <-events:
+		case <-saveTicker.C:
+			s.accounts.saveIfChanged()
+			continue
+		}
+		fmt.Printf("Got event %d: %s\n", e.Type, redactLine(e.Raw))
 
-		switch e.Type {
-		case HELP:
-			log.Println("Help event")
-		case JOIN:
-			log.Println("Join event")
-			chanPassPair := strings.Split(e.Body, SPACE)
+		// anything still queued from a client which has left is dropped
+		if e.Sender.exited {
+			continue
+		}
 
-			log.Println(chanPassPair)
+		if e.Type != UNKNOWN && len(e.Command) > 0 {
+			s.countCommand(e.Command, len(e.Raw))
+		}
 
-			if len(chanPassPair) > 2 || len(chanPassPair) < 0 {
-				// TODO: send error message
-			} else {
-				chans := strings.Split(chanPassPair[0], COMMA)
-				// keys := strings.Split(chanPassPair[1], COMMA)
+		account := e.Sender.Account
 
-				for _, v := range chans {
-					v := strings.Trim(v, SPACE)
+		e.Sender.startLabel(e.Tags)
+		handleEvent(s, e, users, channels, nickRegex)
+		e.Sender.endLabel(s)
 
-					log.Println("in loop")
+		// the dispatch goroutine can't look at modes itself
+		if e.Sender.flood != nil {
+			e.Sender.flood.setExempt(e.Sender.hasMode("o"))
+		}
 
-					if len(v) == 0 || (v[0] != '#' && v[0] != '&') {
-						log.Println("Invalid channel name", v)
-						e.Sender.sendServerMessage(s, ERR_NOSUCHCHANNEL, "The channel \""+v+"\" does not exist")
-						continue
-					}
+		if e.Sender.Account != account && !e.Sender.exited {
+			e.Sender.notifyAccount(channels)
+			e.Sender.updateCloak(s, channels)
+		}
+	}
+}
 
-					// check if user is already in channel
-					if len(e.Sender.Channels) > 0 {
-						i := binarySearch(v, e.Sender.Channels)
-
-						// Do nothing, the user is already in this channel
-						if i == -1 {
-							continue
-						} else {
-							e.Sender.Channels = append(e.Sender.Channels, v)
-							sort.Strings(e.Sender.Channels)
-							log.Println("Adding user to channel", v)
-						}
-					} else {
-						e.Sender.Channels = append(e.Sender.Channels, v)
-					}
+// Handle a single event from a client
+func handleEvent(s *ServerInfo, e *Event, users map[string]*Client, channels map[string]*Channel, nickRegex *regexp.Regexp) {
+	switch e.Type {
+	case ADMIN:
+		log.Println("Admin event")
+		e.Sender.sendAdmin(s)
+	case AUTHENTICATE:
+		log.Println("Authenticate event")
+
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "AUTHENTICATE", "Need more parameters")
+			return
+		}
 
-					if c, exists := channels[v]; exists {
-						// add user to existing channel
-						c.Users.PushBack(e.Sender)
-					} else {
-						// time to make a new channel
-						channels[v] = NewChannel(v)
-						channels[v].Users.PushBack(e.Sender)
-					}
+		e.Sender.authenticate(s, e.Body)
+	case AWAY:
+		log.Println("Away event")
+		e.Sender.setAway(s, e.Body)
+	case CAP:
+		log.Println("Cap event")
 
-					channels[v].sendEvent(e.Sender, "JOIN", "")
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "CAP", "Need more parameters")
+			return
+		}
 
-					if len(channels[v].Topic) > 0 {
-						e.Sender.sendServerTargetInfo(s, RPL_TOPIC, v, channels[v].Topic)
-					} else {
-						e.Sender.sendServerTargetInfo(s, RPL_NOTOPIC, v, "No topic is set")
-					}
-					channels[v].nameReply(s, e.Sender)
+		e.Sender.handleCap(s, e.Target, strings.Split(e.Body, SPACE))
+		completeRegistration(s, e.Sender, users, channels)
+	case CHATHISTORY:
+		log.Println("Chat history event")
+
+		if !e.Valid {
+			e.Sender.sendFail(s, "CHATHISTORY", "NEED_MORE_PARAMS", "*", "Need more parameters")
+			return
+		}
+
+		e.Sender.chatHistory(s, e.Target, strings.Fields(e.Body), users, channels)
+	case CHGHOST:
+		log.Println("Change host event")
+
+		if !e.Sender.hasMode("o") {
+			e.Sender.sendServerMessage(s, ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+			return
+		}
+
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "CHGHOST", "Need more parameters")
+			return
+		}
+
+		user, exists := users[strings.ToLower(e.Target)]
+		if !exists || user.service != nil {
+			e.Sender.sendServerTargetInfo(s, ERR_NOSUCHNICK, e.Target, "No such nick")
+			return
+		}
+
+		pair := strings.SplitN(e.Body, SPACE, 2)
+		user.changeHost(s, pair[0], pair[1], channels)
+	case DNSBL:
+		log.Println("DNSBL event")
+		e.Sender.finishDNSBL(s, e.Target, e.Body, users, channels)
+	case ENFORCE:
+		log.Println("Nick enforcement event")
+		guestNick(s, e.Sender, e.Body, users, channels)
+	case EXCESSFLOOD:
+		serverNotice(s, users, SNO_FLOOD, "Excess flood from "+e.Sender.NoCloakString())
+		e.Sender.sendError("Closing Link: " + e.Sender.Host() + " (Excess Flood)")
+		removeClient(s, e.Sender, "Excess Flood", users, channels)
+	case HELP:
+		log.Println("Help event")
+		e.Sender.sendHelp(s, e.Body)
+	case INFO:
+		log.Println("Info event")
+		e.Sender.sendInfo(s)
+	case INPUTTOOLONG:
+		e.Sender.sendServerMessage(s, ERR_INPUTTOOLONG, "Input line was too long")
+	case ISON:
+		log.Println("Ison event")
+
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "ISON", "Need more parameters")
+			return
+		}
+
+		e.Sender.sendIson(s, strings.Fields(e.Body), users)
+	case JOIN:
+		log.Println("Join event")
+		chanPassPair := strings.Split(e.Body, SPACE)
+
+		log.Println(chanPassPair)
+
+		if len(chanPassPair) > 2 || len(chanPassPair) < 0 {
+			// TODO: send error message
+		} else {
+			chans := strings.Split(chanPassPair[0], COMMA)
+			// keys := strings.Split(chanPassPair[1], COMMA)
+
+			for _, v := range chans {
+				v := strings.Trim(v, SPACE)
+
+				log.Println("in loop")
+
+				if len(v) == 0 || (v[0] != '#' && v[0] != '&') {
+					log.Println("Invalid channel name", v)
+					e.Sender.sendServerMessage(s, ERR_NOSUCHCHANNEL, "The channel \""+v+"\" does not exist")
+					continue
 				}
-			}
-		case MODE:
-			log.Println("Mode event")
 
-			l := len(e.Target)
+				// Do nothing, the user is already in this channel
+				if binarySearch(v, e.Sender.Channels) != -1 {
+					continue
+				}
 
-			if l == 0 {
-				e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "MODE", "Need more parameters")
-				continue
-			}
+				if s.MaxChannels > 0 && len(e.Sender.Channels) >= s.MaxChannels {
+					e.Sender.sendServerTargetInfo(s, ERR_TOOMANYCHANNELS, v, "You have joined too many channels")
+					continue
+				}
+
+				if !canJoin(s, v, e.Sender) {
+					e.Sender.sendServerTargetInfo(s, ERR_BANNEDFROMCHAN, v, "Cannot join channel (you're on the autokick list)")
+					continue
+				}
+
+				log.Println("Adding user to channel", v)
+				e.Sender.Channels = append(e.Sender.Channels, v)
+				sort.Strings(e.Sender.Channels)
 
-			if l > 1 && (e.Target[0] == '#' || e.Target[0] == '&') { // sending to channel
-				if ch, exists := channels[e.Target]; exists {
-					// Format is:
-					// :Server 324 nick #channel +modes
-					e.Sender.sendMessage(strings.Join([]string{
-						s.Hostname,
-						padNumeric(RPL_CHANNELMODEIS),
-						e.Sender.Nick,
-						e.Target,
-						"+" + ch.Mode,
-					}, SPACE))
+				if c, exists := channels[v]; exists {
+					// add user to existing channel
+					c.Users.PushBack(e.Sender)
 				} else {
-					e.Sender.sendServerTargetInfo(s, ERR_NOSUCHCHANNEL, e.Target, "No such channel")
+					// time to make a new channel
+					channels[v] = NewChannel(v)
+					channels[v].Users.PushBack(e.Sender)
+					setupChannel(s, channels[v], e.Sender)
 				}
-			} else if l > 1 { // sending to user
-				if user, exists := users[e.Target]; exists {
-					// Print user mode info
-					e.Sender.sendMessage(strings.Join([]string{
-						s.Hostname,
-						padNumeric(RPL_UMODEIS),
-						e.Sender.Nick,
-						e.Target,
-						"+" + user.Mode,
-					}, SPACE))
+
+				channels[v].sendJoin(e.Sender)
+
+				if len(channels[v].Topic) > 0 {
+					e.Sender.sendServerTargetInfo(s, RPL_TOPIC, v, channels[v].Topic)
 				} else {
-					e.Sender.sendServerTargetInfo(s, ERR_NOSUCHNICK, e.Target, "No suck nick")
+					e.Sender.sendServerTargetInfo(s, RPL_NOTOPIC, v, "No topic is set")
 				}
-			} else {
-				log.Println("I shouldn't be here!")
+				channels[v].nameReply(s, e.Sender)
+				autoOp(s, channels[v], e.Sender, users)
+				playHistory(s, channels[v], e.Sender)
 			}
+		}
+	case KILL:
+		log.Println("Kill event")
+
+		if !e.Sender.hasMode("o") {
+			e.Sender.sendServerMessage(s, ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+			return
+		}
 
-		case NICK:
-			log.Println("User nick event")
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "KILL", "Need more parameters")
+			return
+		}
 
-			n := e.Body
+		victim, exists := users[strings.ToLower(e.Target)]
+		if !exists {
+			e.Sender.sendServerTargetInfo(s, ERR_NOSUCHNICK, e.Target, "No such nick")
+			return
+		} else if victim.service != nil {
+			e.Sender.sendServerMessage(s, ERR_CANTKILLSERVER, "You can't kill a service!")
+			return
+		}
 
-			if !nickRegex.MatchString(n) {
-				e.Sender.sendServerMessage(s, ERR_ERRONEUSNICKNAME, "Erroneus nickname.")
-				continue
-			}
+		reason := "Killed (" + e.Sender.Nick + " (" + e.Body + "))"
+		serverNotice(s, users, SNO_KILLS, "Received KILL message for "+victim.NoCloakString()+
+			". From "+e.Sender.Nick+" Path: "+s.Hostname+"!"+e.Sender.Nick+" ("+e.Body+")")
 
-			u, exists := users[n]
+		victim.sendError("Closing Link: " + victim.Host() + " (" + reason + ")")
+		removeClient(s, victim, reason, users, channels)
+	case KLINE:
+		log.Println("K-line event")
 
-			if exists && u != e.Sender {
-				log.Println("User already exists!")
-				e.Sender.sendServerMessage(s, ERR_NICKNAMEINUSE, "Nickname is already in use.")
-			} else if exists && u == e.Sender {
-				// if user is changing their nick to what their nick already is, then ignore
-				continue
-			} else {
-				if e.Sender.Nick != "" {
-					log.Println("User changed their nickname to", n)
-					delete(users, n)
-					users[n] = u
-				} else { // User is connecting for first time
-					log.Println("New user: ", n)
-					users[n] = e.Sender
+		if !e.Sender.hasMode("o") {
+			e.Sender.sendServerMessage(s, ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+			return
+		}
+
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "KLINE", "Need more parameters")
+			return
+		}
+
+		e.Sender.kline(s, e.Target, e.Body, users, channels)
+	case LIST:
+		log.Println("List event")
+		e.Sender.sendList(s, e.Body, channels)
+	case LOOKUP:
+		log.Println("Lookup event")
+		e.Sender.finishLookups(s, e.Target, e.Body, users, channels)
+	case LUSERS:
+		log.Println("Lusers event")
+		e.Sender.sendLusers(s, users, channels)
+	case MODE:
+		log.Println("Mode event")
+
+		l := len(e.Target)
+
+		if l == 0 {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "MODE", "Need more parameters")
+			return
+		}
+
+		if l > 1 && (e.Target[0] == '#' || e.Target[0] == '&') { // sending to channel
+			params := strings.Split(e.Body, SPACE)
+
+			if ch, exists := channels[e.Target]; exists && len(params) > 1 {
+				if !ch.hasMemberMode(e.Sender, "o") {
+					e.Sender.sendServerTargetInfo(s, ERR_CHANOPRIVSNEEDED, ch.Name, "You're not a channel operator")
+					return
 				}
 
-				e.Sender.Nick = n
+				ch.applyModes(s, e.Sender.String(), e.Sender, params[1], params[2:])
+			} else if exists {
+				// Format is:
+				// :Server 324 nick #channel +modes
+				e.Sender.sendMessage(strings.Join([]string{
+					s.Hostname,
+					padNumeric(RPL_CHANNELMODEIS),
+					e.Sender.Nick,
+					e.Target,
+					"+" + ch.Mode,
+				}, SPACE))
+			} else {
+				e.Sender.sendServerTargetInfo(s, ERR_NOSUCHCHANNEL, e.Target, "No such channel")
 			}
-		case PART:
-			log.Println("Leave channel event")
-
-			chans := strings.Split(e.Target, COMMA) // e.Target is a comma-separated list of channels
-			reason := strings.Trim(e.Body, SPACE)   // e.Body is the part reason
-
-			for _, ch := range chans {
-				if partedChannel, exists := channels[ch]; exists {
-					if binarySearch(ch, e.Sender.Channels) != -1 {
-						partedChannel.sendEvent(e.Sender, "PART", reason)
-					} else {
-						e.Sender.sendServerMessage(s, ERR_NOTONCHANNEL, "You can't leave a channel you aren't in.")
-					}
-				} else {
-					e.Sender.sendServerMessage(s, ERR_NOSUCHCHANNEL, "That channel does not exist")
-				}
+		} else if l > 1 { // sending to user
+			if !strings.EqualFold(e.Target, e.Sender.Nick) {
+				e.Sender.sendServerMessage(s, ERR_USERSDONTMATCH, "Can't change mode for other users")
+				return
 			}
-		case PING:
-			log.Println("Got PING, sending PONG")
 
-			e.Sender.LastSeen = time.Now().Unix()
+			params := strings.Split(e.Body, SPACE)
+			if len(params) == 1 {
+				e.Sender.sendServerMessage(s, RPL_UMODEIS, "+"+e.Sender.Mode)
+			} else {
+				e.Sender.setUserModes(s, params[1], params[2:])
+			}
+		} else {
+			log.Println("I shouldn't be here!")
+		}
+
+	case NAMES:
+		log.Println("Names event")
+
+		if len(e.Target) == 0 {
+			e.Sender.sendServerTargetInfo(s, RPL_ENDOFNAMES, "*", "End of NAMES list")
+			return
+		}
 
-			if len(e.Body) > 0 {
-				e.Sender.sendMessage(s.Hostname + " PONG " + s.Hostname + " :" + e.Body)
+		for _, name := range strings.Split(e.Target, COMMA) {
+			if ch, exists := channels[name]; exists {
+				ch.nameReply(s, e.Sender)
 			} else {
-				e.Sender.sendMessage(s.Hostname + " PONG " + s.Hostname + " :")
+				e.Sender.sendServerTargetInfo(s, RPL_ENDOFNAMES, name, "End of NAMES list")
+			}
+		}
+	case NICK:
+		log.Println("User nick event")
+
+		n := e.Body
+
+		if !nickRegex.MatchString(n) {
+			e.Sender.sendServerMessage(s, ERR_ERRONEUSNICKNAME, "Erroneus nickname.")
+			return
+		}
+
+		u, exists := users[strings.ToLower(n)]
+
+		if exists && u != e.Sender {
+			log.Println("User already exists!")
+			e.Sender.sendServerMessage(s, ERR_NICKNAMEINUSE, "Nickname is already in use.")
+		} else if n == e.Sender.Nick {
+			// if user is changing their nick to what their nick already is, then ignore
+			return
+		} else {
+			if e.Sender.Nick != "" {
+				changeNick(s, e.Sender, n, users, channels)
+			} else { // User is connecting for first time
+				log.Println("New user: ", n)
+				users[strings.ToLower(n)] = e.Sender
+				e.Sender.Nick = n
 			}
-		case PONG:
-			e.Sender.LastSeen = time.Now().Unix()
-			log.Println("Got PONG")
-		case MSG:
-			log.Println("Message event")
 
-			l := len(e.Target)
+			completeRegistration(s, e.Sender, users, channels)
+		}
+	case OPER:
+		log.Println("Oper event")
 
-			if l > 1 && (e.Target[0] == '#' || e.Target[0] == '&') { // sending to channel
-				if c, exists := channels[e.Target]; exists {
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "OPER", "Need more parameters")
+			return
+		}
 
-					i := binarySearch(strings.ToLower(e.Target), e.Sender.Channels)
+		if e.Sender.oper(s, e.Target, e.Body) {
+			serverNotice(s, users, SNO_OPERS, e.Sender.NoCloakString()+" is now an operator ("+e.Target+")")
+		} else {
+			serverNotice(s, users, SNO_OPERS, "Failed OPER attempt by "+e.Sender.NoCloakString()+" as "+e.Target)
+		}
+	case PART:
+		log.Println("Leave channel event")
 
-					restricted := c.hasMode(NO_EXTERNAL_MESSAGES)
+		chans := strings.Split(e.Target, COMMA) // e.Target is a comma-separated list of channels
+		reason := strings.Trim(e.Body, SPACE)   // e.Body is the part reason
 
-					if i == -1 && restricted {
-						e.Sender.sendServerTargetInfo(s, ERR_CANNOTSENDTOCHAN, e.Target,
-							"Cannot send to channel (you need to join first)")
-					} else {
-						c.sendEvent(e.Sender, "PRIVMSG", e.Body)
-					}
+		for _, ch := range chans {
+			if partedChannel, exists := channels[ch]; exists {
+				if binarySearch(ch, e.Sender.Channels) != -1 {
+					partedChannel.sendEvent(e.Sender, "PART", reason)
+					e.Sender.leaveChannel(partedChannel, channels)
 				} else {
-					e.Sender.sendServerTargetInfo(s, ERR_CANNOTSENDTOCHAN, e.Target, "Cannot send to channel")
+					e.Sender.sendServerMessage(s, ERR_NOTONCHANNEL, "You can't leave a channel you aren't in.")
 				}
-			} else if l > 1 { // sending to user
-				if user, exists := users[e.Target]; exists {
-					user.sendMessage(e.Sender.Nick + " PRIVMSG " + user.Nick + " :" + e.Body)
+			} else {
+				e.Sender.sendServerMessage(s, ERR_NOSUCHCHANNEL, "That channel does not exist")
+			}
+		}
+	case PASSCHECK:
+		log.Println("Password check event")
+		e.Sender.finishPasswordCheck(s, e.Body == "ok")
+	case PING:
+		log.Println("Got PING, sending PONG")
+
+		e.Sender.LastSeen = time.Now().Unix()
+
+		if len(e.Body) > 0 {
+			e.Sender.sendMessage(s.Hostname + " PONG " + s.Hostname + " :" + e.Body)
+		} else {
+			e.Sender.sendMessage(s.Hostname + " PONG " + s.Hostname + " :")
+		}
+	case PONG:
+		e.Sender.LastSeen = time.Now().Unix()
+		log.Println("Got PONG")
+	case MSG, NOTICE, TAGMSG:
+		log.Println("Message event")
+
+		command := e.Command
+		tags := messageTags(e.Sender, clientTags(e.Tags))
+
+		l := len(e.Target)
+
+		// STATUSMSG, such as @#channel, only goes to users with that prefix or higher
+		status := ""
+		if l > 2 && strings.Contains(PREFIX_SYMBOLS, e.Target[:1]) {
+			status = e.Target[:1]
+			e.Target = e.Target[1:]
+			l = len(e.Target)
+		}
+
+		if l > 1 && (e.Target[0] == '#' || e.Target[0] == '&') { // sending to channel
+			if c, exists := channels[e.Target]; exists {
+
+				i := binarySearch(strings.ToLower(e.Target), e.Sender.Channels)
+
+				restricted := c.hasMode(NO_EXTERNAL_MESSAGES)
+
+				if i == -1 && restricted {
+					e.Sender.sendServerTargetInfo(s, ERR_CANNOTSENDTOCHAN, e.Target,
+						"Cannot send to channel (you need to join first)")
+				} else if !c.canSpeak(e.Sender) {
+					e.Sender.sendServerTargetInfo(s, ERR_CANNOTSENDTOCHAN, e.Target,
+						"Cannot send to channel (+m)")
 				} else {
-					e.Sender.sendServerTargetInfo(s, ERR_NOSUCHNICK, e.Target, "No suck nick")
+					c.relay(e.Sender, tags, command, status, e.Body)
+					e.Sender.echo(tags, command, status+c.Name, e.Body)
+
+					// messages to part of a channel aren't kept
+					if e.Type != TAGMSG && len(status) == 0 {
+						s.history.add(strings.ToLower(c.Name), newHistoryItem(e.Sender, command, c.Name, e.Body, tags))
+					}
 				}
-			} else { // invalid target
-				e.Sender.sendServerMessage(s, ERR_NORECIPIENT, "No recipient given (PRIVMSG)")
-			}
-		case MOTD:
-			log.Println("MOTD event")
-			e.Sender.sendMotd(s)
-		case RULES:
-			log.Println("Rules event")
-			// TODO: Actualy send rules
-		case TOPIC:
-			// TODO: Check if user has permission to change topic
-			log.Println("TOPIC event")
-
-			if !e.Valid {
-				// TODO: Send bad command text
-				continue
+			} else {
+				e.Sender.sendServerTargetInfo(s, ERR_CANNOTSENDTOCHAN, e.Target, "Cannot send to channel")
 			}
+		} else if l > 1 { // sending to user
+			user, exists := users[strings.ToLower(e.Target)]
+
+			switch {
+			case exists && user.service != nil:
+				e.Sender.echo(tags, command, user.Nick, e.Body)
+				if e.Type == MSG {
+					user.service(s, user, e.Sender, e.Body, users, channels)
+				}
+			case exists:
+				if e.Type == MSG && len(user.Away) > 0 {
+					e.Sender.sendServerTargetInfo(s, RPL_AWAY, user.Nick, user.Away)
+				}
 
-			if ch, exists := channels[e.Target]; exists {
-				ch.Topic = e.Body
+				// with echo-message, messages to yourself are only sent once
+				if user != e.Sender || !e.Sender.hasCap("echo-message") {
+					user.relayTo(tags, e.Sender, command, user.Nick, e.Body)
+				}
+				e.Sender.echo(tags, command, user.Nick, e.Body)
 
-				ch.sendEvent(e.Sender, "TOPIC", e.Body)
-			} else {
-				e.Sender.sendServerMessage(s, ERR_NOSUCHCHANNEL, e.Target+": No such channel")
+				// conversations are only kept between logged in users
+				if e.Type != TAGMSG && len(e.Sender.Account) > 0 && len(user.Account) > 0 {
+					s.history.add(conversationKey(e.Sender.Account, user.Account),
+						newHistoryItem(e.Sender, command, user.Nick, e.Body, tags))
+				}
+			case e.Type == MSG:
+				// keep messages to registered users who are offline as memos
+				// only from identified users, so they can't be sent anonymously
+				acct, registered := s.accounts.getByNick(e.Target)
+				if registered && !acct.Unverified && len(e.Sender.Account) > 0 {
+					e.Sender.echo(tags, command, e.Target, e.Body)
+					users["memoserv"].notice(e.Sender, leaveMemo(s, e.Sender, acct, e.Body, users))
+					return
+				}
+				fallthrough
+			default:
+				e.Sender.sendServerTargetInfo(s, ERR_NOSUCHNICK, e.Target, "No such nick")
 			}
-		case USER:
-			log.Println("User info event")
+		} else { // invalid target
+			e.Sender.sendServerMessage(s, ERR_NORECIPIENT, "No recipient given ("+command+")")
+		}
+	case MONITOR:
+		log.Println("Monitor event")
 
-			nick := e.Sender.Nick
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "MONITOR", "Need more parameters")
+			return
+		}
 
-			if len(nick) > 1 {
-				parts := strings.SplitAfterN(e.Body, SPACE, 4)
+		e.Sender.monitor(s, e.Target, e.Body, users)
+	case MOTD:
+		log.Println("MOTD event")
+		e.Sender.sendMotd(s)
+	case REGISTER:
+		log.Println("Register event")
 
-				if len(parts) == 4 {
-					e.Sender.Username = strings.Trim(parts[0], SPACE)
-					e.Sender.Realname = strings.Trim(parts[3], SPACE+COLON)
-					e.Sender.Registered = true
+		if !e.Valid {
+			e.Sender.sendFail(s, "REGISTER", "NEED_MORE_PARAMS", "*", "Usage: REGISTER <account> <email> <password>")
+			return
+		}
 
-					log.Println("User information registered for", e.Sender.Realname)
+		pair := strings.SplitN(e.Body, SPACE, 2)
+		e.Sender.register(s, e.Target, pair[0], strings.TrimLeft(pair[1], COLON))
+	case REHASH:
+		log.Println("Rehash event")
 
-					e.Sender.Ping(s)
-					e.Sender.sendWelcomeMessage(s)
+		if !e.Sender.hasMode("o") {
+			e.Sender.sendServerMessage(s, ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+			return
+		}
 
-				} else {
-					// TODO: Send INVALID error
-					log.Println("Invalid USER command")
-					log.Printf("%v\n", parts)
-				}
-			} else {
-				log.Println("User must first send a username")
+		e.Sender.sendServerTargetInfo(s, RPL_REHASHING, "config.ini", "Rehashing")
+		rehash(s)
+	case RULES:
+		log.Println("Rules event")
+		e.Sender.sendRules(s)
+	case SETNAME:
+		log.Println("Set name event")
+
+		if !e.Valid {
+			e.Sender.sendFail(s, "SETNAME", "INVALID_REALNAME", "*", "Real name is invalid")
+			return
+		}
+
+		e.Sender.setRealname(s, e.Body, channels)
+	case STATS:
+		log.Println("Stats event")
+		e.Sender.sendStats(s, e.Body, users)
+	case TIME:
+		log.Println("Time event")
+		e.Sender.sendTime(s)
+	case TLS:
+		log.Println("TLS event")
+		e.Sender.addMode("Z")
+		e.Sender.CertFP = e.Body
+	case TOPIC:
+		log.Println("TOPIC event")
+
+		if !e.Valid {
+			// TODO: Send bad command text
+			return
+		}
+
+		if ch, exists := channels[e.Target]; exists {
+			if !canChangeTopic(s, ch, e.Sender) {
+				e.Sender.sendServerTargetInfo(s, ERR_CHANOPRIVSNEEDED, ch.Name, "You're not a channel operator")
+				return
 			}
-		case QUIT:
-			log.Println("User quit event from ", e.Sender.Nick)
 
-			// cleanup - disable all further messages and close connection.
-			e.Sender.Alive = false
-			e.Sender.Conn.Close()
+			if len(e.Body) > TOPICLEN {
+				e.Body = e.Body[:TOPICLEN]
+			}
+			ch.Topic = e.Body
 
-			for _, ch := range channels {
-				ch.sendEvent(e.Sender, "QUIT", e.Body)
-				ch.removeUser(e.Sender.Nick)
+			if reg, registered := s.registered.get(ch.Name); registered {
+				reg.Topic = ch.Topic
+				s.registered.save()
 			}
 
-			// remove user from users map
-			delete(users, e.Sender.Nick)
-		case VERSION_SERVER:
-			log.Println("Version event")
-			e.Sender.sendVersion(s)
-		case UNKNOWN:
-		default:
-			e.Sender.sendServerMessage(s, ERR_UNKNOWNCOMMAND, "Unknown command")
-			log.Println("UNKNOWN event type.")
+			ch.sendEvent(e.Sender, "TOPIC", e.Body)
+		} else {
+			e.Sender.sendServerMessage(s, ERR_NOSUCHCHANNEL, e.Target+": No such channel")
+		}
+	case USER:
+		log.Println("User info event")
+
+		if e.Sender.Registered {
+			e.Sender.sendServerMessage(s, ERR_ALREADYREGISTRED, "Unauthorized command (already registered)")
+			return
+		}
+
+		parts := strings.SplitAfterN(e.Body, SPACE, 4)
+
+		if len(parts) == 4 {
+			e.Sender.Username = strings.Trim(parts[0], SPACE)
+			e.Sender.Realname = strings.Trim(parts[3], SPACE+COLON)
+			if len(e.Sender.Realname) > REALNAMELEN {
+				e.Sender.Realname = e.Sender.Realname[:REALNAMELEN]
+			}
+
+			log.Println("User information received for", e.Sender.Realname)
+			completeRegistration(s, e.Sender, users, channels)
+		} else {
+			log.Println("Invalid USER command")
+			log.Printf("%v\n", parts)
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "USER", "Need more parameters")
+		}
+	case QUIT:
+		log.Println("User quit event from ", e.Sender.Nick)
+		removeClient(s, e.Sender, e.Body, users, channels)
+	case USERHOST:
+		log.Println("Userhost event")
+
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "USERHOST", "Need more parameters")
+			return
+		}
+
+		e.Sender.sendUserhost(s, strings.Fields(e.Body), users)
+	case USERS:
+		log.Println("Users event")
+		e.Sender.sendUsers(s, users)
+	case VERIFY:
+		log.Println("Verify event")
+
+		if !e.Valid {
+			e.Sender.sendFail(s, "VERIFY", "NEED_MORE_PARAMS", "*", "Usage: VERIFY <account> <code>")
+			return
+		}
+
+		e.Sender.verify(s, e.Target, e.Body)
+	case VERSION_SERVER:
+		log.Println("Version event")
+		e.Sender.sendVersion(s)
+	case WALLOPS:
+		log.Println("Wallops event")
+
+		if !e.Sender.hasMode("o") {
+			e.Sender.sendServerMessage(s, ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+			return
+		}
+
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "WALLOPS", "Need more parameters")
+			return
+		}
+
+		wallops(e.Sender, users, e.Body)
+	case WHO:
+		log.Println("Who event")
+		e.Sender.sendWho(s, e.Target, users, channels)
+	case WHOIS:
+		log.Println("Whois event")
+
+		if !e.Valid {
+			e.Sender.sendServerMessage(s, ERR_NONICKNAMEGIVEN, "No nickname given")
+			return
+		}
+
+		e.Sender.sendWhois(s, e.Target, users)
+	case ZLINE:
+		log.Println("Z-line event")
+
+		if !e.Sender.hasMode("o") {
+			e.Sender.sendServerMessage(s, ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+			return
+		}
+
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, e.Command, "Need more parameters")
+			return
+		}
+
+		e.Sender.zline(s, e.Target, e.Body, users, channels)
+	case UNKLINE:
+		log.Println("Un-K-line event")
+
+		if !e.Sender.hasMode("o") {
+			e.Sender.sendServerMessage(s, ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+			return
+		}
+
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, "UNKLINE", "Need more parameters")
+			return
+		}
+
+		if s.bans.removeKLine(e.Target) {
+			e.Sender.sendServerNotice(s, "Removed K-line for "+e.Target)
+			serverNotice(s, users, SNO_BANS, e.Sender.Nick+" removed the K-line for "+e.Target)
+		} else {
+			e.Sender.sendServerNotice(s, "No K-line for "+e.Target)
+		}
+	case UNZLINE:
+		log.Println("Un-Z-line event")
+
+		if !e.Sender.hasMode("o") {
+			e.Sender.sendServerMessage(s, ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+			return
+		}
+
+		if !e.Valid {
+			e.Sender.sendServerTargetInfo(s, ERR_NEEDMOREPARAMS, e.Command, "Need more parameters")
+			return
 		}
+
+		if s.bans.removeZLine(e.Target) {
+			e.Sender.sendServerNotice(s, "Removed Z-line for "+e.Target)
+			serverNotice(s, users, SNO_BANS, e.Sender.Nick+" removed the Z-line for "+e.Target)
+		} else {
+			e.Sender.sendServerNotice(s, "No Z-line for "+e.Target)
+		}
+	case UNKNOWN:
+	default:
+		e.Sender.sendServerMessage(s, ERR_UNKNOWNCOMMAND, "Unknown command")
+		log.Println("UNKNOWN event type.")
+	}
+}
+
+// Finish registering a client once it has sent both NICK and USER, and has
+// finished CAP negotiation if it started any.
+func completeRegistration(s *ServerInfo, cl *Client, users map[string]*Client, channels map[string]*Channel) {
+	if cl.Registered || len(cl.Nick) == 0 || len(cl.Username) == 0 || cl.capNegotiating || cl.lookups > 0 {
+		return
+	}
+
+	cl.applyIdent(s)
+
+	if cl.requireSASL && len(cl.Account) == 0 {
+		reason := "Your IP is listed in " + cl.dnsblZone + ", so you must log in with SASL"
+		serverNotice(s, users, SNO_CONNECTS, "Rejected "+cl.NoCloakString()+" without SASL, listed in "+cl.dnsblZone)
+		cl.sendError("Closing Link: " + cl.IP() + " (" + reason + ")")
+		removeClient(s, cl, reason, users, channels)
+		return
+	}
+
+	if s.bans != nil {
+		if ban := s.bans.klined(cl); ban != nil {
+			reason := "K-lined: " + ban.Reason
+			serverNotice(s, users, SNO_BANS, "Refused K-lined client "+cl.Nick+
+				" ("+cl.Username+"@"+cl.RealHost()+") ("+ban.Reason+")")
+			cl.sendServerMessage(s, ERR_YOUREBANNEDCREEP, "You are banned from this server- "+reason)
+			cl.sendError("Closing Link: " + cl.Host() + " (" + reason + ")")
+			removeClient(s, cl, reason, users, channels)
+			return
+		}
+	}
+
+	cl.Registered = true
+	log.Println("User information registered for", cl.Realname)
+
+	cl.Ping(s)
+	cl.sendWelcomeMessage(s, users, channels)
+
+	serverNotice(s, users, SNO_CONNECTS, "Client connecting: "+cl.Nick+
+		" ("+cl.Username+"@"+cl.RealHost()+") ["+cl.IP()+"] {"+cl.Realname+"}")
+	if len(cl.dnsblZone) > 0 {
+		serverNotice(s, users, SNO_CONNECTS, "Client "+cl.Nick+" ["+cl.IP()+"] is listed in "+cl.dnsblZone)
+	}
+
+	// the client may log in with SASL before this point, so registered
+	// nicks and memos are only checked once the connection is complete
+	enforceNick(s, cl, users)
+	deliverMemos(s, cl)
+	s.notifyOnline(cl)
+}
+
+// Change the nick of a registered client and tell everyone who can see them
+func changeNick(s *ServerInfo, cl *Client, nick string, users map[string]*Client, channels map[string]*Channel) {
+	log.Println("User changed their nickname to", nick)
+
+	delete(users, strings.ToLower(cl.Nick))
+	users[strings.ToLower(nick)] = cl
+
+	if cl.Registered {
+		serverNotice(s, users, SNO_NICKS, "Nick change: From "+cl.Nick+" to "+nick+
+			" ["+cl.Username+"@"+cl.RealHost()+"]")
+		cl.sendNickChange(nick, channels)
+	}
+
+	old := cl.Nick
+	cl.Nick = nick
+
+	if cl.Registered {
+		s.notifyOffline(old)
+		s.notifyOnline(cl)
+		enforceNick(s, cl, users)
+	}
+}
+
+// Disconnect a client and remove it from every channel it's in. This is safe
+// to call more than once for the same client.
+func removeClient(s *ServerInfo, cl *Client, reason string, users map[string]*Client, channels map[string]*Channel) {
+	if cl.exited {
+		return
+	}
+	cl.exited = true
+
+	// cleanup - disable all further messages. writeLoop closes the connection
+	// once it has sent what's already queued, giving up on a client which
+	// doesn't read it in time.
+	cl.markDead()
+	cl.Conn.SetWriteDeadline(time.Now().Add(CLOSE_TIMEOUT * time.Second))
+	close(cl.outgoing)
+
+	if s.limits != nil && cl.limitIP != nil {
+		s.limits.release(cl.limitIP)
+	}
+
+	tags := messageTags(cl, nil)
+	for _, peer := range cl.peers(channels) {
+		peer.sendTagged(tags, ":"+cl.String()+" QUIT :"+reason)
+	}
+
+	for _, name := range cl.Channels {
+		if ch, exists := channels[name]; exists {
+			ch.removeUser(cl.Nick)
+			if ch.Users.Len() == 0 {
+				delete(channels, ch.Name)
+			}
+		}
+	}
+	cl.Channels = nil
+
+	// remove user from users map, unless someone else has already taken the nick
+	if users[strings.ToLower(cl.Nick)] == cl {
+		delete(users, strings.ToLower(cl.Nick))
+	}
+
+	s.clearMonitors(cl)
+	if cl.Registered {
+		s.notifyOffline(cl.Nick)
+		serverNotice(s, users, SNO_CONNECTS, "Client exiting: "+cl.Nick+
+			" ("+cl.Username+"@"+cl.RealHost()+") ["+reason+"]")
 	}
 }
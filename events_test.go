@@ -20,6 +20,7 @@ package main
 
 import (
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -80,3 +81,39 @@ func TestNickRegex(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// NICKLEN is advertised to clients, so make sure it agrees with NICKREGEX
+func TestNickLen(t *testing.T) {
+	nickRE, _ := regexp.Compile(NICKREGEX)
+
+	if !nickRE.MatchString(strings.Repeat("a", NICKLEN)) {
+		t.Error("NICKREGEX rejects a nick of NICKLEN characters")
+	}
+
+	if nickRE.MatchString(strings.Repeat("a", NICKLEN+1)) {
+		t.Error("NICKREGEX accepts a nick longer than NICKLEN")
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	tests := map[string]string{
+		"PASS hunter2":                           "PASS ***",
+		"OPER admin hunter2":                     "OPER ***",
+		"authenticate AGp1bGlldABodW50ZXIy":      "authenticate ***",
+		"REGISTER * a@example.com hunter2":       "REGISTER ***",
+		"@label=1 VERIFY tester 123456":          "@label=1 VERIFY ***",
+		"PRIVMSG NickServ :IDENTIFY hunter2":     "PRIVMSG NickServ :***",
+		"privmsg nickserv :identify hunter2":     "privmsg nickserv :***",
+		"PRIVMSG #test :hello":                   "PRIVMSG #test :hello",
+		"@time=now PRIVMSG tester :hi":           "@time=now PRIVMSG tester :hi",
+		":a!a@host PRIVMSG NickServ :IDENTIFY x": ":a!a@host PRIVMSG NickServ :***",
+		"PING irc.example.com":                   "PING irc.example.com",
+		"":                                       "",
+	}
+
+	for raw, want := range tests {
+		if got := redactLine(raw); got != want {
+			t.Errorf("%q logged as %q, want %q", raw, got, want)
+		}
+	}
+}
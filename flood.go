@@ -0,0 +1,146 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Flood limits, if not set in config.ini
+const (
+	DEFAULT_FLOOD_BURST   = 10 // commands a client can send at once
+	DEFAULT_FLOOD_RATE    = 2  // commands per second after the burst
+	DEFAULT_FLOOD_BACKLOG = 50 // delayed lines before a client is disconnected
+)
+
+// Commands which cost more or less than 1 against a client's flood limit.
+// Replies to the server are free, so clients aren't timed out for being
+// slowed down.
+var FLOOD_COSTS = map[string]float64{
+	"CHATHISTORY": 2,
+	"JOIN":        2,
+	"LIST":        3,
+	"NAMES":       2,
+	"PONG":        0,
+	"QUIT":        0,
+	"WHO":         2,
+	"WHOIS":       2,
+}
+
+// A token bucket used to slow down ("fakelag") clients which send commands
+// faster than the flood limits allow
+type floodLimiter struct {
+	tokens  float64
+	last    time.Time
+	burst   float64
+	rate    float64 // tokens per second
+	backlog int     // lines which may wait to be handled
+
+	// 1 while the client is an operator. The event handler sets it and the
+	// dispatch goroutine reads it, so use setExempt and exempt.
+	oper int32
+}
+
+func newFloodLimiter(s *ServerInfo) *floodLimiter {
+	f := &floodLimiter{
+		burst:   float64(s.FloodBurst),
+		rate:    float64(s.FloodRate),
+		backlog: s.FloodBacklog,
+	}
+
+	if f.burst <= 0 {
+		f.burst = DEFAULT_FLOOD_BURST
+	}
+	if f.rate <= 0 {
+		f.rate = DEFAULT_FLOOD_RATE
+	}
+	if f.backlog <= 0 {
+		f.backlog = DEFAULT_FLOOD_BACKLOG
+	}
+
+	f.tokens = f.burst
+	return f
+}
+
+// Take a command's cost from the bucket at time `now`, and return how long
+// the command must wait before being handled
+func (f *floodLimiter) delay(cost float64, now time.Time) time.Duration {
+	if !f.last.IsZero() {
+		f.tokens += now.Sub(f.last).Seconds() * f.rate
+		if f.tokens > f.burst {
+			f.tokens = f.burst
+		}
+	}
+	f.last = now
+
+	f.tokens -= cost
+	if f.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-f.tokens / f.rate * float64(time.Second))
+}
+
+// Turn the limit off or on, as the client becomes an operator or stops being
+// one
+func (f *floodLimiter) setExempt(exempt bool) {
+	var flag int32
+	if exempt {
+		flag = 1
+	}
+	atomic.StoreInt32(&f.oper, flag)
+}
+
+func (f *floodLimiter) exempt() bool {
+	return atomic.LoadInt32(&f.oper) == 1
+}
+
+// How much a raw line from a client costs against its flood limit
+func floodCost(line string) float64 {
+	for _, word := range strings.Fields(line) {
+		if word[0] == '@' || word[0] == ':' {
+			continue
+		}
+
+		if cost, exists := FLOOD_COSTS[strings.ToUpper(word)]; exists {
+			return cost
+		}
+		break
+	}
+
+	return 1
+}
+
+// Pass lines from a client to the event handler, delaying them when the
+// client goes over its flood limit. Operators aren't limited.
+func (c *Client) dispatch(lines <-chan string, events chan<- *Event) {
+	for line := range lines {
+		if !c.isAlive() {
+			continue
+		}
+
+		if !c.flood.exempt() {
+			time.Sleep(c.flood.delay(floodCost(line), time.Now()))
+		}
+
+		events <- NewEvent(c, line)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFloodLimiter(t *testing.T) {
+	f := newFloodLimiter(&ServerInfo{FloodBurst: 3, FloodRate: 2})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if d := f.delay(1, now); d != 0 {
+			t.Fatalf("Command %d in the burst was delayed %v", i+1, d)
+		}
+	}
+
+	if d := f.delay(1, now); d != 500*time.Millisecond {
+		t.Errorf("Command after the burst was delayed %v, not 500ms", d)
+	}
+
+	// the bucket refills over time, but never past the burst
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if d := f.delay(1, now); d != 0 {
+			t.Fatalf("Command %d after waiting was delayed %v", i+1, d)
+		}
+	}
+	if d := f.delay(1, now); d == 0 {
+		t.Error("Bucket refilled past the burst")
+	}
+}
+
+func TestFloodCost(t *testing.T) {
+	for line, cost := range map[string]float64{
+		"PRIVMSG #gochat :hi":          1,
+		"join #gochat":                 2,
+		"@label=1 PONG :irc.example":   0,
+		":nick!user@host LIST":         3,
+		"@+typing=active :nick WHO #a": 2,
+	} {
+		if c := floodCost(line); c != cost {
+			t.Errorf("Cost of %q is %v, not %v", line, c, cost)
+		}
+	}
+}
+
+func TestFloodExempt(t *testing.T) {
+	f := newFloodLimiter(&ServerInfo{})
+	if f.exempt() {
+		t.Error("New clients are exempt from flood limits")
+	}
+
+	f.setExempt(true)
+	if !f.exempt() {
+		t.Error("Operators aren't exempt from flood limits")
+	}
+}
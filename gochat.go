@@ -20,8 +20,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const bufSize = 1400
@@ -39,24 +45,148 @@ func networkHandler(s *ServerInfo) {
 
 	msgsIn := make(chan string)
 	events := make(chan *Event)
+	s.events = events
 
 	go eventHandler(s, events)
 
+	var tlsConfig *tls.Config
+	if s.TLSPort > 0 || (s.WebSocketPort > 0 && s.WebSocketTLS) {
+		cert, err := tls.LoadX509KeyPair(s.TLSCertPath, s.TLSKeyPath)
+		if err != nil {
+			log.Fatal("Couldn't load TLS certificate: ", err)
+		}
+
+		// ask for, but don't require, client certificates for SASL EXTERNAL
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+		}
+	}
+
+	trusted := parseIPMasks("ProxyTrusted", s.ProxyTrusted)
+
+	if s.TLSPort > 0 {
+		opts := listenerOptions{tlsConfig: tlsConfig, proxy: s.TLSProxyProtocol, trusted: trusted}
+		go acceptConnections(s, listen(s.TLSPort), opts, msgsIn, events)
+	}
+
+	if s.WebSocketPort > 0 {
+		opts := listenerOptions{
+			proxy:     s.WebSocketProxyProtocol,
+			trusted:   trusted,
+			websocket: true,
+		}
+		if s.WebSocketTLS {
+			opts.tlsConfig = tlsConfig
+		}
+
+		for _, origin := range strings.Split(s.WebSocketOrigins, ",") {
+			if origin = strings.TrimSpace(origin); len(origin) > 0 {
+				opts.origins = append(opts.origins, origin)
+			}
+		}
+
+		go acceptConnections(s, listen(s.WebSocketPort), opts, msgsIn, events)
+	}
+
+	acceptConnections(s, listener, listenerOptions{proxy: s.ProxyProtocol, trusted: trusted}, msgsIn, events)
+}
+
+// How connections to a listener are set up
+type listenerOptions struct {
+	tlsConfig *tls.Config  // wrap connections in TLS, if set
+	proxy     bool         // connections start with a PROXY header
+	trusted   []*net.IPNet // load balancers allowed to send PROXY headers
+	websocket bool         // connections are WebSockets
+	origins   []string     // web pages allowed to open WebSockets
+}
+
+func listen(port int) net.Listener {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatal("Couldn't listen on port "+strconv.Itoa(port)+": ", err)
+	}
+
+	return listener
+}
+
+// Accept connections from a listener and set each one up on its own
+func acceptConnections(s *ServerInfo, listener net.Listener, opts listenerOptions,
+	msgsIn chan string, events chan<- *Event) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			log.Fatal("Couldn't accept connection: ", err)
 		}
 
-		cl := NewClient(conn)
+		go acceptConnection(s, conn, opts, msgsIn, events)
+	}
+}
+
+// Set up a single new connection. This runs on its own, since reading a
+// PROXY header or a WebSocket handshake, or refusing a connection, shouldn't
+// hold up the listener.
+func acceptConnection(s *ServerInfo, conn net.Conn, opts listenerOptions, msgsIn chan string, events chan<- *Event) {
+	secure := false
 
-		// cloak user if there is a default cloak
-		if len(s.DefaultCloak) > 0 {
-			cl.Cloak = s.DefaultCloak
+	// the real client address has to be known before anything else is done
+	if opts.proxy {
+		if ip := remoteIP(conn); !ipInMasks(ip, opts.trusted) {
+			log.Println("Refused PROXY connection from untrusted", ip)
+			conn.Close()
+			return
 		}
 
-		go handleConnection(&cl, msgsIn, events)
+		p, err := readProxyHeader(conn)
+		if err != nil {
+			log.Println("Bad PROXY header from", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn, secure = p, p.secure
+	}
+
+	if opts.tlsConfig != nil {
+		conn = tls.Server(conn, opts.tlsConfig)
+	}
+
+	// the handshake comes first so a refused WebSocket client can be told why
+	if opts.websocket {
+		ws, err := upgradeWebSocket(conn, opts.origins)
+		if err != nil {
+			log.Println("WebSocket handshake failed for", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = ws
+	}
+
+	// refuse Z-lined, throttled and over-limit IPs before doing any work
+	ip := remoteIP(conn)
+	if ip == nil {
+		log.Println("Refused connection from unknown address", conn.RemoteAddr())
+		conn.Close()
+		return
+	} else if ok, reason := s.limits.admit(ip, time.Now()); !ok {
+		refuseConnection(conn, ip, reason)
+		return
 	}
+
+	cl := NewClient(conn)
+	cl.limitIP = ip // released by removeClient
+
+	// the load balancer handled TLS for this client
+	if secure {
+		cl.addMode("Z")
+	}
+
+	cl.Cloak = s.cloakFor(&cl)
+	cl.flood = newFloodLimiter(s)
+	go cl.writeLoop()
+
+	// lookup results can remove the client, so they're started last
+	s.startLookups(&cl, events)
+	handleConnection(&cl, msgsIn, events)
 }
 
 func handleConnection(cl *Client, in chan string, events chan<- *Event) {
@@ -64,12 +194,43 @@ func handleConnection(cl *Client, in chan string, events chan<- *Event) {
 	msgBuffer := make([]byte, 0)
 	log.Println("Now handling connection :" + cl.String())
 
-	for cl.Alive {
+	tlsConn, ok := cl.Conn.(*tls.Conn)
+	if ws, isWebSocket := cl.Conn.(*wsConn); isWebSocket {
+		tlsConn, ok = ws.Conn.(*tls.Conn)
+	}
+
+	if ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Println("TLS handshake failed for", cl.String(), err)
+
+			// the event handler closes the connection and cleans up
+			e := NewEvent(cl, "")
+			e.Type = QUIT
+			events <- e
+			return
+		}
+
+		// the event handler owns the client now, so it marks it as secure
+		e := NewEvent(cl, "")
+		e.Type = TLS
+		state := tlsConn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			fp := sha256.Sum256(state.PeerCertificates[0].Raw)
+			e.Body = hex.EncodeToString(fp[:])
+		}
+		events <- e
+	}
+
+	// lines wait here while the client is being slowed down for flooding
+	lines := make(chan string, cl.flood.backlog)
+	defer close(lines)
+	go cl.dispatch(lines, events)
+
+	for cl.isAlive() {
 		bufferIn = make([]byte, bufSize)
 		_, err := cl.Conn.Read(bufferIn)
 		if err != nil {
 			log.Println("User" + cl.String() + "disconnected")
-			cl.Alive = false
 			e := NewEvent(cl, "")
 			e.Type = QUIT
 			events <- e
@@ -90,7 +251,17 @@ func handleConnection(cl *Client, in chan string, events chan<- *Event) {
 			l := len(msg)
 			if l > 0 {
 				msgString := string(msg[:l])
-				events <- NewEvent(cl, msgString)
+				cl.countReceived(l)
+
+				select {
+				case lines <- msgString:
+				default:
+					log.Println("Excess flood from", cl.String())
+					e := NewEvent(cl, "")
+					e.Type = EXCESSFLOOD
+					events <- e
+					return
+				}
 			}
 		}
 
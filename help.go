@@ -0,0 +1,192 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Topic shown when HELP is sent without any arguments
+const HELP_INDEX = "index"
+
+// Built-in help for every implemented command. Files in the help directory
+// with the same (case-insensitive) name as a topic replace these.
+var defaultHelp = map[string]string{
+	"admin":        "ADMIN\n\nShows contact information for the administrator of this server.",
+	"authenticate": "AUTHENTICATE <mechanism|data>\n\nLogs into an account with SASL. Requires the sasl capability.\nSupported mechanisms: " + SASL_MECHANISMS,
+	"away":         "AWAY [:<message>]\n\nMarks you as away with a message, or as back without one.",
+	"cap":          "CAP <LS|LIST|REQ|END> [<capabilities>]\n\nNegotiates IRCv3 capabilities.",
+	"chathistory":  "CHATHISTORY <LATEST|BEFORE|AFTER|AROUND> <target> <reference> <limit>\nCHATHISTORY BETWEEN <target> <reference> <reference> <limit>\nCHATHISTORY TARGETS <timestamp> <timestamp> <limit>\n\nFetches message history for a channel you're in, or a conversation with\nanother account. References are timestamp=<time> or msgid=<id>, or * for\nthe latest messages.",
+	"chghost":      "CHGHOST <nick> <username> <host>\n\nChanges the username and host shown for a user. Operators only.",
+	"dline":        "DLINE <ip|network> [<duration>] :<reason>\n\nThe same as ZLINE.",
+	"help":         "HELP [<topic>]\n\nShows help about a topic. Without a topic, lists all\navailable help topics.",
+	"info":         "INFO\n\nShows information about the server software.",
+	"ison":         "ISON <nick> [<nick>...]\n\nShows which of the given nicks are online.",
+	"join":         "JOIN <channel>{,<channel>}\n\nJoins one or more channels. Channel names start with # or &.",
+	"kill":         "KILL <nick> [:<reason>]\n\nDisconnects a user from the server. Operators only.",
+	"kline":        "KLINE <user@host> [<duration>] :<reason>\n\nBans a user@host mask from the server, and disconnects anyone\nmatching it. The host may be an IP, a CIDR network, or a host\nwith * and ? wildcards. Durations look like 30m, 12h or 7d, and\nare permanent if left out. Operators only.",
+	"lusers":       "LUSERS\n\nShows the number of users, operators, and channels on this server.",
+	"list":         "LIST [<filter>{,<filter>}]\n\nLists channels. Filters may be channel masks, !mask to\nexclude channels, or >n and <n for user counts.",
+	"mode":         "MODE <nick|channel> [<modes> [<params>]]\n\nShows the modes set on a user or channel, or changes your own\nuser modes:\n  i - invisible\n  w - receive wallops\n  s - receive server notices (operators only)\nChannel operators may change channel modes:\n  o <nick> - channel operator\n  v <nick> - voice\n  m - moderated, only ops and voiced users may talk\n  n - no messages from outside the channel\n  s - secret, hidden from LIST\n  t - only ops may change the topic",
+	"names":        "NAMES <channel>{,<channel>}\n\nLists the users in one or more channels.",
+	"monitor":      "MONITOR <+|-> <nick>{,<nick>}\nMONITOR <C|L|S>\n\nWatches nicks and tells you when they come online or go offline.\n+ and - add and remove nicks, C clears the list, L lists it, and\nS shows whether each nick is online.",
+	"motd":         "MOTD\n\nShows the message of the day.",
+	"nick":         "NICK <nickname>\n\nSets or changes your nickname.",
+	"notice":       "NOTICE <target> :<message>\n\nSends a notice to a user or channel. Services don't answer notices.",
+	"oper":         "OPER <name> <password>\n\nIdentifies you as an IRC operator.",
+	"part":         "PART <channel>{,<channel>} [:<reason>]\n\nLeaves one or more channels.",
+	"pass":         "PASS <password>\n\nSets a connection password. Must be sent before NICK and USER.",
+	"ping":         "PING <token>\n\nChecks that the server is still responding.",
+	"pong":         "PONG <token>\n\nReplies to a PING from the server.",
+	"privmsg":      "PRIVMSG <target> :<message>\n\nSends a message to a user or channel.",
+	"quit":         "QUIT [:<reason>]\n\nDisconnects you from the server.",
+	"register":     "REGISTER <account|*> <email|*> <password>\n\nRegisters an account. Use * as the account name to register your\ncurrent nick. You can also register with /msg NickServ REGISTER.",
+	"rehash":       "REHASH\n\nReloads the MOTD, help, and rules files. Operators only.",
+	"rules":        "RULES\n\nShows the rules of this server.",
+	"setname":      "SETNAME :<realname>\n\nChanges your real name.",
+	"stats":        "STATS <b|k|l|m|o|u|z>\n\nShows DNS blocklist hits, K-lines, connections, command usage,\noperators, uptime, or Z-lines. Operators only.",
+	"tagmsg":       "TAGMSG <target>\n\nSends only message tags, such as typing notifications, to a user or\nchannel. Needs the message-tags capability.",
+	"time":         "TIME\n\nShows the local time on this server.",
+	"topic":        "TOPIC <channel> [:<topic>]\n\nShows or changes the topic of a channel.",
+	"undline":      "UNDLINE <ip|network>\n\nThe same as UNZLINE.",
+	"unkline":      "UNKLINE <user@host>\n\nLifts a K-line. Operators only.",
+	"unzline":      "UNZLINE <ip|network>\n\nLifts a Z-line. Operators only.",
+	"user":         "USER <username> <mode> <unused> :<realname>\n\nSets your username and real name when connecting.",
+	"userhost":     "USERHOST <nick> [<nick>...]\n\nShows the username and host of up to 5 users. * marks an operator,\nand - marks someone who is away.",
+	"users":        "USERS\n\nLists the users logged into this server.",
+	"verify":       "VERIFY <account> <code>\n\nVerifies a newly registered account with the code sent to you.",
+	"version":      "VERSION\n\nShows the version of the server software.",
+	"wallops":      "WALLOPS :<message>\n\nSends a message to every user with user mode +w. Operators only.",
+	"who":          "WHO <channel|mask>\n\nLists users in a channel, or users who match a mask. Masks may\nbe a nick, nick!user@host, or $a:account.",
+	"whois":        "WHOIS <nick>\n\nShows information about a user. Operators, and the user themselves,\nalso see the address they are connecting from.",
+	"zline":        "ZLINE <ip|network> [<duration>] :<reason>\n\nBans an IP address or CIDR network from connecting, and disconnects\nanyone using it. Durations look like 30m, 12h or 7d, and are\npermanent if left out. Operators only.",
+}
+
+// Load help topics into ServerInfo. Each file in the help directory is a
+// topic named after the file, without its extension. A missing directory
+// is not fatal; the built-in topics are still available.
+func readHelp(s *ServerInfo, dir string) {
+	help := make(map[string][]string)
+	for topic, text := range defaultHelp {
+		help[topic] = strings.Split(text, NEWLINE)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Println("Couldn't read help directory, using built-in help:", err)
+	}
+
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		lines, err := readLines(filepath.Join(dir, f.Name()))
+		if err != nil {
+			log.Println("Couldn't read help topic", f.Name(), err)
+			continue
+		}
+
+		topic := strings.ToLower(strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))
+		help[topic] = lines
+	}
+
+	// build an index of every topic unless one was provided
+	if _, exists := help[HELP_INDEX]; !exists {
+		topics := []string{}
+		for topic := range help {
+			topics = append(topics, strings.ToUpper(topic))
+		}
+		sort.Strings(topics)
+
+		index := []string{"Help topics available to users:", ""}
+		for i := 0; i < len(topics); i += 6 {
+			end := i + 6
+			if end > len(topics) {
+				end = len(topics)
+			}
+			index = append(index, strings.Join(topics[i:end], SPACE))
+		}
+		index = append(index, "", "Use HELP <topic> for more information.")
+
+		help[HELP_INDEX] = index
+	}
+
+	s.HelpData = help
+
+	log.Println("Help Loaded")
+}
+
+// Load the server rules. Without a rules file, RULES replies with ERR_NORULES.
+func readRules(s *ServerInfo, path string) {
+	if len(path) == 0 {
+		s.RulesData = nil
+		return
+	}
+
+	lines, err := readLines(path)
+	if err != nil {
+		log.Println("Couldn't read rules file:", err)
+		s.RulesData = nil
+		return
+	}
+
+	s.RulesData = lines
+
+	log.Println("Rules Loaded")
+}
+
+func (c *Client) sendHelp(s *ServerInfo, topic string) {
+	topic = strings.ToLower(strings.Trim(topic, SPACE))
+	if len(topic) == 0 {
+		topic = HELP_INDEX
+	}
+
+	lines, exists := s.HelpData[topic]
+	if !exists {
+		c.sendServerTargetInfo(s, ERR_HELPNOTFOUND, topic, "No help available on this topic")
+		return
+	}
+
+	for i, line := range lines {
+		if i == 0 {
+			c.sendServerTargetInfo(s, RPL_HELPSTART, topic, line)
+		} else {
+			c.sendServerTargetInfo(s, RPL_HELPTXT, topic, line)
+		}
+	}
+	c.sendServerTargetInfo(s, RPL_ENDOFHELP, topic, "End of /HELP")
+}
+
+func (c *Client) sendRules(s *ServerInfo) {
+	if len(s.RulesData) == 0 {
+		c.sendServerMessage(s, ERR_NORULES, "RULES File is missing")
+		return
+	}
+
+	c.sendServerMessage(s, RPL_RULESSTART, "- "+s.Hostname+" Server Rules - ")
+	for _, line := range s.RulesData {
+		c.sendServerMessage(s, RPL_RULES, "- "+line)
+	}
+	c.sendServerMessage(s, RPL_ENDOFRULES, "End of RULES command.")
+}
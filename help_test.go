@@ -0,0 +1,62 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadHelp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gochat-help")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "JOIN.txt"), []byte("Custom join help\nSecond line\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cloaks"), []byte("About cloaks\n"), 0644)
+
+	s := new(ServerInfo)
+	readHelp(s, dir)
+
+	if join := s.HelpData["join"]; len(join) != 2 || join[0] != "Custom join help" {
+		t.Errorf("Help file didn't replace built-in topic: %v", join)
+	}
+
+	if _, exists := s.HelpData["cloaks"]; !exists {
+		t.Error("Help file without extension wasn't loaded")
+	}
+
+	if _, exists := s.HelpData["nick"]; !exists {
+		t.Error("Built-in topic missing")
+	}
+
+	if _, exists := s.HelpData[HELP_INDEX]; !exists {
+		t.Error("Help index wasn't generated")
+	}
+
+	// a missing directory still provides built-in topics
+	readHelp(s, filepath.Join(dir, "missing"))
+	if join := s.HelpData["join"]; len(join) == 0 || join[0] == "Custom join help" {
+		t.Error("Built-in help wasn't used for a missing directory")
+	}
+}
@@ -0,0 +1,291 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Lines kept for each channel and conversation, if not set in config.ini
+const DEFAULT_HISTORY_LINES = 1000
+
+// A message kept in history
+type HistoryItem struct {
+	MsgID   string
+	Time    time.Time
+	Source  string // nick!user@host of the sender
+	Account string `json:",omitempty"`
+	Command string // PRIVMSG or NOTICE
+	Target  string
+	Text    string
+}
+
+// Recent messages for every channel and private conversation. Channels are
+// keyed by their lowercase name, and conversations between two accounts by
+// both account names. If `dir` is set, each buffer is also kept in a file
+// with one JSON message per line.
+type HistoryStore struct {
+	dir      string
+	maxLines int
+	maxAge   time.Duration // 0 keeps messages until there are too many
+	buffers  map[string]*historyBuffer
+}
+
+type historyBuffer struct {
+	items    []HistoryItem
+	appended int // lines appended to the file since it was last rewritten
+}
+
+// Create the history store, loading any saved history from `dir`
+func loadHistory(dir string, maxLines, maxAge int) *HistoryStore {
+	if maxLines <= 0 {
+		maxLines = DEFAULT_HISTORY_LINES
+	}
+
+	h := &HistoryStore{
+		dir:      dir,
+		maxLines: maxLines,
+		maxAge:   time.Duration(maxAge) * time.Second,
+		buffers:  make(map[string]*historyBuffer),
+	}
+
+	if len(dir) == 0 {
+		return h
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatal("Couldn't create history directory: ", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Fatal("Couldn't read history directory: ", err)
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+
+		key, err := url.PathUnescape(strings.TrimSuffix(name, ".log"))
+		if err != nil {
+			continue
+		}
+
+		buf := &historyBuffer{items: readHistoryFile(filepath.Join(dir, name))}
+		h.buffers[key] = buf
+		h.trim(buf)
+	}
+
+	log.Println("History Loaded")
+	return h
+}
+
+// Read every message from a history file, skipping lines which don't parse
+func readHistoryFile(path string) []HistoryItem {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("Couldn't read history file", path, err)
+		return nil
+	}
+	defer file.Close()
+
+	items := []HistoryItem{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var item HistoryItem
+		if json.Unmarshal(scanner.Bytes(), &item) == nil {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// The history key for a private conversation between two accounts
+func conversationKey(a, b string) string {
+	names := []string{strings.ToLower(a), strings.ToLower(b)}
+	sort.Strings(names)
+	return strings.Join(names, COMMA)
+}
+
+// Add a message to a buffer, dropping the oldest messages if it's full
+func (h *HistoryStore) add(key string, item HistoryItem) {
+	buf, exists := h.buffers[key]
+	if !exists {
+		buf = &historyBuffer{}
+		h.buffers[key] = buf
+	}
+
+	buf.items = append(buf.items, item)
+	trimmed := h.trim(buf)
+
+	if len(h.dir) > 0 {
+		h.persist(key, buf, item, trimmed)
+	}
+}
+
+// Get the messages in a buffer, oldest first
+func (h *HistoryStore) get(key string) []HistoryItem {
+	buf, exists := h.buffers[key]
+	if !exists {
+		return nil
+	}
+
+	h.trim(buf)
+	return buf.items
+}
+
+// Private conversations involving an account, along with the name of the
+// other account in each one
+func (h *HistoryStore) conversations(account string) map[string]string {
+	account = strings.ToLower(account)
+	found := make(map[string]string)
+
+	for key := range h.buffers {
+		names := strings.Split(key, COMMA)
+		if len(names) != 2 {
+			continue
+		}
+
+		if names[0] == account {
+			found[key] = names[1]
+		} else if names[1] == account {
+			found[key] = names[0]
+		}
+	}
+
+	return found
+}
+
+// Drop messages which are too old or over the line limit. Returns true if
+// anything was dropped.
+func (h *HistoryStore) trim(buf *historyBuffer) bool {
+	start := 0
+	if len(buf.items) > h.maxLines {
+		start = len(buf.items) - h.maxLines
+	}
+
+	if h.maxAge > 0 {
+		cutoff := time.Now().Add(-h.maxAge)
+		for start < len(buf.items) && buf.items[start].Time.Before(cutoff) {
+			start++
+		}
+	}
+
+	if start == 0 {
+		return false
+	}
+
+	buf.items = append([]HistoryItem(nil), buf.items[start:]...)
+	return true
+}
+
+// Save a new message to disk. Messages are appended, and the file is
+// rewritten from memory once enough old messages have been dropped.
+func (h *HistoryStore) persist(key string, buf *historyBuffer, item HistoryItem, trimmed bool) {
+	path := filepath.Join(h.dir, url.PathEscape(key)+".log")
+
+	if trimmed && buf.appended >= h.maxLines {
+		buf.appended = 0
+		if err := writeHistoryFile(path, buf.items); err != nil {
+			log.Println("Couldn't rewrite history file", path, err)
+		}
+		return
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("Couldn't write history file", path, err)
+		return
+	}
+	defer file.Close()
+
+	file.Write(append(data, '\n'))
+	buf.appended++
+}
+
+// Replace a history file atomically
+func writeHistoryFile(path string, items []HistoryItem) error {
+	lines := []byte{}
+	for _, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, data...), '\n')
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, lines, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Make a history item for a message, using the time and msgid it was sent with
+func newHistoryItem(sender *Client, command, target, text string, tags map[string]string) HistoryItem {
+	sent, err := time.Parse(SERVER_TIME_FORMAT, tags["time"])
+	if err != nil {
+		sent = time.Now().UTC()
+	}
+
+	return HistoryItem{
+		MsgID:   tags["msgid"],
+		Time:    sent,
+		Source:  sender.String(),
+		Account: sender.Account,
+		Command: command,
+		Target:  target,
+		Text:    text,
+	}
+}
+
+// Send a message from history, with the tags it was originally sent with
+func (c *Client) sendHistoryItem(item HistoryItem, batch string) {
+	tags := map[string]string{
+		"time":  serverTime(item.Time),
+		"msgid": item.MsgID,
+	}
+	if len(item.Account) > 0 {
+		tags["account"] = item.Account
+	}
+	if len(batch) > 0 {
+		tags["batch"] = batch
+	}
+
+	c.sendTagged(tags, ":"+item.Source+" "+item.Command+" "+item.Target+" :"+item.Text)
+}
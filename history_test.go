@@ -0,0 +1,99 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testHistoryItems(h *HistoryStore, key string, n int) []HistoryItem {
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	for i := 0; i < n; i++ {
+		h.add(key, HistoryItem{
+			MsgID:   "id" + strconv.Itoa(i),
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			Source:  "tester!tester@example.com",
+			Command: "PRIVMSG",
+			Target:  "#test",
+			Text:    "message " + strconv.Itoa(i),
+		})
+	}
+
+	return h.get(key)
+}
+
+func TestHistoryStore(t *testing.T) {
+	dir := t.TempDir()
+
+	h := loadHistory(dir, 5, 0)
+	items := testHistoryItems(h, "#test", 8)
+	if len(items) != 5 || items[0].MsgID != "id3" {
+		t.Fatalf("History wasn't trimmed to 5 lines: %v", items)
+	}
+
+	reloaded := loadHistory(dir, 5, 0).get("#test")
+	if len(reloaded) != 5 || reloaded[4].Text != "message 7" {
+		t.Errorf("History wasn't saved: %v", reloaded)
+	}
+
+	aged := loadHistory(dir, 5, 60*30).get("#test")
+	for _, item := range aged {
+		if time.Since(item.Time) > 30*time.Minute {
+			t.Errorf("Message %s is older than HistoryAge", item.MsgID)
+		}
+	}
+
+	if key := conversationKey("Bob", "alice"); key != "alice,bob" {
+		t.Errorf("Conversation key is %s", key)
+	}
+}
+
+func TestHistoryRefs(t *testing.T) {
+	items := testHistoryItems(loadHistory("", 100, 0), "#test", 10)
+
+	lo, hi := refBounds(items, historyRef{msgid: "id4"})
+	if lo != 4 || hi != 5 {
+		t.Errorf("msgid bounds are %d, %d", lo, hi)
+	}
+
+	before := latest(items[:lo], 3)
+	if len(before) != 3 || before[0].MsgID != "id1" || before[2].MsgID != "id3" {
+		t.Errorf("BEFORE returned %v", before)
+	}
+
+	after := earliest(items[hi:], 2)
+	if len(after) != 2 || after[0].MsgID != "id5" {
+		t.Errorf("AFTER returned %v", after)
+	}
+
+	ref, ok := parseHistoryRef("timestamp=" + serverTime(items[7].Time))
+	if !ok {
+		t.Fatal("Couldn't parse timestamp reference")
+	}
+
+	if lo, hi = refBounds(items, ref); lo != 7 || hi != 8 {
+		t.Errorf("timestamp bounds are %d, %d", lo, hi)
+	}
+
+	if _, ok = parseHistoryRef("bogus=1"); ok {
+		t.Error("Invalid reference was accepted")
+	}
+}
@@ -0,0 +1,231 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Longest vhost that can be assigned
+const VHOSTLEN = 63
+
+var hostServHelp = []string{
+	"HostServ gives accounts a custom host (vhost) instead of a cloak.",
+	"  REQUEST <vhost> - Ask the operators for a vhost",
+	"  ON              - Use your vhost",
+	"  OFF             - Stop using your vhost",
+	"Operators only:",
+	"  WAITING                 - List vhost requests",
+	"  ACTIVATE <account>      - Approve an account's request",
+	"  REJECT <account>        - Reject an account's request",
+	"  SET <account> <vhost>   - Give an account a vhost",
+	"  DEL <account>           - Take away an account's vhost",
+}
+
+func hostServ(s *ServerInfo, service, sender *Client, message string,
+	users map[string]*Client, channels map[string]*Channel) {
+	command, params := serviceCommand(message)
+
+	if command == "HELP" || command == "" {
+		for _, line := range hostServHelp {
+			service.notice(sender, line)
+		}
+		return
+	}
+
+	acct, identified := s.accounts.get(sender.Account)
+	if !identified {
+		service.notice(sender, "You must identify with NickServ to use HostServ")
+		return
+	}
+
+	switch command {
+	case "REQUEST":
+		if len(params) != 1 {
+			service.notice(sender, "Syntax: REQUEST <vhost>")
+			return
+		}
+
+		if !validVHost(params[0]) {
+			service.notice(sender, params[0]+" is not a valid vhost")
+			return
+		}
+
+		acct.VHostRequest = params[0]
+		s.accounts.save()
+
+		service.notice(sender, "Your request for "+params[0]+" has been sent to the operators")
+		serverNotice(s, users, SNO_OPERS, "vhost "+params[0]+" requested by "+acct.Name)
+		return
+	case "ON", "OFF":
+		if len(acct.VHost) == 0 {
+			service.notice(sender, "You don't have a vhost")
+			return
+		}
+
+		acct.VHostOn = command == "ON"
+		s.accounts.save()
+		updateAccountCloaks(s, acct, users, channels)
+
+		if acct.VHostOn {
+			service.notice(sender, "Your vhost "+acct.VHost+" is now on")
+		} else {
+			service.notice(sender, "Your vhost is now off")
+		}
+		return
+	case "WAITING", "ACTIVATE", "REJECT", "SET", "DEL":
+		if !sender.hasMode("o") {
+			service.notice(sender, "Only operators may use "+command)
+			return
+		}
+	default:
+		service.notice(sender, "Unknown command "+command+". Send HELP for a list of commands.")
+		return
+	}
+
+	if command == "WAITING" {
+		var waiting []string
+		for _, a := range s.accounts.Accounts {
+			if len(a.VHostRequest) > 0 {
+				waiting = append(waiting, a.Name+"  "+a.VHostRequest)
+			}
+		}
+		sort.Strings(waiting)
+
+		for _, line := range waiting {
+			service.notice(sender, line)
+		}
+		service.notice(sender, "End of vhost requests")
+		return
+	}
+
+	if command == "SET" && len(params) != 2 {
+		service.notice(sender, "Syntax: SET <account> <vhost>")
+		return
+	} else if command != "SET" && len(params) != 1 {
+		service.notice(sender, "Syntax: "+command+" <account>")
+		return
+	}
+
+	target, exists := s.accounts.get(params[0])
+	if !exists {
+		service.notice(sender, params[0]+" is not registered")
+		return
+	}
+
+	switch command {
+	case "ACTIVATE":
+		if len(target.VHostRequest) == 0 {
+			service.notice(sender, target.Name+" hasn't requested a vhost")
+			return
+		}
+
+		setVHost(s, target, target.VHostRequest, users, channels)
+		service.notice(sender, target.Name+"'s vhost is now "+target.VHost)
+		noticeAccount(target, service, users, "Your vhost request was approved. Your vhost is now "+target.VHost)
+	case "REJECT":
+		if len(target.VHostRequest) == 0 {
+			service.notice(sender, target.Name+" hasn't requested a vhost")
+			return
+		}
+
+		target.VHostRequest = ""
+		s.accounts.save()
+		service.notice(sender, target.Name+"'s vhost request has been rejected")
+		noticeAccount(target, service, users, "Your vhost request was rejected")
+	case "SET":
+		if !validVHost(params[1]) {
+			service.notice(sender, params[1]+" is not a valid vhost")
+			return
+		}
+
+		setVHost(s, target, params[1], users, channels)
+		service.notice(sender, target.Name+"'s vhost is now "+target.VHost)
+	case "DEL":
+		target.VHost, target.VHostOn = "", false
+		s.accounts.save()
+		updateAccountCloaks(s, target, users, channels)
+		service.notice(sender, target.Name+"'s vhost has been removed")
+	}
+
+	log.Println(sender.Nick, "used HostServ", command, "on", target.Name)
+}
+
+// Give an account a vhost, turn it on, and show it for anyone logged in
+func setVHost(s *ServerInfo, acct *Account, vhost string,
+	users map[string]*Client, channels map[string]*Channel) {
+	acct.VHost, acct.VHostOn, acct.VHostRequest = vhost, true, ""
+	s.accounts.save()
+	updateAccountCloaks(s, acct, users, channels)
+}
+
+// Update the host of every client logged into an account
+func updateAccountCloaks(s *ServerInfo, acct *Account,
+	users map[string]*Client, channels map[string]*Channel) {
+	for _, u := range users {
+		if u.service == nil && strings.EqualFold(u.Account, acct.Name) {
+			u.updateCloak(s, channels)
+		}
+	}
+}
+
+// Send a notice from a service to every client logged into an account
+func noticeAccount(acct *Account, service *Client, users map[string]*Client, message string) {
+	for _, u := range users {
+		if u.service == nil && strings.EqualFold(u.Account, acct.Name) {
+			service.notice(u, message)
+		}
+	}
+}
+
+// Check that a vhost looks like a hostname. Parts are separated by dots or
+// slashes and made of letters, digits and dashes. IP addresses and account
+// cloaks aren't allowed, so a vhost can't be mistaken for either.
+func validVHost(vhost string) bool {
+	if len(vhost) == 0 || len(vhost) > VHOSTLEN || net.ParseIP(vhost) != nil {
+		return false
+	}
+
+	if strings.HasPrefix(strings.ToLower(vhost), "user/") {
+		return false
+	}
+
+	for _, part := range strings.FieldsFunc(vhost, func(r rune) bool { return r == '.' || r == '/' }) {
+		if part[0] == '-' || part[len(part)-1] == '-' {
+			return false
+		}
+	}
+
+	prev := '.'
+	for _, r := range vhost {
+		separator := r == '.' || r == '/'
+		if separator && (prev == '.' || prev == '/') {
+			return false
+		}
+		if !separator && r != '-' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') {
+			return false
+		}
+		prev = r
+	}
+
+	return prev != '.' && prev != '/'
+}
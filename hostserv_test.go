@@ -0,0 +1,104 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestValidVHost(t *testing.T) {
+	for vhost, valid := range map[string]bool{
+		"staff.example":        true,
+		"gochat/staff/camconn": true,
+		"a-b.c9":               true,
+		"":                     false,
+		"-staff.example":       false,
+		"staff-.example":       false,
+		"staff..example":       false,
+		"staff.example.":       false,
+		"/staff":               false,
+		"sta ff":               false,
+		"staff_example":        false,
+		"192.0.2.1":            false,
+		"user/camconn":         false,
+	} {
+		if validVHost(vhost) != valid {
+			t.Errorf("validVHost(%q) should be %v", vhost, valid)
+		}
+	}
+}
+
+func TestHostServ(t *testing.T) {
+	s := &ServerInfo{
+		Hostname:    "irc.example.com",
+		CloakSecret: "secret",
+		accounts:    &AccountStore{Accounts: make(map[string]*Account)},
+	}
+	users := make(map[string]*Client)
+	channels := make(map[string]*Channel)
+	hostserv := newService(s, "HostServ", hostServ)
+	addService(users, hostserv)
+
+	if _, err := s.accounts.create("camconn", "hunter2hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.accounts.create("oper", "hunter2hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := newPipeClient(t, "camconn")
+	user.Account = "camconn"
+	user.Cloak = s.cloakFor(user)
+	users["camconn"] = user
+
+	oper, _ := newPipeClient(t, "oper")
+	oper.Account = "oper"
+	users["oper"] = oper
+
+	hostServ(s, hostserv, user, "REQUEST staff.example", users, channels)
+	if user.Cloak != cloakIP("secret", user.IP()) {
+		t.Error("vhost was used before it was approved:", user.Cloak)
+	}
+
+	hostServ(s, hostserv, user, "ACTIVATE camconn", users, channels)
+	if user.Cloak != cloakIP("secret", user.IP()) {
+		t.Error("A user approved their own vhost")
+	}
+
+	oper.addMode("o")
+	hostServ(s, hostserv, oper, "ACTIVATE camconn", users, channels)
+	if user.Cloak != "staff.example" {
+		t.Error("Approved vhost wasn't applied:", user.Cloak)
+	}
+
+	hostServ(s, hostserv, user, "OFF", users, channels)
+	if user.Cloak != cloakIP("secret", user.IP()) {
+		t.Error("vhost is still used after OFF:", user.Cloak)
+	}
+
+	hostServ(s, hostserv, user, "ON", users, channels)
+	if user.Cloak != "staff.example" {
+		t.Error("vhost isn't used after ON:", user.Cloak)
+	}
+
+	hostServ(s, hostserv, oper, "DEL camconn", users, channels)
+	if user.Cloak != cloakIP("secret", user.IP()) {
+		t.Error("vhost is still used after DEL:", user.Cloak)
+	}
+}
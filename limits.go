@@ -0,0 +1,194 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection limits, if not set in config.ini
+const (
+	DEFAULT_MAX_PER_IP      = 5
+	DEFAULT_MAX_PER_NET     = 20
+	DEFAULT_IPV4_NET_BITS   = 24
+	DEFAULT_IPV6_NET_BITS   = 64
+	DEFAULT_THROTTLE_COUNT  = 5
+	DEFAULT_THROTTLE_PERIOD = 60 // seconds
+)
+
+// Decides which new connections are let in. Counts are kept per IP and per
+// network (a /24 or /64 by default), along with recent connection times for
+// throttling. Both listeners and every connection's reader use it, so it's
+// locked while it's used.
+type ConnLimits struct {
+	mu       sync.Mutex
+	maxIP    int
+	maxNet   int
+	v4Bits   int
+	v6Bits   int
+	throttle int
+	period   time.Duration
+	exempt   []*net.IPNet
+	bans     *BanStore
+	perIP    map[string]int
+	perNet   map[string]int
+	recent   map[string][]time.Time // IP => recent connection times
+}
+
+func newConnLimits(s *ServerInfo) *ConnLimits {
+	l := &ConnLimits{
+		maxIP:    s.MaxPerIP,
+		maxNet:   s.MaxPerNet,
+		v4Bits:   s.IPv4NetBits,
+		v6Bits:   s.IPv6NetBits,
+		throttle: s.ThrottleCount,
+		period:   time.Duration(s.ThrottlePeriod) * time.Second,
+		bans:     s.bans,
+		perIP:    make(map[string]int),
+		perNet:   make(map[string]int),
+		recent:   make(map[string][]time.Time),
+	}
+
+	if l.maxIP <= 0 {
+		l.maxIP = DEFAULT_MAX_PER_IP
+	}
+	if l.maxNet <= 0 {
+		l.maxNet = DEFAULT_MAX_PER_NET
+	}
+	if l.v4Bits <= 0 || l.v4Bits > 32 {
+		l.v4Bits = DEFAULT_IPV4_NET_BITS
+	}
+	if l.v6Bits <= 0 || l.v6Bits > 128 {
+		l.v6Bits = DEFAULT_IPV6_NET_BITS
+	}
+	if l.throttle <= 0 {
+		l.throttle = DEFAULT_THROTTLE_COUNT
+	}
+	if l.period <= 0 {
+		l.period = DEFAULT_THROTTLE_PERIOD * time.Second
+	}
+
+	l.exempt = parseIPMasks("ConnectExempt", s.ConnectExempt)
+
+	return l
+}
+
+// Decide whether a connection from `ip` may be accepted at time `now`. If it
+// may, it's counted until release is called for it. Otherwise the reason it
+// was refused is returned.
+func (l *ConnLimits) admit(ip net.IP, now time.Time) (bool, string) {
+	if l.exempted(ip) {
+		return true, ""
+	}
+
+	if l.bans != nil {
+		if ban := l.bans.zlined(ip); ban != nil {
+			return false, "Z-lined: " + ban.Reason
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key, network := ip.String(), l.network(ip)
+
+	// forget connections from before the throttle period
+	recent := l.recent[key]
+	for len(recent) > 0 && now.Sub(recent[0]) >= l.period {
+		recent = recent[1:]
+	}
+	if len(recent) >= l.throttle {
+		l.recent[key] = recent
+		return false, "Throttled: Reconnecting too fast"
+	}
+	l.recent[key] = append(recent, now)
+
+	if l.perIP[key] >= l.maxIP {
+		return false, fmt.Sprintf("Too many connections from your IP (%d)", l.maxIP)
+	}
+	if l.perNet[network] >= l.maxNet {
+		return false, fmt.Sprintf("Too many connections from your network (%d)", l.maxNet)
+	}
+
+	l.perIP[key]++
+	l.perNet[network]++
+	return true, ""
+}
+
+// Stop counting a connection which admit let in
+func (l *ConnLimits) release(ip net.IP) {
+	if l.exempted(ip) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key, network := ip.String(), l.network(ip)
+	if l.perIP[key]--; l.perIP[key] <= 0 {
+		delete(l.perIP, key)
+	}
+	if l.perNet[network]--; l.perNet[network] <= 0 {
+		delete(l.perNet, network)
+	}
+
+	// throttle entries for IPs which aren't connected any more are only
+	// needed until the throttle period is over
+	for k, times := range l.recent {
+		if _, connected := l.perIP[k]; !connected && time.Since(times[len(times)-1]) >= l.period {
+			delete(l.recent, k)
+		}
+	}
+}
+
+// Exempt IPs are never limited, throttled or Z-lined
+func (l *ConnLimits) exempted(ip net.IP) bool {
+	return ipInMasks(ip, l.exempt)
+}
+
+// The network an IP is counted in for MaxPerNet
+func (l *ConnLimits) network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.v4Bits, 32)).String() + fmt.Sprintf("/%d", l.v4Bits)
+	}
+	return ip.Mask(net.CIDRMask(l.v6Bits, 128)).String() + fmt.Sprintf("/%d", l.v6Bits)
+}
+
+// The IP address a connection comes from
+func remoteIP(conn net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Tell a refused connection why, then close it. This runs on its own so a
+// slow client can't hold up the listener.
+func refuseConnection(conn net.Conn, ip net.IP, reason string) {
+	log.Println("Refused connection from", ip, "-", reason)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ERROR :Closing Link: " + ip.String() + " (" + reason + ")" + CRLF))
+	conn.Close()
+}
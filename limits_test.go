@@ -0,0 +1,135 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimits(t *testing.T) {
+	l := newConnLimits(&ServerInfo{
+		MaxPerIP:       2,
+		MaxPerNet:      3,
+		ThrottleCount:  10,
+		ThrottlePeriod: 60,
+		ConnectExempt:  "127.0.0.1",
+	})
+	now := time.Now()
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		if ok, reason := l.admit(ip, now); !ok {
+			t.Fatalf("Connection %d was refused: %s", i+1, reason)
+		}
+	}
+	if ok, _ := l.admit(ip, now); ok {
+		t.Error("Accepted more than MaxPerIP connections")
+	}
+
+	if ok, _ := l.admit(net.ParseIP("192.0.2.2"), now); !ok {
+		t.Error("Refused a connection from another IP in the network")
+	}
+	if ok, _ := l.admit(net.ParseIP("192.0.2.3"), now); ok {
+		t.Error("Accepted more than MaxPerNet connections")
+	}
+	if ok, _ := l.admit(net.ParseIP("198.51.100.1"), now); !ok {
+		t.Error("Refused a connection from another network")
+	}
+
+	l.release(ip)
+	if ok, _ := l.admit(ip, now); !ok {
+		t.Error("Refused a connection after one was released")
+	}
+
+	for i := 0; i < 20; i++ {
+		if ok, _ := l.admit(net.ParseIP("127.0.0.1"), now); !ok {
+			t.Fatal("Refused a connection from an exempt IP")
+		}
+	}
+}
+
+func TestConnThrottle(t *testing.T) {
+	l := newConnLimits(&ServerInfo{ThrottleCount: 2, ThrottlePeriod: 60})
+	ip := net.ParseIP("2001:db8::1")
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		l.admit(ip, now)
+		l.release(ip)
+	}
+	if ok, _ := l.admit(ip, now.Add(time.Second)); ok {
+		t.Error("Reconnecting too fast wasn't throttled")
+	}
+	if ok, reason := l.admit(ip, now.Add(time.Minute)); !ok {
+		t.Error("Still throttled after the throttle period:", reason)
+	}
+}
+
+func TestZLinedConnection(t *testing.T) {
+	s := &ServerInfo{bans: &BanStore{}}
+	l := newConnLimits(s)
+	s.bans.addZLine("192.0.2.0/24", "spam", "oper", 0)
+
+	if ok, reason := l.admit(net.ParseIP("192.0.2.9"), time.Now()); ok || reason != "Z-lined: spam" {
+		t.Error("Z-lined IP was let in:", reason)
+	}
+}
+
+func TestConnLimitReleasedOnRemove(t *testing.T) {
+	s := &ServerInfo{
+		MaxPerIP:       1,
+		ThrottleCount:  10,
+		ThrottlePeriod: 60,
+		accounts:       &AccountStore{Accounts: make(map[string]*Account)},
+	}
+	s.limits = newConnLimits(s)
+	ip := net.ParseIP("192.0.2.1")
+
+	l := s.limits
+	if ok, reason := l.admit(ip, time.Now()); !ok {
+		t.Fatal("Connection was refused:", reason)
+	}
+
+	cl, _ := newPipeClient(t, "tester")
+	cl.limitIP = ip
+
+	// the IP's slot is taken until the event handler removes the client
+	if ok, _ := l.admit(ip, time.Now()); ok {
+		t.Error("Accepted more than MaxPerIP connections")
+	}
+
+	removeClient(s, cl, "Bye", make(map[string]*Client), make(map[string]*Channel))
+	if ok, _ := l.admit(ip, time.Now()); !ok {
+		t.Error("Connection limit wasn't released when the client was removed")
+	}
+}
+
+func TestUnknownAddressRefused(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// a pipe has no IP address, so the connection can't be counted
+	acceptConnection(&ServerInfo{}, server, listenerOptions{}, nil, nil)
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection without an IP wasn't closed: %v", err)
+	}
+}
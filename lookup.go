@@ -0,0 +1,265 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seconds to wait for DNS and ident, if not set in config.ini
+const DEFAULT_LOOKUP_TIMEOUT = 5
+
+// Longest username accepted from an ident server
+const USERLEN = 10
+
+// Looks up hostnames for connecting clients. *net.Resolver satisfies this,
+// and tests can use a stand-in.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Asks a client's ident server which user owns the connection from `remote`
+// (the client's end) to `local` (the server's end)
+type IdentFunc func(ctx context.Context, remote, local *net.TCPAddr) (string, error)
+
+// Send the notices for the lookups a new connection is waiting on, and start
+// them. Hostname and ident results come back to the event handler as a
+// LOOKUP event, and blocklist results as a DNSBL event.
+//
+// The event handler may use the client as soon as a lookup is started, so
+// this must be called once the client is otherwise set up and its writeLoop
+// is running.
+func (s *ServerInfo) startLookups(cl *Client, events chan<- *Event) {
+	blocklist := false
+	if s.dnsbl != nil && len(s.dnsbl.zones) > 0 {
+		ip := net.ParseIP(cl.IP())
+		blocklist = ip == nil || s.limits == nil || !s.limits.exempted(ip)
+	}
+	resolve := s.ResolveHostnames || s.IdentLookups
+
+	if blocklist {
+		cl.lookups++
+	}
+	if resolve {
+		cl.lookups++
+	}
+
+	if s.ResolveHostnames {
+		cl.sendMessage(s.Hostname + " NOTICE * :*** Looking up your hostname...")
+	}
+	if s.IdentLookups {
+		cl.sendMessage(s.Hostname + " NOTICE * :*** Checking Ident")
+	}
+
+	if resolve {
+		go func() {
+			e := NewEvent(cl, "")
+			e.Type = LOOKUP
+			e.Target, e.Body = s.lookup(cl.Conn)
+			events <- e
+		}()
+	}
+
+	// a cached blocklist result comes back straight away, and may reject
+	// the client, so this is the very last thing done
+	if blocklist {
+		go s.checkDNSBL(cl, events)
+	}
+}
+
+// How long to wait for lookups about a new connection
+func (s *ServerInfo) lookupTimeout() time.Duration {
+	if s.LookupTimeout <= 0 {
+		return DEFAULT_LOOKUP_TIMEOUT * time.Second
+	}
+	return time.Duration(s.LookupTimeout) * time.Second
+}
+
+// Look up a connection's hostname and ident username at the same time.
+// Either is blank if it's turned off or couldn't be found.
+func (s *ServerInfo) lookup(conn net.Conn) (hostname, username string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.lookupTimeout())
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	if remote == nil {
+		return "", ""
+	}
+
+	if s.ResolveHostnames {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hostname = resolveHostname(ctx, s.resolver, remote.IP)
+		}()
+	}
+
+	if s.IdentLookups && local != nil && s.ident != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if user, err := s.ident(ctx, remote, local); err == nil && validUsername(user) {
+				username = user
+			}
+		}()
+	}
+
+	wg.Wait()
+	return hostname, username
+}
+
+// Find the hostname for an IP. A hostname is only used if it resolves back
+// to the same IP, so nobody can pretend to be from somewhere else by
+// setting up reverse DNS for their IP.
+func resolveHostname(ctx context.Context, resolver Resolver, ip net.IP) string {
+	if resolver == nil {
+		return ""
+	}
+
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return ""
+	}
+
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if !validHostname(name) {
+			continue
+		}
+
+		addrs, err := resolver.LookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ip.Equal(net.ParseIP(addr)) {
+				return strings.ToLower(name)
+			}
+		}
+	}
+
+	return ""
+}
+
+// Hostnames follow the same rules as vhosts, but can't have slashes
+func validHostname(name string) bool {
+	return !strings.Contains(name, "/") && validVHost(name)
+}
+
+// Ident usernames can't be longer than USERLEN or have characters which
+// would break a nick!user@host mask
+func validUsername(user string) bool {
+	return len(user) > 0 && len(user) <= USERLEN && !strings.ContainsAny(user, "!@*?:~ \t")
+}
+
+// Query a client's ident server (RFC 1413) on port 113
+func queryIdent(ctx context.Context, remote, local *net.TCPAddr) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(remote.IP.String(), "113"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err = fmt.Fprintf(conn, "%d, %d"+CRLF, remote.Port, local.Port); err != nil {
+		return "", err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return parseIdentReply(line, remote.Port, local.Port)
+}
+
+// Get the username from an ident reply such as
+// "6193, 23 : USERID : UNIX : stjohns"
+func parseIdentReply(line string, remotePort, localPort int) (string, error) {
+	parts := strings.SplitN(strings.TrimRight(line, CRLF), ":", 4)
+	if len(parts) != 4 || strings.TrimSpace(parts[1]) != "USERID" {
+		return "", errors.New("no ident user in reply: " + line)
+	}
+
+	ports := strings.Split(parts[0], ",")
+	if len(ports) != 2 ||
+		strings.TrimSpace(ports[0]) != strconv.Itoa(remotePort) ||
+		strings.TrimSpace(ports[1]) != strconv.Itoa(localPort) {
+		return "", errors.New("ident reply is for the wrong connection: " + line)
+	}
+
+	return strings.TrimSpace(parts[3]), nil
+}
+
+// Use the results of a client's lookups, then carry on registering them
+func (c *Client) finishLookups(s *ServerInfo, hostname, username string,
+	users map[string]*Client, channels map[string]*Channel) {
+	c.lookups--
+
+	if s.ResolveHostnames {
+		if len(hostname) > 0 {
+			c.Hostname = hostname
+			c.sendMessage(s.Hostname + " NOTICE " + c.nickOrStar() + " :*** Found your hostname")
+		} else {
+			c.sendMessage(s.Hostname + " NOTICE " + c.nickOrStar() + " :*** Couldn't look up your hostname")
+		}
+	}
+
+	if s.IdentLookups {
+		if len(username) > 0 {
+			c.identUser = username
+			c.sendMessage(s.Hostname + " NOTICE " + c.nickOrStar() + " :*** Got Ident response")
+		} else {
+			c.sendMessage(s.Hostname + " NOTICE " + c.nickOrStar() + " :*** No Ident response")
+		}
+	}
+
+	completeRegistration(s, c, users, channels)
+}
+
+// With ident lookups on, a client's username is the one their ident server
+// gave, or the one they sent prefixed with "~" to show it wasn't checked
+func (c *Client) applyIdent(s *ServerInfo) {
+	if !s.IdentLookups {
+		return
+	}
+
+	if len(c.identUser) > 0 {
+		c.Username = c.identUser
+	} else if !strings.HasPrefix(c.Username, "~") {
+		c.Username = "~" + c.Username
+	}
+}
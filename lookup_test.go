@@ -0,0 +1,174 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// A stand-in resolver with fixed reverse and forward records
+type testResolver struct {
+	reverse map[string][]string
+	forward map[string][]string
+}
+
+func (r testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, exists := r.reverse[addr]; exists {
+		return names, nil
+	}
+	return nil, errors.New("no PTR record")
+}
+
+func (r testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, exists := r.forward[host]; exists {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestResolveHostname(t *testing.T) {
+	resolver := testResolver{
+		reverse: map[string][]string{
+			"192.0.2.1": {"Host.Example.com."},
+			"192.0.2.2": {"liar.example.com."},
+			"192.0.2.3": {"bad_name!.example.com."},
+		},
+		forward: map[string][]string{
+			"Host.Example.com": {"192.0.2.1"},
+			"liar.example.com": {"198.51.100.1"},
+		},
+	}
+	ctx := context.Background()
+
+	if name := resolveHostname(ctx, resolver, net.ParseIP("192.0.2.1")); name != "host.example.com" {
+		t.Errorf("Hostname is %q, not host.example.com", name)
+	}
+	if name := resolveHostname(ctx, resolver, net.ParseIP("192.0.2.2")); name != "" {
+		t.Error("Used a hostname which doesn't resolve back to the IP:", name)
+	}
+	if name := resolveHostname(ctx, resolver, net.ParseIP("192.0.2.3")); name != "" {
+		t.Error("Used an invalid hostname:", name)
+	}
+	if name := resolveHostname(ctx, resolver, net.ParseIP("192.0.2.4")); name != "" {
+		t.Error("Found a hostname for an IP without one:", name)
+	}
+}
+
+func TestParseIdentReply(t *testing.T) {
+	user, err := parseIdentReply("6193, 23 : USERID : UNIX : stjohns\r\n", 6193, 23)
+	if err != nil || user != "stjohns" {
+		t.Errorf("Ident user is %q (%v), not stjohns", user, err)
+	}
+
+	if _, err = parseIdentReply("6193, 23 : ERROR : NO-USER\r\n", 6193, 23); err == nil {
+		t.Error("Accepted an ident error")
+	}
+	if _, err = parseIdentReply("6195, 23 : USERID : UNIX : stjohns\r\n", 6193, 23); err == nil {
+		t.Error("Accepted an ident reply for another connection")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := &ServerInfo{
+		ResolveHostnames: true,
+		IdentLookups:     true,
+		resolver: testResolver{
+			reverse: map[string][]string{"127.0.0.1": {"localhost."}},
+			forward: map[string][]string{"localhost": {"127.0.0.1"}},
+		},
+		ident: func(ctx context.Context, remote, local *net.TCPAddr) (string, error) {
+			if remote.String() != client.LocalAddr().String() {
+				t.Error("Ident asked about the wrong connection:", remote)
+			}
+			return "camconn", nil
+		},
+	}
+
+	hostname, username := s.lookup(conn)
+	if hostname != "localhost" || username != "camconn" {
+		t.Errorf("Lookups found %q and %q", hostname, username)
+	}
+
+	cl := Client{Conn: conn, Username: "typed"}
+	cl.applyIdent(s)
+	if cl.Username != "~typed" {
+		t.Errorf("Unchecked username is %s, not ~typed", cl.Username)
+	}
+
+	cl = Client{Conn: conn, Username: "typed", identUser: username}
+	cl.applyIdent(s)
+	if cl.Username != "camconn" {
+		t.Errorf("Username is %s, not the ident user", cl.Username)
+	}
+}
+
+func TestStartLookups(t *testing.T) {
+	s := &ServerInfo{
+		Hostname:         "irc.example.com",
+		ResolveHostnames: true,
+		resolver:         testResolver{},
+		dnsbl:            loadDNSBL(map[string]string{"dnsbl.example": "*:reject"}, 0),
+	}
+	events := make(chan *Event)
+
+	cl, readLine := newPipeClient(t, "")
+	cl.Registered = false
+	s.startLookups(cl, events)
+
+	// everything is counted and queued before any result can come back
+	if cl.lookups != 2 {
+		t.Errorf("Client is waiting on %d lookups, not 2", cl.lookups)
+	}
+	if line := readLine(); line != ":irc.example.com NOTICE * :*** Looking up your hostname..." {
+		t.Errorf("Client was sent %q", line)
+	}
+
+	types := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		e := <-events
+		if e.Sender != cl {
+			t.Error("Lookup result is for the wrong client")
+		}
+		types[e.Type] = true
+	}
+	if !types[LOOKUP] || !types[DNSBL] {
+		t.Errorf("Lookups sent the events %v", types)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max memos waiting for an account, if not set in config.ini
+const DEFAULT_MEMO_QUOTA = 20
+
+// Seconds a client has to wait between sending memos
+const MEMO_DELAY = 5
+
+var memoServHelp = []string{
+	"MemoServ keeps messages for registered users who are offline.",
+	"  SEND <nick|account> <message> - Leave a memo for someone",
+	"  LIST                          - List your memos",
+	"  READ <number>                 - Read a memo",
+	"  DEL <number|ALL>              - Delete a memo, or all of them",
+	"Messages sent to a registered nick while nobody is using it are",
+	"kept as memos too, and delivered when its owner logs in. You must",
+	"identify with NickServ to send memos.",
+}
+
+func memoServ(s *ServerInfo, service, sender *Client, message string,
+	users map[string]*Client, channels map[string]*Channel) {
+	command, params := serviceCommand(message)
+
+	if command == "SEND" {
+		if len(params) < 2 {
+			service.notice(sender, "Syntax: SEND <nick|account> <message>")
+			return
+		}
+
+		acct, exists := s.accounts.getByNick(params[0])
+		if !exists || acct.Unverified {
+			service.notice(sender, params[0]+" is not registered")
+			return
+		}
+
+		service.notice(sender, leaveMemo(s, sender, acct, strings.Join(params[1:], SPACE), users))
+		return
+	} else if command == "HELP" || command == "" {
+		for _, line := range memoServHelp {
+			service.notice(sender, line)
+		}
+		return
+	}
+
+	acct, identified := s.accounts.get(sender.Account)
+	if !identified {
+		service.notice(sender, "You must identify with NickServ to read memos")
+		return
+	}
+
+	switch command {
+	case "LIST":
+		if len(acct.Memos) == 0 {
+			service.notice(sender, "You have no memos")
+			return
+		}
+
+		for i, memo := range acct.Memos {
+			status := " "
+			if !memo.Read {
+				status = "*"
+			}
+
+			service.notice(sender, fmt.Sprintf("%s%d  %s  %s", status, i+1,
+				time.Unix(memo.Sent, 0).Format(TIMEFORMAT), memoSender(memo)))
+		}
+		service.notice(sender, "End of memos. Unread memos are marked with *")
+	case "READ":
+		i, ok := memoIndex(acct, params)
+		if !ok {
+			service.notice(sender, "Syntax: READ <number>")
+			return
+		}
+
+		memo := &acct.Memos[i]
+		service.notice(sender, fmt.Sprintf("Memo %d from %s, sent %s:", i+1, memoSender(*memo),
+			time.Unix(memo.Sent, 0).Format(TIMEFORMAT)))
+		service.notice(sender, memo.Text)
+
+		if !memo.Read {
+			memo.Read = true
+			s.accounts.saveSoon()
+		}
+	case "DEL":
+		if len(params) == 1 && strings.ToUpper(params[0]) == "ALL" {
+			acct.Memos = nil
+			s.accounts.save()
+			service.notice(sender, "All of your memos have been deleted")
+			return
+		}
+
+		i, ok := memoIndex(acct, params)
+		if !ok {
+			service.notice(sender, "Syntax: DEL <number|ALL>")
+			return
+		}
+
+		acct.Memos = append(acct.Memos[:i], acct.Memos[i+1:]...)
+		s.accounts.save()
+		service.notice(sender, fmt.Sprintf("Memo %d has been deleted", i+1))
+	default:
+		service.notice(sender, "Unknown command "+command+". Send HELP for a list of commands.")
+	}
+}
+
+// Store a memo for an account, unless its quota is used up, and let anyone
+// logged into it know. Only identified users may send memos, and not too
+// often. Returns a notice for the sender.
+func leaveMemo(s *ServerInfo, sender *Client, acct *Account, text string, users map[string]*Client) string {
+	quota := s.MemoQuota
+	if quota <= 0 {
+		quota = DEFAULT_MEMO_QUOTA
+	}
+
+	now := time.Now().Unix()
+	switch {
+	case len(sender.Account) == 0:
+		return "You must identify with NickServ to send memos"
+	case now-sender.lastMemo < MEMO_DELAY:
+		return fmt.Sprintf("Please wait %d seconds between memos", MEMO_DELAY)
+	case len(acct.Memos) >= quota:
+		return acct.Name + "'s memo box is full"
+	}
+
+	sender.lastMemo = now
+	acct.Memos = append(acct.Memos, Memo{
+		From: sender.String(),
+		Sent: now,
+		Text: text,
+	})
+	s.accounts.saveSoon()
+
+	memoserv, exists := users["memoserv"]
+	for _, u := range users {
+		if exists && strings.EqualFold(u.Account, acct.Name) {
+			memoserv.notice(u, "You have a new memo from "+sender.Nick+". Send /msg MemoServ LIST to see it")
+		}
+	}
+
+	return "Your message has been saved for " + acct.Name
+}
+
+// Send unread memos to a client which has just logged in, as messages from
+// the original senders. Clients with server-time get the time each memo was
+// sent as a tag, everyone else gets it in the message.
+func deliverMemos(s *ServerInfo, cl *Client) {
+	acct, exists := s.accounts.get(cl.Account)
+	if !exists || !cl.Registered {
+		return
+	}
+
+	delivered := false
+	for i := range acct.Memos {
+		memo := &acct.Memos[i]
+		if memo.Read {
+			continue
+		}
+
+		sent := time.Unix(memo.Sent, 0)
+		if cl.hasCap("server-time") {
+			cl.sendTagged(map[string]string{"time": serverTime(sent)}, ":"+memo.From+" PRIVMSG "+cl.Nick+" :"+memo.Text)
+		} else {
+			cl.sendRaw(":" + memo.From + " PRIVMSG " + cl.Nick + " :[" + sent.Format(TIMEFORMAT) + "] " + memo.Text)
+		}
+
+		memo.Read = true
+		delivered = true
+	}
+
+	if delivered {
+		s.accounts.saveSoon()
+	}
+}
+
+// The nick part of a memo's sender
+func memoSender(memo Memo) string {
+	return strings.SplitN(memo.From, "!", 2)[0]
+}
+
+// Parse a 1-based memo number from the first parameter
+func memoIndex(acct *Account, params []string) (int, bool) {
+	if len(params) != 1 {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(params[0])
+	if err != nil || n < 1 || n > len(acct.Memos) {
+		return 0, false
+	}
+
+	return n - 1, true
+}
@@ -0,0 +1,76 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMemos(t *testing.T) {
+	s := &ServerInfo{
+		MemoQuota: 2,
+		accounts:  &AccountStore{Accounts: make(map[string]*Account)},
+	}
+	users := make(map[string]*Client)
+
+	acct, err := s.accounts.create("camconn", "hunter2hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := newTestClient()
+	leaveMemo(s, sender, acct, "anonymous", users)
+	if len(acct.Memos) != 0 {
+		t.Fatal("Memo stored from a user who hasn't identified")
+	}
+
+	sender.Account = "sender"
+	leaveMemo(s, sender, acct, "first", users)
+	leaveMemo(s, sender, acct, "too soon", users)
+	if len(acct.Memos) != 1 {
+		t.Fatalf("Memos weren't rate limited, %d memos stored", len(acct.Memos))
+	}
+
+	sender.lastMemo = 0
+	leaveMemo(s, sender, acct, "second", users)
+	sender.lastMemo = 0
+	leaveMemo(s, sender, acct, "over quota", users)
+	if len(acct.Memos) != 2 {
+		t.Fatalf("Memo quota wasn't enforced, %d memos stored", len(acct.Memos))
+	}
+
+	if !s.accounts.changed {
+		t.Error("Memos weren't marked to be saved")
+	}
+
+	if memoSender(acct.Memos[0]) != "tester" {
+		t.Errorf("Memo sender is %s, not tester", memoSender(acct.Memos[0]))
+	}
+
+	owner := newTestClient()
+	owner.Registered = true
+	owner.Account = "camconn"
+	deliverMemos(s, owner)
+
+	for i, memo := range acct.Memos {
+		if !memo.Read {
+			t.Errorf("Memo %d wasn't marked as read after delivery", i+1)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Max nicks a client may watch with MONITOR, advertised as MONITOR=
+const MONITOR_LIMIT = 100
+
+// Handle MONITOR <+|-|C|L|S> [targets]
+func (c *Client) monitor(s *ServerInfo, subcommand, targets string, users map[string]*Client) {
+	nicks := []string{}
+	for _, nick := range strings.Split(targets, COMMA) {
+		if nick = strings.TrimSpace(nick); len(nick) > 0 {
+			nicks = append(nicks, nick)
+		}
+	}
+
+	switch subcommand {
+	case "+":
+		added := []string{}
+		for i, nick := range nicks {
+			if len(c.monitoring) >= MONITOR_LIMIT && !c.monitoring[strings.ToLower(nick)] {
+				c.sendServerTargetInfo(s, ERR_MONLISTFULL,
+					strconv.Itoa(MONITOR_LIMIT)+" "+strings.Join(nicks[i:], COMMA), "Monitor list is full.")
+				break
+			}
+
+			s.addMonitor(c, nick)
+			added = append(added, nick)
+		}
+		c.sendMonitorStatus(s, added, users)
+	case "-":
+		for _, nick := range nicks {
+			s.removeMonitor(c, nick)
+		}
+	case "C":
+		s.clearMonitors(c)
+	case "L":
+		watched := c.monitored()
+		for i := 0; i < len(watched); i += 10 {
+			end := i + 10
+			if end > len(watched) {
+				end = len(watched)
+			}
+			c.sendServerMessage(s, RPL_MONLIST, strings.Join(watched[i:end], COMMA))
+		}
+		c.sendServerMessage(s, RPL_ENDOFMONLIST, "End of MONITOR list")
+	case "S":
+		c.sendMonitorStatus(s, c.monitored(), users)
+	default:
+		c.sendServerTargetInfo(s, ERR_UNKNOWNCOMMAND, "MONITOR", "Unknown MONITOR subcommand")
+	}
+}
+
+// Every nick this client is watching, sorted
+func (c *Client) monitored() []string {
+	watched := []string{}
+	for nick := range c.monitoring {
+		watched = append(watched, nick)
+	}
+	sort.Strings(watched)
+	return watched
+}
+
+// Send RPL_MONONLINE and RPL_MONOFFLINE for a list of nicks
+func (c *Client) sendMonitorStatus(s *ServerInfo, nicks []string, users map[string]*Client) {
+	online, offline := []string{}, []string{}
+	for _, nick := range nicks {
+		if user, exists := users[strings.ToLower(nick)]; exists && user.Registered {
+			online = append(online, user.String())
+		} else {
+			offline = append(offline, nick)
+		}
+	}
+
+	if len(online) > 0 {
+		c.sendServerMessage(s, RPL_MONONLINE, strings.Join(online, COMMA))
+	}
+	if len(offline) > 0 {
+		c.sendServerMessage(s, RPL_MONOFFLINE, strings.Join(offline, COMMA))
+	}
+}
+
+func (s *ServerInfo) addMonitor(c *Client, nick string) {
+	nick = strings.ToLower(nick)
+
+	if s.monitors == nil {
+		s.monitors = make(map[string]map[*Client]bool)
+	}
+	if s.monitors[nick] == nil {
+		s.monitors[nick] = make(map[*Client]bool)
+	}
+	if c.monitoring == nil {
+		c.monitoring = make(map[string]bool)
+	}
+
+	s.monitors[nick][c] = true
+	c.monitoring[nick] = true
+}
+
+func (s *ServerInfo) removeMonitor(c *Client, nick string) {
+	nick = strings.ToLower(nick)
+
+	delete(c.monitoring, nick)
+	delete(s.monitors[nick], c)
+	if len(s.monitors[nick]) == 0 {
+		delete(s.monitors, nick)
+	}
+}
+
+// Stop watching every nick, such as when a client disconnects
+func (s *ServerInfo) clearMonitors(c *Client) {
+	for nick := range c.monitoring {
+		s.removeMonitor(c, nick)
+	}
+}
+
+// Tell everyone watching a client's nick that it's online
+func (s *ServerInfo) notifyOnline(cl *Client) {
+	for watcher := range s.monitors[strings.ToLower(cl.Nick)] {
+		watcher.sendServerMessage(s, RPL_MONONLINE, cl.String())
+	}
+}
+
+// Tell everyone watching a nick that it's gone offline
+func (s *ServerInfo) notifyOffline(nick string) {
+	for watcher := range s.monitors[strings.ToLower(nick)] {
+		watcher.sendServerMessage(s, RPL_MONOFFLINE, nick)
+	}
+}
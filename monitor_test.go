@@ -0,0 +1,83 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMonitor(t *testing.T) {
+	s := &ServerInfo{
+		Hostname: "irc.example.com",
+		accounts: &AccountStore{Accounts: make(map[string]*Account)},
+	}
+	users := make(map[string]*Client)
+	channels := make(map[string]*Channel)
+
+	watcher, readWatcher := newPipeClient(t, "watcher")
+	users["watcher"] = watcher
+
+	watcher.monitor(s, "+", "Friend,watcher", users)
+	if line := readWatcher(); line != ":irc.example.com 730 watcher :watcher!watcher@example.com" {
+		t.Errorf("Online reply was %q", line)
+	}
+	if line := readWatcher(); line != ":irc.example.com 731 watcher :Friend" {
+		t.Errorf("Offline reply was %q", line)
+	}
+
+	friend, _ := newPipeClient(t, "someone")
+	friend.Username = "friend"
+	users["someone"] = friend
+
+	changeNick(s, friend, "friend", users, channels)
+	if line := readWatcher(); line != ":irc.example.com 730 watcher :friend!friend@example.com" {
+		t.Errorf("Nick change to a watched nick sent %q", line)
+	}
+
+	removeClient(s, friend, "Bye", users, channels)
+	if line := readWatcher(); line != ":irc.example.com 731 watcher :friend" {
+		t.Errorf("Watched user quitting sent %q", line)
+	}
+
+	s.clearMonitors(watcher)
+	if len(s.monitors) != 0 || len(watcher.monitoring) != 0 {
+		t.Error("MONITOR C didn't clear the monitor list")
+	}
+}
+
+func TestUserhost(t *testing.T) {
+	s := &ServerInfo{Hostname: "irc.example.com"}
+	users := make(map[string]*Client)
+
+	asker, read := newPipeClient(t, "asker")
+	oper, _ := newPipeClient(t, "oper")
+	oper.Mode = "o"
+	oper.Away = "Lunch"
+	users["asker"], users["oper"] = asker, oper
+
+	asker.sendUserhost(s, []string{"oper", "nobody"}, users)
+	if line := read(); line != ":irc.example.com 302 asker :oper*=-oper@example.com" {
+		t.Errorf("USERHOST reply was %q", line)
+	}
+
+	asker.sendIson(s, []string{"OPER", "nobody", "asker"}, users)
+	if line := read(); line != ":irc.example.com 303 asker :oper asker" {
+		t.Errorf("ISON reply was %q", line)
+	}
+}
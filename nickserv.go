@@ -0,0 +1,343 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Seconds a user has to identify before being renamed, if not set in config.ini
+const DEFAULT_NICK_GRACE = 60
+
+var nickServHelp = []string{
+	"NickServ lets you register and protect your nickname.",
+	"  REGISTER <password> [email]   - Register your current nick",
+	"  IDENTIFY [account] <password> - Log into your account",
+	"  GHOST <nick> [password]       - Disconnect someone using your nick",
+	"  GROUP                         - Add your current nick to your account",
+	"  DROP <password>               - Ungroup your current nick, or drop your account",
+	"  INFO [nick]                   - Show information about a registered nick",
+	"  SET ENFORCE <ON|OFF>          - Rename people who use your nicks without identifying",
+}
+
+func nickServ(s *ServerInfo, service, sender *Client, message string,
+	users map[string]*Client, channels map[string]*Channel) {
+	command, params := serviceCommand(message)
+
+	switch command {
+	case "REGISTER":
+		if len(params) < 1 {
+			service.notice(sender, "Syntax: REGISTER <password> [email]")
+			return
+		}
+
+		email := ""
+		if len(params) >= 2 {
+			email = params[1]
+		}
+
+		acct, regErr := sender.createAccount(s, sender.Nick, email, params[0])
+		if regErr != nil {
+			service.notice(sender, regErr.description)
+		} else if acct.Unverified {
+			service.notice(sender, "Your nick has been registered. Check "+acct.Email+
+				" for a verification code, then send /VERIFY "+acct.Name+" <code>")
+		} else {
+			service.notice(sender, "Your nick "+acct.Name+" has been registered")
+			sender.login(s, acct)
+		}
+	case "IDENTIFY":
+		if len(params) < 1 {
+			service.notice(sender, "Syntax: IDENTIFY [account] <password>")
+			return
+		}
+
+		if len(sender.Account) > 0 {
+			service.notice(sender, "You are already identified as "+sender.Account)
+			return
+		}
+
+		name, password := sender.Nick, params[0]
+		if len(params) >= 2 {
+			name, password = params[0], params[1]
+		}
+
+		// allow identifying to an account with one of its grouped nicks
+		if owner, exists := s.accounts.getByNick(name); exists {
+			name = owner.Name
+		}
+
+		sender.checkPassword(s, name, password, func(acct *Account, err error) {
+			if err != nil {
+				service.notice(sender, passwordNotice(err, "Invalid account or password"))
+				return
+			} else if len(sender.Account) > 0 {
+				service.notice(sender, "You are already identified as "+sender.Account)
+				return
+			}
+
+			sender.login(s, acct)
+			service.notice(sender, "You are now identified as "+acct.Name)
+		})
+	case "GHOST":
+		if len(params) < 1 {
+			service.notice(sender, "Syntax: GHOST <nick> [password]")
+			return
+		}
+
+		ghost, online := users[strings.ToLower(params[0])]
+		if !online || ghost.service != nil {
+			service.notice(sender, params[0]+" is not online")
+			return
+		} else if ghost == sender {
+			service.notice(sender, "You can't ghost yourself")
+			return
+		}
+
+		acct, owned := s.accounts.getByNick(ghost.Nick)
+		if !owned {
+			service.notice(sender, ghost.Nick+" is not registered")
+			return
+		}
+
+		kill := func() {
+			if ghost.exited {
+				service.notice(sender, ghost.Nick+" is not online")
+				return
+			}
+
+			ghost.sendError("Closing Link: " + ghost.Host() + " (GHOST command used by " + sender.Nick + ")")
+			removeClient(s, ghost, "GHOST command used by "+sender.Nick, users, channels)
+			service.notice(sender, ghost.Nick+" has been ghosted")
+		}
+
+		if strings.EqualFold(sender.Account, acct.Name) {
+			kill()
+			return
+		} else if len(params) < 2 {
+			service.notice(sender, "Access denied")
+			return
+		}
+
+		sender.checkPassword(s, acct.Name, params[1], func(_ *Account, err error) {
+			if err != nil {
+				service.notice(sender, passwordNotice(err, "Access denied"))
+				return
+			}
+
+			kill()
+		})
+	case "GROUP":
+		acct, identified := s.accounts.get(sender.Account)
+		if !identified {
+			service.notice(sender, "You must identify before grouping nicks")
+			return
+		}
+
+		if owner, owned := s.accounts.getByNick(sender.Nick); owned {
+			if owner == acct {
+				service.notice(sender, sender.Nick+" is already in your account")
+			} else {
+				service.notice(sender, sender.Nick+" is registered to someone else")
+			}
+			return
+		}
+
+		acct.Nicks = append(acct.Nicks, sender.Nick)
+		s.accounts.save()
+		service.notice(sender, sender.Nick+" is now grouped to "+acct.Name)
+	case "DROP":
+		if len(params) < 1 {
+			service.notice(sender, "Syntax: DROP <password>")
+			return
+		}
+
+		if len(sender.Account) == 0 {
+			service.notice(sender, "Access denied")
+			return
+		}
+
+		sender.checkPassword(s, sender.Account, params[0], func(acct *Account, err error) {
+			if err != nil || !strings.EqualFold(sender.Account, acct.Name) {
+				service.notice(sender, passwordNotice(err, "Access denied"))
+				return
+			}
+
+			dropNick(s, service, sender, acct, users, channels)
+		})
+	case "INFO":
+		nick := sender.Nick
+		if len(params) >= 1 {
+			nick = params[0]
+		}
+
+		acct, exists := s.accounts.getByNick(nick)
+		if !exists {
+			service.notice(sender, nick+" is not registered")
+			return
+		}
+
+		enforce := "OFF"
+		if acct.Enforce {
+			enforce = "ON"
+		}
+
+		service.notice(sender, "Information on "+nick+" (account "+acct.Name+"):")
+		service.notice(sender, "  Registered: "+time.Unix(acct.Registered, 0).Format(TIMEFORMAT))
+		if len(acct.Nicks) > 0 {
+			service.notice(sender, "  Nicks: "+strings.Join(acct.Nicks, SPACE))
+		}
+		service.notice(sender, "  Enforce: "+enforce)
+
+		// only show contact information to the owner and opers
+		if len(acct.Email) > 0 && (strings.EqualFold(sender.Account, acct.Name) || sender.hasMode("o")) {
+			service.notice(sender, "  Email: "+acct.Email)
+		}
+	case "SET":
+		acct, identified := s.accounts.get(sender.Account)
+		if !identified {
+			service.notice(sender, "You must identify first")
+			return
+		}
+
+		if len(params) != 2 || strings.ToUpper(params[0]) != "ENFORCE" {
+			service.notice(sender, "Syntax: SET ENFORCE <ON|OFF>")
+			return
+		}
+
+		switch strings.ToUpper(params[1]) {
+		case "ON":
+			acct.Enforce = true
+		case "OFF":
+			acct.Enforce = false
+		default:
+			service.notice(sender, "Syntax: SET ENFORCE <ON|OFF>")
+			return
+		}
+
+		s.accounts.save()
+		service.notice(sender, "ENFORCE is now "+strings.ToUpper(params[1])+" for "+acct.Name)
+	case "HELP", "":
+		for _, line := range nickServHelp {
+			service.notice(sender, line)
+		}
+	default:
+		service.notice(sender, "Unknown command "+command+". Send HELP for a list of commands.")
+	}
+}
+
+// Finish NickServ DROP once the password has been checked. Dropping a grouped
+// nick only removes it from the account.
+func dropNick(s *ServerInfo, service, sender *Client, acct *Account,
+	users map[string]*Client, channels map[string]*Channel) {
+	for i, grouped := range acct.Nicks {
+		if strings.EqualFold(grouped, sender.Nick) {
+			acct.Nicks = append(acct.Nicks[:i], acct.Nicks[i+1:]...)
+			s.accounts.save()
+			service.notice(sender, sender.Nick+" has been removed from "+acct.Name)
+			return
+		}
+	}
+
+	s.accounts.drop(acct)
+	s.registered.forgetAccount(acct.Name)
+	for _, u := range users {
+		if strings.EqualFold(u.Account, acct.Name) {
+			u.logout(s)
+			if u != sender {
+				u.notifyAccount(channels)
+				u.updateCloak(s, channels)
+			}
+		}
+	}
+	service.notice(sender, "The account "+acct.Name+" has been dropped")
+}
+
+// Explain a failed password check, unless it was just the wrong password
+func passwordNotice(err error, wrong string) string {
+	switch err {
+	case errTooManyFailures:
+		return "Too many failed attempts. Try again later."
+	case errCheckPending:
+		return "Your last attempt is still being checked"
+	}
+	return wrong
+}
+
+// Warn a client using a nick which belongs to someone else's account, and
+// rename them after the grace period if the account enforces its nicks.
+func enforceNick(s *ServerInfo, cl *Client, users map[string]*Client) {
+	if !cl.nickReserved(s, cl.Nick) {
+		return
+	}
+
+	acct, _ := s.accounts.getByNick(cl.Nick)
+	nickserv, exists := users["nickserv"]
+	if !exists {
+		return
+	}
+
+	nickserv.notice(cl, "This nickname is registered. Please identify with /msg NickServ IDENTIFY <password>")
+	if !acct.Enforce {
+		return
+	}
+
+	grace := s.NickGrace
+	if grace <= 0 {
+		grace = DEFAULT_NICK_GRACE
+	}
+	nickserv.notice(cl, fmt.Sprintf("If you don't identify within %d seconds, your nick will be changed", grace))
+
+	if s.events == nil {
+		return
+	}
+
+	nick := cl.Nick
+	time.AfterFunc(time.Duration(grace)*time.Second, func() {
+		s.events <- &Event{Type: ENFORCE, Sender: cl, Body: nick, Valid: true}
+	})
+}
+
+// Rename a client to a Guest nick if they're still using `nick` without
+// identifying to the account which owns it.
+func guestNick(s *ServerInfo, cl *Client, nick string, users map[string]*Client, channels map[string]*Channel) {
+	if cl.exited || cl.Nick != nick || !cl.nickReserved(s, nick) {
+		return
+	}
+
+	guest := ""
+	for len(guest) == 0 {
+		guest = "Guest" + strconv.Itoa(10000+rand.Intn(90000))
+		if _, taken := users[strings.ToLower(guest)]; taken {
+			guest = ""
+		}
+	}
+
+	log.Println("Renaming", nick, "to", guest)
+	if nickserv, exists := users["nickserv"]; exists {
+		nickserv.notice(cl, "You didn't identify in time, so your nick has been changed to "+guest)
+	}
+
+	changeNick(s, cl, guest, users, channels)
+}
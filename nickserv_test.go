@@ -0,0 +1,123 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNickServ(t *testing.T) {
+	s := &ServerInfo{
+		RegistrationPolicy: REGISTER_OPEN,
+		accounts:           &AccountStore{Accounts: make(map[string]*Account)},
+	}
+	users := make(map[string]*Client)
+	channels := make(map[string]*Channel)
+
+	nickserv := newService(s, "NickServ", nickServ)
+	addService(users, nickserv)
+
+	owner := newTestClient()
+	owner.Registered = true
+	users["tester"] = owner
+
+	nickServ(s, nickserv, owner, "REGISTER hunter2hunter2", users, channels)
+	if owner.Account != "tester" {
+		t.Fatalf("REGISTER didn't log in, account is %q", owner.Account)
+	}
+
+	// group a second nick to the account
+	changeNick(s, owner, "tester2", users, channels)
+	nickServ(s, nickserv, owner, "GROUP", users, channels)
+	if acct, _ := s.accounts.getByNick("TESTER2"); acct == nil || acct.Name != "tester" {
+		t.Error("GROUP didn't add nick to account")
+	}
+
+	// someone else takes the original nick without identifying
+	squatter := newTestClient()
+	squatter.Nick = "other"
+	squatter.Registered = true
+	users["other"] = squatter
+	changeNick(s, squatter, "tester", users, channels)
+
+	guestNick(s, squatter, "tester", users, channels)
+	if !strings.HasPrefix(squatter.Nick, "Guest") {
+		t.Errorf("Unidentified user wasn't renamed, nick is %s", squatter.Nick)
+	}
+
+	// identifying with a grouped nick logs into the account
+	nickServ(s, nickserv, squatter, "IDENTIFY tester2 hunter2hunter2", users, channels)
+	if squatter.Account != "tester" {
+		t.Errorf("IDENTIFY with grouped nick failed, account is %q", squatter.Account)
+	}
+}
+
+func TestNickServDropChannels(t *testing.T) {
+	s := &ServerInfo{
+		RegistrationPolicy: REGISTER_OPEN,
+		accounts:           &AccountStore{Accounts: make(map[string]*Account)},
+		registered:         &ChannelStore{Channels: make(map[string]*ChannelReg)},
+	}
+	users := make(map[string]*Client)
+	channels := make(map[string]*Channel)
+
+	nickserv := newService(s, "NickServ", nickServ)
+	addService(users, nickserv)
+
+	owner := newTestClient()
+	owner.Registered = true
+	users["tester"] = owner
+	nickServ(s, nickserv, owner, "REGISTER hunter2hunter2", users, channels)
+
+	alone, _ := s.registered.register("#alone", "tester")
+	alone.Access = []AccessEntry{{Mask: "*!*@example.com", Level: ACCESS_OP}}
+
+	shared, _ := s.registered.register("#shared", "tester")
+	shared.Access = []AccessEntry{
+		{Mask: "friend", Level: ACCESS_VOICE},
+		{Mask: "helper", Level: ACCESS_OP},
+		{Mask: "later", Level: ACCESS_OP},
+	}
+
+	other, _ := s.registered.register("#other", "someone")
+	other.Access = []AccessEntry{{Mask: "Tester", Level: ACCESS_OP}}
+
+	nickServ(s, nickserv, owner, "DROP hunter2hunter2", users, channels)
+	if _, exists := s.accounts.get("tester"); exists {
+		t.Fatal("DROP didn't drop the account")
+	}
+
+	if _, exists := s.registered.get("#alone"); exists {
+		t.Error("Channel without another op account wasn't dropped")
+	}
+	if shared.Founder != "helper" || len(shared.Access) != 2 || shared.findAccess("helper") != -1 {
+		t.Errorf("Channel wasn't handed to the first op: founder %s, access %v", shared.Founder, shared.Access)
+	}
+	if other.findAccess("tester") != -1 {
+		t.Error("Dropped account kept its access to another channel")
+	}
+
+	// someone registering the name again gets nothing
+	owner.Account = ""
+	nickServ(s, nickserv, owner, "REGISTER anotherpassword", users, channels)
+	if reg, _ := s.registered.get("#other"); reg.accessLevel(owner) != "" {
+		t.Error("New account with the dropped name has access to #other")
+	}
+}
@@ -0,0 +1,59 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+)
+
+// Server notice mask letters. See SNOMASK_LETTERS for descriptions.
+const (
+	SNO_CONNECTS = "c"
+	SNO_FLOOD    = "f"
+	SNO_KILLS    = "k"
+	SNO_NICKS    = "n"
+	SNO_OPERS    = "o"
+	SNO_BANS     = "x"
+)
+
+// Send a server notice to every oper subscribed to the given snomask letter
+func serverNotice(s *ServerInfo, users map[string]*Client, letter, message string) {
+	log.Println("Server notice:", message)
+
+	for _, u := range users {
+		if u.hasMode("s") && u.hasSnomask(letter) {
+			u.sendMessage(s.Hostname + " NOTICE " + u.Nick + " :*** Notice -- " + message)
+		}
+	}
+}
+
+// Send a server notice to a single client, such as to tell an oper what a
+// command did
+func (c *Client) sendServerNotice(s *ServerInfo, message string) {
+	c.sendMessage(s.Hostname + " NOTICE " + c.Nick + " :*** " + message)
+}
+
+// Send a WALLOPS message from an oper to every user with +w
+func wallops(sender *Client, users map[string]*Client, message string) {
+	for _, u := range users {
+		if u.hasMode("w") {
+			u.sendRaw(":" + sender.String() + " WALLOPS :" + message)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+)
+
+// Max length of a real name set with USER or SETNAME
+const REALNAMELEN = 128
+
+// Tell everyone in a channel that a user joined. Clients with extended-join
+// also get the user's account ("*" if they aren't logged in) and real name.
+func (ch *Channel) sendJoin(cl *Client) {
+	tags := messageTags(cl, nil)
+
+	account := cl.Account
+	if len(account) == 0 {
+		account = "*"
+	}
+
+	for u := ch.Users.Front(); u != nil; u = u.Next() {
+		if user, ok := (u.Value).(*Client); ok {
+			user.sendJoinLine(tags, cl, ch.Name, account)
+		}
+	}
+}
+
+func (c *Client) sendJoinLine(tags map[string]string, joined *Client, channel, account string) {
+	if c.hasCap("extended-join") {
+		c.sendTagged(tags, ":"+joined.String()+" JOIN "+channel+" "+account+" :"+joined.Realname)
+	} else {
+		c.sendTagged(tags, ":"+joined.String()+" JOIN "+channel)
+	}
+}
+
+// Tell a client and its peers with account-notify that it has logged in or
+// out. This is sent after Account has changed.
+func (c *Client) notifyAccount(channels map[string]*Channel) {
+	if !c.Registered {
+		return
+	}
+
+	account := c.Account
+	if len(account) == 0 {
+		account = "*"
+	}
+
+	message := ":" + c.String() + " ACCOUNT " + account
+	for _, peer := range append(c.peers(channels), c) {
+		if peer.hasCap("account-notify") {
+			peer.sendRaw(message)
+		}
+	}
+}
+
+// Change the username and host shown to everyone else. Peers with chghost
+// get a CHGHOST, and everyone else sees the user quit and join again.
+func (c *Client) changeHost(s *ServerInfo, username, cloak string, channels map[string]*Channel) {
+	if username == c.Username && cloak == c.Cloak {
+		return
+	}
+
+	old := c.String()
+	oldHost := c.Host()
+	c.Username, c.Cloak = username, cloak
+
+	log.Println(old, "changed host to", c.String())
+
+	if !c.Registered {
+		return
+	}
+
+	if oldHost != c.Host() {
+		c.sendServerTargetInfo(s, RPL_HOSTHIDDEN, c.Host(), "is now your displayed host")
+	}
+
+	chghost := ":" + old + " CHGHOST " + c.Username + " " + c.Host()
+	if c.hasCap("chghost") {
+		c.sendRaw(chghost)
+	}
+
+	account := c.Account
+	if len(account) == 0 {
+		account = "*"
+	}
+
+	for _, peer := range c.peers(channels) {
+		if peer.hasCap("chghost") {
+			peer.sendRaw(chghost)
+			continue
+		}
+
+		peer.sendRaw(":" + old + " QUIT :Changing host")
+		tags := messageTags(c, nil)
+		for _, name := range c.Channels {
+			ch, exists := channels[name]
+			if !exists || binarySearch(name, peer.Channels) == -1 {
+				continue
+			}
+
+			peer.sendJoinLine(tags, c, ch.Name, account)
+			if modes := ch.Members[c]; len(modes) > 0 {
+				nicks := ""
+				for range modes {
+					nicks += " " + c.Nick
+				}
+				peer.sendRaw(":" + s.Hostname + " MODE " + ch.Name + " +" + modes + nicks)
+			}
+		}
+	}
+}
+
+// Handle SETNAME, which changes a user's real name after connecting
+func (c *Client) setRealname(s *ServerInfo, realname string, channels map[string]*Channel) {
+	if len(realname) == 0 || len(realname) > REALNAMELEN {
+		c.sendFail(s, "SETNAME", "INVALID_REALNAME", "*", "Real name is invalid")
+		return
+	}
+
+	c.Realname = realname
+
+	message := ":" + c.String() + " SETNAME :" + realname
+	tags := messageTags(c, nil)
+	for _, peer := range append(c.peers(channels), c) {
+		if peer.hasCap("setname") {
+			peer.sendTagged(tags, message)
+		}
+	}
+}
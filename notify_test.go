@@ -0,0 +1,84 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A connected client whose output can be read back line by line
+func newPipeClient(t *testing.T, nick string, caps ...string) (*Client, func() string) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	cl := NewClient(server)
+	cl.Nick = nick
+	cl.Username = nick
+	cl.Cloak = "example.com"
+	cl.Registered = true
+	for _, name := range caps {
+		cl.Caps[name] = true
+	}
+	go cl.writeLoop()
+
+	reader := bufio.NewReader(client)
+	return &cl, func() string {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimRight(line, CRLF)
+	}
+}
+
+func TestChangeHost(t *testing.T) {
+	s := &ServerInfo{Hostname: "irc.example.com"}
+	channels := map[string]*Channel{"#test": NewChannel("#test")}
+	ch := channels["#test"]
+
+	user, _ := newPipeClient(t, "user")
+	modern, readModern := newPipeClient(t, "modern", "chghost")
+	old, readOld := newPipeClient(t, "old", "extended-join")
+
+	for _, cl := range []*Client{user, modern, old} {
+		cl.Channels = []string{"#test"}
+		ch.Users.PushBack(cl)
+	}
+	ch.setMemberMode(user, "o", true)
+
+	user.changeHost(s, "newuser", "new.example.com", channels)
+
+	if line := readModern(); line != ":user!user@example.com CHGHOST newuser new.example.com" {
+		t.Errorf("chghost client got %q", line)
+	}
+
+	expected := []string{
+		":user!user@example.com QUIT :Changing host",
+		":user!newuser@new.example.com JOIN #test * :",
+		":irc.example.com MODE #test +o user",
+	}
+	for _, want := range expected {
+		if line := readOld(); line != want {
+			t.Errorf("Client without chghost got %q, not %q", line, want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed password attempts one connection may make
+const MAX_AUTH_FAILURES = 3
+
+// Failed password attempts one IP may make in AUTH_FAILURE_WINDOW seconds
+const MAX_IP_AUTH_FAILURES = 10
+const AUTH_FAILURE_WINDOW = 600
+
+var (
+	errBadPassword     = errors.New("invalid account or password")
+	errCheckPending    = errors.New("a password check is already running")
+	errTooManyFailures = errors.New("too many failed password attempts")
+)
+
+// A password check waiting for its result. `done` runs on the event handler.
+type passwordCheck struct {
+	name string
+	hash []byte // checked against, in case the password changes meanwhile
+	done func(acct *Account, err error)
+}
+
+// Failed password attempts from one IP since the window started
+type ipAuthFailures struct {
+	count   int
+	expires time.Time
+}
+
+// Accounts which don't exist are checked against this, so they take as long
+// as accounts which do
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+func getDummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		password := make([]byte, 16)
+		rand.Read(password)
+		dummyHash, _ = bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+// Check a password for an account. bcrypt is slow on purpose, so the check
+// runs outside the event handler and the result comes back as a PASSCHECK
+// event, which calls `done`. Each client has one check running at most, and
+// clients and IPs which fail too often are refused for a while.
+func (c *Client) checkPassword(s *ServerInfo, name, password string, done func(*Account, error)) {
+	if c.passCheck != nil {
+		done(nil, errCheckPending)
+		return
+	} else if s.authBlocked(c, time.Now()) {
+		done(nil, errTooManyFailures)
+		return
+	}
+
+	var hash []byte
+	if acct, exists := s.accounts.get(name); exists {
+		hash = acct.PasswordHash
+	}
+	c.passCheck = &passwordCheck{name: name, hash: hash, done: done}
+
+	compare := func() bool {
+		if hash == nil {
+			bcrypt.CompareHashAndPassword(getDummyHash(), []byte(password))
+			return false
+		}
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	}
+
+	// without an event handler, as in tests, check right away
+	if s.events == nil {
+		c.finishPasswordCheck(s, compare())
+		return
+	}
+
+	go func() {
+		e := &Event{Type: PASSCHECK, Sender: c, Valid: true}
+		if compare() {
+			e.Body = "ok"
+		}
+		s.events <- e
+	}()
+}
+
+// Act on the result of checkPassword
+func (c *Client) finishPasswordCheck(s *ServerInfo, matched bool) {
+	check := c.passCheck
+	c.passCheck = nil
+	if check == nil {
+		return
+	}
+
+	acct, exists := s.accounts.get(check.name)
+	switch {
+	case !matched || !exists || !bytes.Equal(acct.PasswordHash, check.hash):
+		s.authFailed(c, time.Now())
+		check.done(nil, errBadPassword)
+	case acct.Unverified:
+		check.done(nil, errUnverified)
+	default:
+		check.done(acct, nil)
+	}
+}
+
+// Whether a client, or its IP, has failed too many password attempts
+func (s *ServerInfo) authBlocked(c *Client, now time.Time) bool {
+	if c.authFailures >= MAX_AUTH_FAILURES {
+		return true
+	}
+
+	f, exists := s.authFailures[c.IP()]
+	return exists && now.Before(f.expires) && f.count >= MAX_IP_AUTH_FAILURES
+}
+
+// Count a failed password attempt against a client and its IP
+func (s *ServerInfo) authFailed(c *Client, now time.Time) {
+	c.authFailures++
+
+	if s.authFailures == nil {
+		s.authFailures = make(map[string]*ipAuthFailures)
+	}
+
+	f, exists := s.authFailures[c.IP()]
+	if !exists || now.After(f.expires) {
+		for ip, old := range s.authFailures {
+			if now.After(old.expires) {
+				delete(s.authFailures, ip)
+			}
+		}
+
+		f = &ipAuthFailures{expires: now.Add(AUTH_FAILURE_WINDOW * time.Second)}
+		s.authFailures[c.IP()] = f
+	}
+	f.count++
+}
@@ -0,0 +1,224 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Seconds a load balancer has to send the PROXY header
+const PROXY_TIMEOUT = 5
+
+// Longest PROXY protocol v1 header, including the CRLF
+const PROXY_V1_MAX = 107
+
+// Every PROXY protocol v2 header starts with this
+var PROXY_V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 TLV for TLS information, and the flag in it saying the
+// client connected with TLS
+const (
+	PP2_TYPE_SSL   = 0x20
+	PP2_CLIENT_SSL = 0x01
+)
+
+// A connection from a load balancer, with the addresses of the client it's
+// passing on. Anything read after the PROXY header comes from `reader`.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	secure bool // the client connected to the load balancer with TLS
+}
+
+func (p *proxyConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *proxyConn) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+func (p *proxyConn) LocalAddr() net.Addr {
+	return p.local
+}
+
+// Read a PROXY protocol v1 or v2 header from a connection. The connection
+// returned has the client's address instead of the load balancer's. Headers
+// which don't give an address, such as health checks, keep the original
+// addresses.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(PROXY_TIMEOUT * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	p := &proxyConn{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, 512),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+
+	start, err := p.reader.Peek(len(PROXY_V2_SIGNATURE))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, PROXY_V2_SIGNATURE) {
+		return p, p.readV2()
+	} else if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return p, p.readV1()
+	}
+
+	return nil, errors.New("no PROXY header")
+}
+
+// Parse a v1 header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 6667"
+func (p *proxyConn) readV1() error {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte(CRLF)) {
+		if len(line) >= PROXY_V1_MAX {
+			return errors.New("PROXY header is too long")
+		}
+
+		c, err := p.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errors.New("invalid PROXY header: " + strings.TrimSpace(string(line)))
+	}
+
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return errors.New("invalid PROXY addresses: " + strings.TrimSpace(string(line)))
+	}
+
+	p.remote = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	p.local = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+// Parse a binary v2 header, including whether the client used TLS
+func (p *proxyConn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(p.reader, header); err != nil {
+		return err
+	}
+
+	if header[12]>>4 != 2 {
+		return errors.New("unknown PROXY protocol version")
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(p.reader, body); err != nil {
+		return err
+	}
+
+	// LOCAL connections are the load balancer itself, such as health checks
+	if header[12]&0xf == 0 {
+		return nil
+	} else if header[12]&0xf != 1 {
+		return errors.New("unknown PROXY command")
+	}
+
+	var addrLen int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		addrLen = 12
+		if len(body) < addrLen {
+			return errors.New("PROXY header is too short")
+		}
+		p.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		p.local = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case 0x21: // TCP over IPv6
+		addrLen = 36
+		if len(body) < addrLen {
+			return errors.New("PROXY header is too short")
+		}
+		p.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		p.local = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	default:
+		// other address families keep the load balancer's address
+		return nil
+	}
+
+	// the rest is type-length-value fields
+	tlvs := body[addrLen:]
+	for len(tlvs) >= 3 {
+		kind, length := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return errors.New("PROXY TLV is too short")
+		}
+
+		value := tlvs[3 : 3+length]
+		if kind == PP2_TYPE_SSL && length >= 1 && value[0]&PP2_CLIENT_SSL != 0 {
+			p.secure = true
+		}
+		tlvs = tlvs[3+length:]
+	}
+
+	return nil
+}
+
+// Parse a comma-separated list of IPs and CIDR networks from config.ini.
+// `setting` names the setting for the log if any of them are invalid.
+func parseIPMasks(setting, list string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, mask := range strings.Split(list, ",") {
+		mask = strings.TrimSpace(mask)
+		if len(mask) == 0 {
+			continue
+		}
+
+		if network, ok := parseIPMask(mask); ok {
+			networks = append(networks, network)
+		} else {
+			log.Println("Ignoring invalid "+setting+" mask:", mask)
+		}
+	}
+	return networks
+}
+
+func ipInMasks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
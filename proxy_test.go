@@ -0,0 +1,112 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// Send `data` down a pipe and read a PROXY header from the other end
+func readTestHeader(t *testing.T, data []byte) (*proxyConn, error) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close(); client.Close() })
+
+	go client.Write(data)
+	return readProxyHeader(server)
+}
+
+func TestProxyV1(t *testing.T) {
+	p, err := readTestHeader(t, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 6667\r\nNICK camconn\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.RemoteAddr().String() != "192.0.2.1:56324" || p.LocalAddr().String() != "198.51.100.1:6667" {
+		t.Errorf("Wrong addresses %s and %s", p.RemoteAddr(), p.LocalAddr())
+	}
+	if remoteIP(p).String() != "192.0.2.1" {
+		t.Error("remoteIP doesn't use the PROXY address")
+	}
+
+	// whatever the client sent after the header is still there
+	line, err := bufio.NewReader(p).ReadString('\n')
+	if err != nil || line != "NICK camconn\r\n" {
+		t.Errorf("Read %q (%v) after the header", line, err)
+	}
+
+	if p, err = readTestHeader(t, []byte("PROXY UNKNOWN\r\n")); err != nil || p.RemoteAddr().String() != "pipe" {
+		t.Error("PROXY UNKNOWN didn't keep the original address:", err)
+	}
+
+	for _, header := range []string{
+		"NICK camconn\r\nUSER camconn 0 * :Cameron\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 not.an.ip 198.51.100.1 56324 6667\r\n",
+	} {
+		if _, err = readTestHeader(t, []byte(header)); err == nil {
+			t.Errorf("Accepted the header %q", header)
+		}
+	}
+}
+
+// Build a v2 header with the PROXY command
+func proxyV2Header(family byte, addrs []byte, tlvs []byte) []byte {
+	body := append(append([]byte{}, addrs...), tlvs...)
+	header := append([]byte{}, PROXY_V2_SIGNATURE...)
+	header = append(header, 0x21, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestProxyV2(t *testing.T) {
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x1a, 0x0b}
+	ssl := []byte{PP2_TYPE_SSL, 0, 5, PP2_CLIENT_SSL, 0, 0, 0, 0}
+
+	p, err := readTestHeader(t, proxyV2Header(0x11, addrs, ssl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.RemoteAddr().String() != "192.0.2.1:56324" || p.LocalAddr().String() != "198.51.100.1:6667" {
+		t.Errorf("Wrong addresses %s and %s", p.RemoteAddr(), p.LocalAddr())
+	}
+	if !p.secure {
+		t.Error("TLS from the load balancer wasn't noticed")
+	}
+
+	addrs6 := make([]byte, 36)
+	copy(addrs6, net.ParseIP("2001:db8::1"))
+	copy(addrs6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(addrs6[32:], 40000)
+	binary.BigEndian.PutUint16(addrs6[34:], 6697)
+
+	p, err = readTestHeader(t, proxyV2Header(0x21, addrs6, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.RemoteAddr().String() != "[2001:db8::1]:40000" || p.secure {
+		t.Errorf("Wrong IPv6 address %s, or TLS when there wasn't any", p.RemoteAddr())
+	}
+
+	if _, err = readTestHeader(t, proxyV2Header(0x11, addrs[:6], nil)); err == nil {
+		t.Error("Accepted a v2 header which is too short")
+	}
+}
@@ -0,0 +1,227 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Account registration policies, set with RegistrationPolicy in config.ini
+const (
+	REGISTER_OPEN   = "open"      // accounts are usable right away
+	REGISTER_VERIFY = "verify"    // accounts need a verification code
+	REGISTER_OPER   = "oper-only" // only opers may register accounts
+)
+
+const MIN_PASSWORD_LEN = 8
+
+// Value of the draft/account-registration capability
+const REGISTRATION_CAP = "before-connect,custom-account-name"
+
+var accountNameRegex = regexp.MustCompile(NICKREGEX)
+
+// An account registration which was refused, along with the
+// draft/account-registration FAIL code for the reason
+type registerError struct {
+	code        string
+	description string
+}
+
+// Handle REGISTER <account> <email> <password>. An account name of "*"
+// registers the client's current nick.
+func (c *Client) register(s *ServerInfo, name, email, password string) {
+	if !c.Registered && !c.hasCap("draft/account-registration") {
+		c.sendFail(s, "REGISTER", "COMPLETE_CONNECTION_REQUIRED", name, "Finish connecting before registering an account")
+		return
+	}
+
+	if name == "*" {
+		if len(c.Nick) == 0 {
+			c.sendFail(s, "REGISTER", "NEED_NICK", name, "Send NICK before registering your nick")
+			return
+		}
+		name = c.Nick
+	}
+
+	acct, regErr := c.createAccount(s, name, email, password)
+	if regErr != nil {
+		context := name
+		if regErr.code == "ALREADY_AUTHENTICATED" {
+			context = c.Account
+		}
+
+		c.sendFail(s, "REGISTER", regErr.code, context, regErr.description)
+		return
+	}
+
+	if acct.Unverified {
+		c.sendRaw(":" + s.Hostname + " REGISTER VERIFICATION_REQUIRED " + acct.Name +
+			" :Account created, check " + acct.Email + " for a verification code")
+		return
+	}
+
+	c.sendRaw(":" + s.Hostname + " REGISTER SUCCESS " + acct.Name + " :Account successfully registered")
+	c.login(s, acct)
+}
+
+// Check that an account may be registered according to the registration
+// policy, then create it. Under the verify policy, the new account is
+// unverified and a code is written to the outbox.
+func (c *Client) createAccount(s *ServerInfo, name, email, password string) (*Account, *registerError) {
+	if len(c.Account) > 0 {
+		return nil, &registerError{"ALREADY_AUTHENTICATED", "You are already logged into an account"}
+	}
+
+	if s.RegistrationPolicy == REGISTER_OPER && !c.hasMode("o") {
+		return nil, &registerError{"DISALLOWED", "Only operators may register accounts"}
+	}
+
+	if !accountNameRegex.MatchString(name) {
+		return nil, &registerError{"BAD_ACCOUNT_NAME", "Account names must be valid nicks"}
+	}
+
+	if _, exists := s.accounts.getByNick(name); exists {
+		return nil, &registerError{"ACCOUNT_EXISTS", "Account already exists"}
+	}
+
+	if email == "*" {
+		email = ""
+	}
+	if (len(email) > 0 || s.RegistrationPolicy == REGISTER_VERIFY) && !validEmail(email) {
+		return nil, &registerError{"INVALID_EMAIL", "A valid email address is required"}
+	}
+
+	if len(password) < MIN_PASSWORD_LEN {
+		return nil, &registerError{"WEAK_PASSWORD",
+			fmt.Sprintf("Passwords must be at least %d characters long", MIN_PASSWORD_LEN)}
+	}
+
+	acct, err := newAccount(name, password)
+	if err != nil {
+		log.Println("Couldn't create account", name, err)
+		return nil, &registerError{"TEMPORARILY_UNAVAILABLE", "Couldn't create account"}
+	}
+	acct.Email = email
+
+	var code string
+	if s.RegistrationPolicy == REGISTER_VERIFY {
+		if code, err = newVerifyCode(); err != nil {
+			log.Println("Couldn't make verification code for", name, err)
+			return nil, &registerError{"TEMPORARILY_UNAVAILABLE", "Couldn't create account"}
+		}
+
+		acct.Unverified = true
+		acct.VerifyCode = hashVerifyCode(code)
+	}
+
+	if err := s.accounts.add(acct); err != nil {
+		log.Println("Couldn't create account", name, err)
+		return nil, &registerError{"TEMPORARILY_UNAVAILABLE", "Couldn't create account"}
+	}
+
+	if acct.Unverified {
+		if err := sendVerifyCode(s, acct, code); err != nil {
+			log.Println("Couldn't write verification code for", name, err)
+			s.accounts.drop(acct)
+			return nil, &registerError{"TEMPORARILY_UNAVAILABLE", "Couldn't send verification code"}
+		}
+	}
+
+	return acct, nil
+}
+
+// Handle VERIFY <account> <code>
+func (c *Client) verify(s *ServerInfo, name, code string) {
+	acct, exists := s.accounts.get(name)
+	if !exists {
+		c.sendFail(s, "VERIFY", "INVALID_CODE", name, "Invalid verification code")
+		return
+	}
+
+	if !acct.Unverified {
+		c.sendFail(s, "VERIFY", "ACCOUNT_ALREADY_VERIFIED", acct.Name, "Account is already verified")
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashVerifyCode(code)), []byte(acct.VerifyCode)) != 1 {
+		c.sendFail(s, "VERIFY", "INVALID_CODE", acct.Name, "Invalid verification code")
+		return
+	}
+
+	acct.Unverified = false
+	acct.VerifyCode = ""
+	s.accounts.save()
+
+	c.sendRaw(":" + s.Hostname + " VERIFY SUCCESS " + acct.Name + " :Account successfully verified")
+	if len(c.Account) == 0 {
+		c.login(s, acct)
+	}
+}
+
+// Write a verification code to the outbox directory instead of sending a
+// real email. Returns the code so it can be checked by VERIFY.
+func sendVerifyCode(s *ServerInfo, acct *Account, code string) error {
+	if err := os.MkdirAll(s.VerifyOutbox, 0700); err != nil {
+		return err
+	}
+
+	message := "To: " + acct.Email + NEWLINE +
+		"Subject: Verify your " + s.Network + " account" + NEWLINE + NEWLINE +
+		"To verify the account " + acct.Name + ", send this command:" + NEWLINE +
+		"/VERIFY " + acct.Name + " " + code + NEWLINE
+
+	path := filepath.Join(s.VerifyOutbox, fmt.Sprintf("%s-%d.txt", strings.ToLower(acct.Name), time.Now().Unix()))
+	return ioutil.WriteFile(path, []byte(message), 0600)
+}
+
+func newVerifyCode() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashVerifyCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// A very loose check that an email address looks like user@domain
+func validEmail(email string) bool {
+	at := strings.Index(email, "@")
+	return at > 0 && at < len(email)-1 && !strings.ContainsAny(email, " ,:")
+}
+
+// Check if a nick belongs to an account which the client isn't logged into
+func (c *Client) nickReserved(s *ServerInfo, nick string) bool {
+	acct, exists := s.accounts.getByNick(nick)
+	return exists && !acct.Unverified && !strings.EqualFold(c.Account, acct.Name)
+}
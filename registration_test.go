@@ -0,0 +1,129 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegisterOpen(t *testing.T) {
+	s := &ServerInfo{
+		RegistrationPolicy: REGISTER_OPEN,
+		accounts:           &AccountStore{Accounts: make(map[string]*Account)},
+	}
+
+	cl := newTestClient()
+	cl.Registered = true
+
+	cl.register(s, "*", "*", "short")
+	if _, exists := s.accounts.get("tester"); exists {
+		t.Error("Account registered with a weak password")
+	}
+
+	cl.register(s, "*", "*", "longenough")
+	if cl.Account != "tester" {
+		t.Errorf("Not logged in after registering, account is %q", cl.Account)
+	}
+
+	other := newTestClient()
+	other.Nick = "other"
+	if !other.nickReserved(s, "Tester") {
+		t.Error("Registered nick isn't reserved from other users")
+	}
+	if cl.nickReserved(s, "tester") {
+		t.Error("Registered nick is reserved from its owner")
+	}
+}
+
+func TestRegisterVerify(t *testing.T) {
+	outbox, err := ioutil.TempDir("", "gochat-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outbox)
+
+	s := &ServerInfo{
+		RegistrationPolicy: REGISTER_VERIFY,
+		VerifyOutbox:       outbox,
+		accounts:           loadAccounts(filepath.Join(outbox, "accounts.json")),
+	}
+
+	cl := newTestClient()
+	cl.Registered = true
+
+	cl.register(s, "camconn", "*", "longenough")
+	if _, exists := s.accounts.get("camconn"); exists {
+		t.Error("Account registered without an email under the verify policy")
+	}
+
+	cl.register(s, "camconn", "cam@example.com", "longenough")
+	if len(cl.Account) > 0 {
+		t.Error("Logged in before verifying")
+	}
+	cl.checkPassword(s, "camconn", "longenough", func(_ *Account, err error) {
+		if err != errUnverified {
+			t.Error("Unverified account could be logged into")
+		}
+	})
+
+	saved, _ := loadAccounts(filepath.Join(outbox, "accounts.json")).get("camconn")
+	if saved == nil || !saved.Unverified || len(saved.VerifyCode) == 0 {
+		t.Errorf("Account was saved before it was set up: %+v", saved)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(outbox, "camconn-*.txt"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message in the outbox, found %d", len(files))
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	fields := strings.Fields(string(data))
+	code := fields[len(fields)-1]
+
+	cl.verify(s, "camconn", "wrong")
+	if len(cl.Account) > 0 {
+		t.Error("Verified with the wrong code")
+	}
+
+	cl.verify(s, "camconn", code)
+	if cl.Account != "camconn" {
+		t.Errorf("Not logged in after verifying, account is %q", cl.Account)
+	}
+}
+
+func TestRegisterSaveFails(t *testing.T) {
+	s := &ServerInfo{
+		RegistrationPolicy: REGISTER_OPEN,
+		accounts:           loadAccounts(filepath.Join(t.TempDir(), "missing", "accounts.json")),
+	}
+
+	cl := newTestClient()
+	cl.Registered = true
+
+	cl.register(s, "*", "*", "longenough")
+	if len(cl.Account) > 0 {
+		t.Error("Logged in to an account which couldn't be saved")
+	}
+	if _, exists := s.accounts.get("tester"); exists {
+		t.Error("Account which couldn't be saved was kept")
+	}
+}
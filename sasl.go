@@ -0,0 +1,335 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SASL_MECHANISMS = "PLAIN,EXTERNAL,SCRAM-SHA-256"
+
+// Max length of a single AUTHENTICATE payload chunk
+const SASL_CHUNK = 400
+
+// State of a SASL exchange that is in progress
+type saslSession struct {
+	mech   string
+	buffer string // base64 chunks received so far
+	step   int
+
+	// SCRAM-SHA-256 state
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	account         *Account
+}
+
+// Handle a single AUTHENTICATE message. The first message picks a mechanism,
+// and the rest carry base64-encoded data for that mechanism.
+func (c *Client) authenticate(s *ServerInfo, param string) {
+	if !c.hasCap("sasl") {
+		c.sendServerMessage(s, ERR_SASLFAIL, "SASL authentication failed")
+		return
+	}
+
+	if len(c.Account) > 0 {
+		c.sendServerMessage(s, ERR_SASLALREADY, "You have already authenticated using SASL")
+		return
+	}
+
+	if len(param) > SASL_CHUNK {
+		c.sasl = nil
+		c.sendServerMessage(s, ERR_SASLTOOLONG, "SASL message too long")
+		return
+	}
+
+	if c.sasl == nil {
+		mech := strings.ToUpper(param)
+		if !strings.Contains(COMMA+SASL_MECHANISMS+COMMA, COMMA+mech+COMMA) {
+			c.sendServerTargetInfo(s, RPL_SASLMECHS, SASL_MECHANISMS, "are available SASL mechanisms")
+			c.sendServerMessage(s, ERR_SASLFAIL, "SASL authentication failed")
+			return
+		}
+
+		c.sasl = &saslSession{mech: mech}
+		c.sendRaw("AUTHENTICATE +")
+		return
+	}
+
+	if param == "*" {
+		c.sasl = nil
+		c.sendServerMessage(s, ERR_SASLABORTED, "SASL authentication aborted")
+		return
+	}
+
+	// wait for the rest of a message split into multiple chunks
+	if param != "+" {
+		c.sasl.buffer += param
+		if len(param) == SASL_CHUNK {
+			return
+		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(c.sasl.buffer)
+	c.sasl.buffer = ""
+	if err != nil {
+		c.saslFail(s)
+		return
+	}
+
+	switch c.sasl.mech {
+	case "PLAIN":
+		c.saslPlain(s, data)
+	case "EXTERNAL":
+		c.saslExternal(s, data)
+	case "SCRAM-SHA-256":
+		c.saslScram(s, data)
+	}
+}
+
+// PLAIN: authzid NUL authcid NUL password
+func (c *Client) saslPlain(s *ServerInfo, data []byte) {
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		c.saslFail(s)
+		return
+	}
+
+	authzid, authcid, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if len(authzid) > 0 && !strings.EqualFold(authzid, authcid) {
+		c.saslFail(s)
+		return
+	}
+
+	session := c.sasl
+	c.checkPassword(s, authcid, password, func(acct *Account, err error) {
+		if c.sasl != session { // aborted while the password was checked
+			return
+		} else if err != nil {
+			c.saslFail(s)
+			return
+		}
+
+		c.saslSuccess(s, acct)
+	})
+}
+
+// EXTERNAL: the TLS client certificate decides the account. The client may
+// optionally send the account name it expects.
+func (c *Client) saslExternal(s *ServerInfo, data []byte) {
+	acct, exists := s.accounts.getByCertFP(c.CertFP)
+	if !exists || (len(data) > 0 && !strings.EqualFold(string(data), acct.Name)) {
+		c.saslFail(s)
+		return
+	}
+
+	c.saslSuccess(s, acct)
+}
+
+// SCRAM-SHA-256 (RFC 7677). Channel binding isn't supported.
+func (c *Client) saslScram(s *ServerInfo, data []byte) {
+	session := c.sasl
+	msg := string(data)
+
+	switch session.step {
+	case 0: // client-first-message
+		parts := strings.SplitN(msg, COMMA, 3)
+		if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+			c.saslFail(s)
+			return
+		}
+
+		attrs := parseScramAttrs(parts[2])
+		name := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs["n"])
+		clientNonce := attrs["r"]
+		if len(name) == 0 || len(clientNonce) == 0 || len(attrs["m"]) > 0 {
+			c.saslFail(s)
+			return
+		}
+
+		if s.authBlocked(c, time.Now()) {
+			c.saslFail(s)
+			return
+		}
+
+		// accounts which can't log in get made-up credentials and fail at
+		// the end, so SCRAM doesn't tell anyone which accounts exist
+		salt, iterations := scramFakeSalt(name), SCRAM_ITERATIONS
+		acct, exists := s.accounts.get(name)
+		if exists && len(acct.ScramStoredKey) > 0 && !acct.Unverified {
+			salt, iterations = acct.ScramSalt, acct.ScramIterations
+		} else {
+			acct = nil
+		}
+
+		serverNonce := make([]byte, 18)
+		if _, err := rand.Read(serverNonce); err != nil {
+			c.saslFail(s)
+			return
+		}
+
+		session.gs2Header = parts[0] + COMMA + parts[1] + COMMA
+		session.clientFirstBare = parts[2]
+		session.nonce = clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+		session.account = acct
+		session.serverFirst = "r=" + session.nonce +
+			",s=" + base64.StdEncoding.EncodeToString(salt) +
+			",i=" + strconv.Itoa(iterations)
+		session.step++
+
+		c.sendAuthenticate([]byte(session.serverFirst))
+	case 1: // client-final-message
+		i := strings.LastIndex(msg, ",p=")
+		if i == -1 {
+			c.saslFail(s)
+			return
+		}
+
+		withoutProof := msg[:i]
+		attrs := parseScramAttrs(withoutProof)
+		proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+		if err != nil || len(proof) != sha256.Size ||
+			attrs["c"] != base64.StdEncoding.EncodeToString([]byte(session.gs2Header)) ||
+			attrs["r"] != session.nonce {
+			c.saslFail(s)
+			return
+		}
+
+		acct := session.account
+		if acct == nil {
+			s.authFailed(c, time.Now())
+			c.saslFail(s)
+			return
+		}
+
+		authMessage := []byte(session.clientFirstBare + COMMA + session.serverFirst + COMMA + withoutProof)
+
+		clientSignature := hmacSHA256(acct.ScramStoredKey, authMessage)
+		clientKey := make([]byte, sha256.Size)
+		for j := range clientKey {
+			clientKey[j] = proof[j] ^ clientSignature[j]
+		}
+
+		storedKey := sha256.Sum256(clientKey)
+		if !hmac.Equal(storedKey[:], acct.ScramStoredKey) {
+			s.authFailed(c, time.Now())
+			c.saslFail(s)
+			return
+		}
+
+		session.step++
+		serverSignature := hmacSHA256(acct.ScramServerKey, authMessage)
+		c.sendAuthenticate([]byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)))
+	case 2: // client acknowledges the server signature with an empty message
+		if len(data) > 0 {
+			c.saslFail(s)
+			return
+		}
+
+		c.saslSuccess(s, session.account)
+	}
+}
+
+// Key for making up SCRAM salts for accounts which don't exist. The same name
+// always gets the same salt while the server is running.
+var (
+	scramFakeKey     []byte
+	scramFakeKeyOnce sync.Once
+)
+
+func scramFakeSalt(name string) []byte {
+	scramFakeKeyOnce.Do(func() {
+		scramFakeKey = make([]byte, 32)
+		rand.Read(scramFakeKey)
+	})
+	return hmacSHA256(scramFakeKey, []byte(strings.ToLower(name)))[:16]
+}
+
+// Split SCRAM attributes such as "n=user,r=nonce" into a map
+func parseScramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, COMMA) {
+		if len(attr) >= 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+
+	return attrs
+}
+
+// Send base64-encoded SASL data, split into chunks of SASL_CHUNK bytes
+func (c *Client) sendAuthenticate(data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	for len(encoded) >= SASL_CHUNK {
+		c.sendRaw("AUTHENTICATE " + encoded[:SASL_CHUNK])
+		encoded = encoded[SASL_CHUNK:]
+	}
+
+	if len(encoded) > 0 {
+		c.sendRaw("AUTHENTICATE " + encoded)
+	} else {
+		c.sendRaw("AUTHENTICATE +")
+	}
+}
+
+func (c *Client) saslFail(s *ServerInfo) {
+	c.sasl = nil
+	c.sendServerMessage(s, ERR_SASLFAIL, "SASL authentication failed")
+}
+
+func (c *Client) saslSuccess(s *ServerInfo, acct *Account) {
+	c.sasl = nil
+	c.login(s, acct)
+	c.sendServerMessage(s, RPL_SASLSUCCESS, "SASL authentication successful")
+}
+
+// Attach an account to a client
+func (c *Client) login(s *ServerInfo, acct *Account) {
+	log.Println(c.nickOrStar(), "logged in as", acct.Name)
+
+	c.Account = acct.Name
+	c.addMode("r")
+	c.sendServerTargetInfo(s, RPL_LOGGEDIN, c.nickOrStar()+"!"+c.Username+"@"+c.Host()+" "+acct.Name,
+		"You are now logged in as "+acct.Name)
+
+	// clients logging in with SASL get their memos once they're connected
+	if c.Registered {
+		deliverMemos(s, c)
+	}
+}
+
+// Detach a client from its account
+func (c *Client) logout(s *ServerInfo) {
+	log.Println(c.nickOrStar(), "logged out of", c.Account)
+
+	c.Account = ""
+	c.removeMode("r")
+	c.sendServerTargetInfo(s, RPL_LOGGEDOUT, c.nickOrStar()+"!"+c.Username+"@"+c.Host(), "You are now logged out")
+}
@@ -0,0 +1,212 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAccounts(t *testing.T) *ServerInfo {
+	s := &ServerInfo{accounts: &AccountStore{Accounts: make(map[string]*Account)}}
+
+	if _, err := s.accounts.create("camconn", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func newTestClient() *Client {
+	conn, _ := net.Pipe()
+	return &Client{Conn: conn, Nick: "tester", Caps: map[string]bool{"sasl": true}}
+}
+
+func b64(data string) string {
+	return base64.StdEncoding.EncodeToString([]byte(data))
+}
+
+func TestSaslPlain(t *testing.T) {
+	s := newTestAccounts(t)
+
+	cl := newTestClient()
+	cl.authenticate(s, "PLAIN")
+	cl.authenticate(s, b64("\x00camconn\x00wrong"))
+	if len(cl.Account) > 0 {
+		t.Error("Logged in with the wrong password")
+	}
+
+	cl.authenticate(s, "PLAIN")
+	cl.authenticate(s, b64("\x00CamConn\x00hunter2"))
+	if cl.Account != "camconn" || !cl.hasMode("r") {
+		t.Errorf("PLAIN login failed, account is %q", cl.Account)
+	}
+}
+
+func TestSaslScram(t *testing.T) {
+	s := newTestAccounts(t)
+
+	cl := newTestClient()
+	cl.authenticate(s, "SCRAM-SHA-256")
+
+	clientFirstBare := "n=camconn,r=clientnonce"
+	cl.authenticate(s, b64("n,,"+clientFirstBare))
+	if cl.sasl == nil || cl.sasl.step != 1 {
+		t.Fatal("Server didn't accept client-first-message")
+	}
+
+	// compute the client proof the same way a real client would
+	attrs := parseScramAttrs(cl.sasl.serverFirst)
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	iterations, _ := strconv.Atoi(attrs["i"])
+	if !strings.HasPrefix(attrs["r"], "clientnonce") {
+		t.Fatal("Server nonce doesn't start with the client nonce")
+	}
+
+	saltedPassword, _ := pbkdf2.Key(sha256.New, "hunter2", salt, iterations, sha256.Size)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=" + b64("n,,") + ",r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + cl.sasl.serverFirst + "," + withoutProof
+	clientSignature := hmacSHA256(storedKey[:], []byte(authMessage))
+
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	cl.authenticate(s, b64(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof)))
+	if cl.sasl == nil || cl.sasl.step != 2 {
+		t.Fatal("Server didn't accept client-final-message")
+	}
+
+	cl.authenticate(s, "+")
+	if cl.Account != "camconn" {
+		t.Errorf("SCRAM login failed, account is %q", cl.Account)
+	}
+}
+
+func TestSaslExternal(t *testing.T) {
+	s := newTestAccounts(t)
+	acct, _ := s.accounts.get("camconn")
+	acct.CertFPs = []string{"abcdef"}
+
+	cl := newTestClient()
+	cl.CertFP = "ABCDEF"
+	cl.authenticate(s, "EXTERNAL")
+	cl.authenticate(s, "+")
+	if cl.Account != "camconn" {
+		t.Errorf("EXTERNAL login failed, account is %q", cl.Account)
+	}
+}
+
+func TestSaslScramUnknownAccount(t *testing.T) {
+	s := newTestAccounts(t)
+
+	var salts []string
+	for i := 0; i < 2; i++ {
+		cl := newTestClient()
+		cl.authenticate(s, "SCRAM-SHA-256")
+		cl.authenticate(s, b64("n,,n=nobody,r=clientnonce"))
+		if cl.sasl == nil || cl.sasl.step != 1 {
+			t.Fatal("An unknown account was refused straight away")
+		}
+
+		attrs := parseScramAttrs(cl.sasl.serverFirst)
+		if attrs["i"] != strconv.Itoa(SCRAM_ITERATIONS) || len(attrs["s"]) == 0 {
+			t.Errorf("Made-up credentials look different: %q", cl.sasl.serverFirst)
+		}
+		salts = append(salts, attrs["s"])
+
+		withoutProof := "c=" + b64("n,,") + ",r=" + attrs["r"]
+		cl.authenticate(s, b64(withoutProof+",p="+base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))))
+		if cl.sasl != nil || len(cl.Account) > 0 {
+			t.Error("Logged into an account which doesn't exist")
+		}
+	}
+
+	if salts[0] != salts[1] {
+		t.Error("An unknown account got a different salt each time")
+	}
+}
+
+func TestPasswordCheckAsync(t *testing.T) {
+	s := newTestAccounts(t)
+	events := make(chan *Event, 1)
+	s.events = events
+
+	cl := newTestClient()
+	cl.authenticate(s, "PLAIN")
+	cl.authenticate(s, b64("\x00camconn\x00hunter2"))
+	if len(cl.Account) > 0 {
+		t.Fatal("Password was checked by the event handler")
+	}
+
+	e := <-events
+	if e.Type != PASSCHECK || e.Sender != cl {
+		t.Fatalf("Got event %+v instead of the password check", e)
+	}
+
+	cl.finishPasswordCheck(s, e.Body == "ok")
+	if cl.Account != "camconn" {
+		t.Errorf("Not logged in after the check, account is %q", cl.Account)
+	}
+}
+
+func TestPasswordFailureLimits(t *testing.T) {
+	s := newTestAccounts(t)
+
+	login := func(cl *Client, password string) bool {
+		cl.authenticate(s, "PLAIN")
+		cl.authenticate(s, b64("\x00camconn\x00"+password))
+		return len(cl.Account) > 0
+	}
+
+	cl := newTestClient()
+	for i := 0; i < MAX_AUTH_FAILURES; i++ {
+		login(cl, "wrong")
+	}
+	if login(cl, "hunter2") {
+		t.Error("Logged in after too many failures on one connection")
+	}
+
+	// every test client has the same address
+	for failures := MAX_AUTH_FAILURES; failures < MAX_IP_AUTH_FAILURES; {
+		other := newTestClient()
+		for i := 0; i < MAX_AUTH_FAILURES && failures < MAX_IP_AUTH_FAILURES; i++ {
+			login(other, "wrong")
+			failures++
+		}
+	}
+	if login(newTestClient(), "hunter2") {
+		t.Error("Logged in after too many failures from one IP")
+	}
+
+	s.authFailures[newTestClient().IP()].expires = time.Now().Add(-time.Second)
+	if !login(newTestClient(), "hunter2") {
+		t.Error("IP still refused after its failures expired")
+	}
+}
@@ -0,0 +1,64 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Handles a PRIVMSG sent to a service. `service` is the pseudo-client the
+// message was sent to.
+type serviceHandler func(s *ServerInfo, service, sender *Client, message string,
+	users map[string]*Client, channels map[string]*Channel)
+
+// Create a pseudo-client for an internal service such as NickServ. Services
+// live in the users map like everyone else, but have no connection, so
+// messages to them are handled by `handler` instead of being sent anywhere.
+func newService(s *ServerInfo, nick string, handler serviceHandler) *Client {
+	return &Client{
+		Nick:       nick,
+		Username:   nick,
+		Realname:   nick + " Service",
+		Cloak:      "services." + s.Hostname,
+		Registered: true,
+		Signon:     time.Now().Unix(),
+		Caps:       make(map[string]bool),
+		service:    handler,
+	}
+}
+
+func addService(users map[string]*Client, service *Client) {
+	users[strings.ToLower(service.Nick)] = service
+}
+
+// Send a NOTICE from a service to a client
+func (service *Client) notice(cl *Client, message string) {
+	cl.sendTagged(messageTags(service, nil), ":"+service.String()+" NOTICE "+cl.Nick+" :"+message)
+}
+
+// Split a message to a service into an upper-case command and its parameters
+func serviceCommand(message string) (string, []string) {
+	words := strings.Fields(message)
+	if len(words) == 0 {
+		return "", nil
+	}
+
+	return strings.ToUpper(words[0]), words[1:]
+}
@@ -0,0 +1,219 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Max length of the tag section of a line, including the leading @ and the
+// trailing space
+const MAX_TAGS_LEN = 8191
+
+// Max length of the tag data a client may send, not counting the @ and space
+const MAX_CLIENT_TAGS_LEN = 4094
+
+// The capability a client needs to be sent each server tag. Client-only tags
+// and anything else not listed here need message-tags.
+var tagCaps = map[string]string{
+	"account": "account-tag",
+	"batch":   "batch",
+	"time":    "server-time",
+}
+
+var tagEscaper = strings.NewReplacer("\\", "\\\\", ";", "\\:", " ", "\\s", "\r", "\\r", "\n", "\\n")
+
+// Split the message tags off the front of a line, such as
+// "@+draft/reply=abc;+example.com/foo PRIVMSG #chan :hi". Returns false if
+// the tag section is too long.
+func parseTags(line string) (map[string]string, string, bool) {
+	if len(line) == 0 || line[0] != '@' {
+		return nil, line, true
+	}
+
+	end := strings.Index(line, SPACE)
+	if end == -1 {
+		end = len(line)
+	}
+
+	if end+1 > MAX_TAGS_LEN || end-1 > MAX_CLIENT_TAGS_LEN {
+		return nil, "", false
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(line[1:end], ";") {
+		pair := strings.SplitN(tag, "=", 2)
+		if len(pair[0]) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(pair) == 2 {
+			value = unescapeTagValue(pair[1])
+		}
+
+		// if a tag is repeated, the last one wins
+		tags[pair[0]] = value
+	}
+
+	return tags, strings.TrimLeft(line[end:], SPACE), true
+}
+
+// Undo the escaping of a tag value. An unknown escape such as \b is just
+// the character after the backslash, and a backslash at the end is dropped.
+func unescapeTagValue(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	unescaped := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped = append(unescaped, value[i])
+			continue
+		}
+
+		i++
+		if i == len(value) {
+			break
+		}
+
+		switch value[i] {
+		case ':':
+			unescaped = append(unescaped, ';')
+		case 's':
+			unescaped = append(unescaped, ' ')
+		case 'r':
+			unescaped = append(unescaped, '\r')
+		case 'n':
+			unescaped = append(unescaped, '\n')
+		default:
+			unescaped = append(unescaped, value[i])
+		}
+	}
+
+	return string(unescaped)
+}
+
+// Format tags for sending, sorted by key so lines are predictable. Tags with
+// empty values are sent without an =.
+func formatTags(tags map[string]string) string {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	formatted := make([]string, len(keys))
+	for i, key := range keys {
+		formatted[i] = key
+		if len(tags[key]) > 0 {
+			formatted[i] += "=" + tagEscaper.Replace(tags[key])
+		}
+	}
+
+	return strings.Join(formatted, ";")
+}
+
+// Pick out the client-only tags (those starting with +) which are relayed
+// from one client to another
+func clientTags(tags map[string]string) map[string]string {
+	relayed := make(map[string]string)
+	for key, value := range tags {
+		if strings.HasPrefix(key, "+") {
+			relayed[key] = value
+		}
+	}
+
+	return relayed
+}
+
+// Tags for a message from `sender`: when it was sent, a unique ID, and the
+// sender's account, along with any client-only tags being relayed
+func messageTags(sender *Client, relayed map[string]string) map[string]string {
+	tags := map[string]string{
+		"time":  serverTime(time.Now()),
+		"msgid": newMsgID(),
+	}
+
+	if len(sender.Account) > 0 {
+		tags["account"] = sender.Account
+	}
+
+	for key, value := range relayed {
+		tags[key] = value
+	}
+
+	return tags
+}
+
+// A random ID for the msgid tag
+func newMsgID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Send a line with message tags, leaving out the tags this client hasn't
+// enabled the capability for
+func (c *Client) sendTagged(tags map[string]string, line string) {
+	enabled := make(map[string]string)
+	for key, value := range tags {
+		needed, exists := tagCaps[key]
+		if !exists {
+			needed = "message-tags"
+		}
+
+		if c.hasCap(needed) {
+			enabled[key] = value
+		}
+	}
+
+	if len(enabled) == 0 {
+		c.sendRaw(line)
+		return
+	}
+
+	c.sendRaw("@" + formatTags(enabled) + " " + line)
+}
+
+// Send a PRIVMSG, NOTICE or TAGMSG from `sender` to this client. TAGMSG is
+// only sent to clients which can see tags.
+func (c *Client) relayTo(tags map[string]string, sender *Client, command, target, message string) {
+	line := ":" + sender.String() + " " + command + " " + target
+	if command != "TAGMSG" {
+		line += " :" + message
+	} else if !c.hasCap("message-tags") {
+		return
+	}
+
+	c.sendTagged(tags, line)
+}
+
+// Send a message back to the client which sent it, if it has enabled
+// echo-message, so it can see the message as everyone else got it
+func (c *Client) echo(tags map[string]string, command, target, message string) {
+	if c.hasCap("echo-message") {
+		c.relayTo(tags, c, command, target, message)
+	}
+}
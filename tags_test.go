@@ -0,0 +1,116 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, rest, ok := parseTags(`@+example.com/foo=a\sb\:c\\d;+typing=active;bare;+end=x\ PRIVMSG #chan :hi`)
+	if !ok {
+		t.Fatal("Valid tags were rejected")
+	}
+
+	if rest != "PRIVMSG #chan :hi" {
+		t.Errorf("Line after tags is %q", rest)
+	}
+
+	expected := map[string]string{
+		"+example.com/foo": `a b;c\d`,
+		"+typing":          "active",
+		"bare":             "",
+		"+end":             "x",
+	}
+	for key, value := range expected {
+		if tags[key] != value {
+			t.Errorf("Tag %s is %q, not %q", key, tags[key], value)
+		}
+	}
+
+	if _, _, ok = parseTags("@+a=" + strings.Repeat("x", MAX_CLIENT_TAGS_LEN) + " TAGMSG #chan"); ok {
+		t.Error("Tags over the length limit were accepted")
+	}
+
+	if _, rest, _ = parseTags("PRIVMSG #chan :no tags"); rest != "PRIVMSG #chan :no tags" {
+		t.Errorf("Line without tags was changed to %q", rest)
+	}
+}
+
+func TestFormatTags(t *testing.T) {
+	tags := map[string]string{"+b": "semi;colon space", "+a": ""}
+
+	formatted := formatTags(tags)
+	if formatted != `+a;+b=semi\:colon\sspace` {
+		t.Errorf("Tags formatted as %q", formatted)
+	}
+
+	parsed, _, _ := parseTags("@" + formatted + " TAGMSG #chan")
+	if parsed["+b"] != tags["+b"] {
+		t.Errorf("Tag value didn't survive a round trip: %q", parsed["+b"])
+	}
+
+	if relayed := clientTags(map[string]string{"+a": "1", "time": "now"}); len(relayed) != 1 {
+		t.Errorf("Only client-only tags should be relayed, got %v", relayed)
+	}
+}
+
+func TestTaggedEvent(t *testing.T) {
+	e := NewEvent(newTestClient(), "@+typing=active TAGMSG #chan")
+	if e.Type != TAGMSG || e.Target != "#chan" || e.Tags["+typing"] != "active" {
+		t.Errorf("Tagged TAGMSG parsed as type %d, target %q, tags %v", e.Type, e.Target, e.Tags)
+	}
+}
+
+func TestSendTagged(t *testing.T) {
+	sender := newTestClient()
+	sender.Account = "camconn"
+	tags := messageTags(sender, map[string]string{"+typing": "active"})
+
+	if len(tags["msgid"]) == 0 || len(tags["time"]) == 0 || tags["account"] != "camconn" {
+		t.Fatalf("Message tags are missing server tags: %v", tags)
+	}
+
+	if tags["msgid"] == messageTags(sender, nil)["msgid"] {
+		t.Error("Message IDs aren't unique")
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	cl := NewClient(server)
+	cl.Caps["server-time"] = true
+	go cl.writeLoop()
+
+	cl.sendTagged(tags, ":tester PRIVMSG someone :hi")
+
+	reader := bufio.NewReader(client)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the time tag should be sent without account-tag and message-tags
+	if !strings.HasPrefix(line, "@time="+tags["time"]+" :tester PRIVMSG") {
+		t.Errorf("Tagged line sent as %q", line)
+	}
+}
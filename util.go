@@ -21,6 +21,7 @@ package main
 import (
 	"github.com/go-ini/ini"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -36,37 +37,191 @@ const (
 	RPL_CREATED          = 003
 	RPL_MYINFO           = 004
 	RPL_ISUPPORT         = 005
+	RPL_SNOMASK          = 010 // 008, written in octal like the numerics above it
+	RPL_STATSLINKINFO    = 211
+	RPL_STATSCOMMANDS    = 212
+	RPL_STATSKLINE       = 216
+	RPL_ENDOFSTATS       = 219
 	RPL_UMODEIS          = 221
+	RPL_STATSDLINE       = 225
+	RPL_RULES            = 232
+	RPL_STATSUPTIME      = 242
+	RPL_STATSOLINE       = 243
+	RPL_STATSDEBUG       = 249
+	RPL_LUSERCLIENT      = 251
+	RPL_LUSEROP          = 252
+	RPL_LUSERCHANNELS    = 254
+	RPL_LUSERME          = 255
+	RPL_ADMINME          = 256
+	RPL_ADMINLOC1        = 257
+	RPL_ADMINLOC2        = 258
+	RPL_ADMINEMAIL       = 259
+	RPL_LOCALUSERS       = 265
+	RPL_GLOBALUSERS      = 266
+	RPL_AWAY             = 301
+	RPL_USERHOST         = 302
+	RPL_ISON             = 303
+	RPL_UNAWAY           = 305
+	RPL_NOWAWAY          = 306
+	RPL_RULESSTART       = 308
+	RPL_ENDOFRULES       = 309
+	RPL_WHOISUSER        = 311
+	RPL_WHOISSERVER      = 312
+	RPL_WHOISOPERATOR    = 313
+	RPL_ENDOFWHO         = 315
+	RPL_ENDOFWHOIS       = 318
+	RPL_WHOISCHANNELS    = 319
+	RPL_WHOISSPECIAL     = 320
+	RPL_LISTSTART        = 321
+	RPL_LIST             = 322
+	RPL_LISTEND          = 323
 	RPL_CHANNELMODEIS    = 324
+	RPL_WHOISACCOUNT     = 330
 	RPL_NOTOPIC          = 331
 	RPL_TOPIC            = 332
 	RPL_VERSION          = 351
+	RPL_WHOREPLY         = 352
 	RPL_NAMREPLY         = 353
 	RPL_ENDOFNAMES       = 366
-	RPL_MOTDSTART        = 375
+	RPL_INFO             = 371
 	RPL_MOTD             = 372
+	RPL_ENDOFINFO        = 374
+	RPL_MOTDSTART        = 375
 	RPL_ENDOFMOTD        = 376
+	RPL_WHOISHOST        = 378
+	RPL_YOUREOPER        = 381
+	RPL_REHASHING        = 382
+	RPL_TIME             = 391
+	RPL_USERSSTART       = 392
+	RPL_USERS            = 393
+	RPL_ENDOFUSERS       = 394
+	RPL_NOUSERS          = 395
+	RPL_HOSTHIDDEN       = 396
 	ERR_NOSUCHNICK       = 401
 	ERR_NOSUCHCHANNEL    = 403
 	ERR_CANNOTSENDTOCHAN = 404
 	ERR_TOOMANYCHANNELS  = 405
 	ERR_WASNOSUCHNICK    = 406
 	ERR_TOOMANYTARGETS   = 407
+	ERR_INVALIDCAPCMD    = 410
 	ERR_NORECIPIENT      = 411
+	ERR_INPUTTOOLONG     = 417
 	ERR_UNKNOWNCOMMAND   = 421
+	ERR_NONICKNAMEGIVEN  = 431
 	ERR_ERRONEUSNICKNAME = 432
 	ERR_NICKNAMEINUSE    = 433
+	ERR_NORULES          = 434
+	ERR_USERNOTINCHANNEL = 441
 	ERR_NOTONCHANNEL     = 442
 	ERR_NEEDMOREPARAMS   = 461
+	ERR_ALREADYREGISTRED = 462
+	ERR_PASSWDMISMATCH   = 464
+	ERR_YOUREBANNEDCREEP = 465
+	ERR_UNKNOWNMODE      = 472
+	ERR_BANNEDFROMCHAN   = 474
+	ERR_NOPRIVILEGES     = 481
+	ERR_CHANOPRIVSNEEDED = 482
+	ERR_CANTKILLSERVER   = 483
+	ERR_NOOPERHOST       = 491
+	ERR_UMODEUNKNOWNFLAG = 501
+	ERR_USERSDONTMATCH   = 502
+	ERR_HELPNOTFOUND     = 524
+	RPL_WHOISSECURE      = 671
+	RPL_HELPSTART        = 704
+	RPL_HELPTXT          = 705
+	RPL_ENDOFHELP        = 706
+	RPL_MONONLINE        = 730
+	RPL_MONOFFLINE       = 731
+	RPL_MONLIST          = 732
+	RPL_ENDOFMONLIST     = 733
+	ERR_MONLISTFULL      = 734
+	RPL_LOGGEDIN         = 900
+	RPL_LOGGEDOUT        = 901
+	ERR_NICKLOCKED       = 902
+	RPL_SASLSUCCESS      = 903
+	ERR_SASLFAIL         = 904
+	ERR_SASLTOOLONG      = 905
+	ERR_SASLABORTED      = 906
+	ERR_SASLALREADY      = 907
+	RPL_SASLMECHS        = 908
 )
 
 type ServerInfo struct {
-	Hostname     string
-	Network      string
-	MotdPath     string
-	MotdData     []string
-	DefaultCloak string
-	started      *time.Time
+	Hostname               string
+	Network                string
+	MotdPath               string
+	MotdData               []string
+	HelpPath               string
+	HelpData               map[string][]string `ini:"-"` // topic => lines
+	RulesPath              string
+	RulesData              []string
+	CloakSecret            string
+	AccountCloaks          bool
+	MaxChannels            int
+	AccountsPath           string
+	ChannelsPath           string
+	RegistrationPolicy     string
+	VerifyOutbox           string
+	NickGrace              int
+	MemoQuota              int
+	FloodBurst             int
+	FloodRate              int
+	FloodBacklog           int
+	MaxPerIP               int
+	MaxPerNet              int
+	IPv4NetBits            int
+	IPv6NetBits            int
+	ThrottleCount          int
+	ThrottlePeriod         int
+	ConnectExempt          string
+	BansPath               string
+	ResolveHostnames       bool
+	IdentLookups           bool
+	LookupTimeout          int
+	DNSBLCacheTime         int
+	HistoryPath            string
+	HistoryLines           int
+	HistoryAge             int
+	HistoryPlayback        int
+	TLSPort                int
+	TLSCertPath            string
+	TLSKeyPath             string
+	ProxyProtocol          bool
+	TLSProxyProtocol       bool
+	ProxyTrusted           string
+	WebSocketPort          int
+	WebSocketTLS           bool
+	WebSocketOrigins       string
+	WebSocketProxyProtocol bool
+	Admin                  AdminInfo         `ini:"-"`
+	Opers                  map[string]string `ini:"-"` // oper name => password
+	started                *time.Time
+	maxUsers               int
+	commandStats           map[string]*CommandStat
+	accounts               *AccountStore
+	registered             *ChannelStore
+	history                *HistoryStore
+	bans                   *BanStore
+	limits                 *ConnLimits
+	resolver               Resolver
+	ident                  IdentFunc
+	dnsbl                  *DNSBLChecker
+	monitors               map[string]map[*Client]bool // lowercase nick => clients watching it
+	authFailures           map[string]*ipAuthFailures  // IP => failed password attempts
+	events                 chan<- *Event               // lets timers queue events for the event handler
+}
+
+// Contact information for the server administrator, as sent by ADMIN
+type AdminInfo struct {
+	Location1 string
+	Location2 string
+	Email     string
+}
+
+// Usage counter for a single command, as reported by STATS m
+type CommandStat struct {
+	Count int
+	Bytes int
 }
 
 // Search for a term in a sorted space. Returns the index
@@ -136,70 +291,203 @@ func loadConfig() *ServerInfo {
 		log.Fatal(err)
 	}
 
+	err = cfg.Section("Admin").MapTo(&serverConfig.Admin)
+	if err != nil {
+		log.Println("Couldn't map admin configuration!")
+		log.Fatal(err)
+	}
+
+	serverConfig.Opers = cfg.Section("Opers").KeysHash()
+	serverConfig.commandStats = make(map[string]*CommandStat)
+	serverConfig.dnsbl = loadDNSBL(cfg.Section("DNSBL").KeysHash(), serverConfig.DNSBLCacheTime)
+
 	now := time.Now()
 	serverConfig.started = &now
 
+	if len(serverConfig.CloakSecret) == 0 {
+		log.Println("No CloakSecret is set, so users' IP addresses will be visible")
+	}
+
+	serverConfig.resolver = net.DefaultResolver
+	serverConfig.ident = queryIdent
+
 	log.Println("Loading motd")
 	readMotd(serverConfig, serverConfig.MotdPath)
 
+	log.Println("Loading accounts")
+	serverConfig.accounts = loadAccounts(serverConfig.AccountsPath)
+
+	log.Println("Loading registered channels")
+	serverConfig.registered = loadChannelStore(serverConfig.ChannelsPath)
+
+	log.Println("Loading bans")
+	serverConfig.bans = loadBans(serverConfig.BansPath)
+	serverConfig.limits = newConnLimits(serverConfig)
+
+	log.Println("Loading history")
+	serverConfig.history = loadHistory(serverConfig.HistoryPath, serverConfig.HistoryLines, serverConfig.HistoryAge)
+
+	switch serverConfig.RegistrationPolicy {
+	case REGISTER_OPEN, REGISTER_OPER:
+	case REGISTER_VERIFY:
+		capabilities["draft/account-registration"] += ",email-required"
+	default:
+		log.Fatal("Unknown RegistrationPolicy: ", serverConfig.RegistrationPolicy)
+	}
+
+	log.Println("Loading help and rules")
+	readHelp(serverConfig, serverConfig.HelpPath)
+	readRules(serverConfig, serverConfig.RulesPath)
+
 	log.Println("Configuration fully loaded")
 	return serverConfig
 
 }
 
+// Record a use of a command for STATS m
+func (s *ServerInfo) countCommand(command string, size int) {
+	stat, exists := s.commandStats[command]
+	if !exists {
+		stat = new(CommandStat)
+		s.commandStats[command] = stat
+	}
+
+	stat.Count++
+	stat.Bytes += size
+}
+
 // read motd from file and write data to ServerInfo
 func readMotd(s *ServerInfo, path string) {
-	f, err := os.Open(path)
-	defer f.Close()
-
+	lines, err := readLines(path)
 	if err != nil {
 		log.Fatal("Invalid motd path: " + path)
 	}
 
-	fInfo, err := f.Stat()
+	s.MotdData = lines
+
+	log.Println("MOTD Loaded")
+}
+
+// Read a text file and split it into lines
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal("Not able to load information about MOTD file")
+		return nil, err
 	}
+	defer f.Close()
 
-	fSize := fInfo.Size()
-	data := make([]byte, fSize)
+	fInfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
 
+	data := make([]byte, fInfo.Size())
 	_, err = f.Read(data)
+	if err != nil && fInfo.Size() > 0 {
+		return nil, err
+	}
 
-	motdRaw := string(data[:len(data)])
-	data = []byte{} // go ahead and clean out byte array
+	raw := strings.TrimRight(strings.Replace(string(data), "\r", "", -1), NEWLINE)
+	return strings.Split(raw, NEWLINE), nil
+}
 
-	s.MotdData = strings.Split(motdRaw, NEWLINE)
+// Reload the MOTD, help topics, and rules without restarting the server.
+// Unlike startup, a missing file here is logged instead of being fatal.
+func rehash(s *ServerInfo) {
+	log.Println("Rehashing")
 
-	log.Println("MOTD Loaded")
+	if lines, err := readLines(s.MotdPath); err == nil {
+		s.MotdData = lines
+	} else {
+		log.Println("Couldn't reload motd:", err)
+	}
+
+	readHelp(s, s.HelpPath)
+	readRules(s, s.RulesPath)
 }
 
-func (c *Client) sendWelcomeMessage(s *ServerInfo) {
+func (c *Client) sendWelcomeMessage(s *ServerInfo, users map[string]*Client, channels map[string]*Channel) {
 	c.sendServerMessage(s, RPL_WELCOME, "Welcome to the Internet Relay Network "+c.String())
 	c.sendServerMessage(s, RPL_YOURHOST, "Your host is "+s.Hostname+", running version "+string(VERSION))
 
 	dateCreatedStr := s.started.Format(TIMEFORMAT)
 	c.sendServerMessage(s, RPL_CREATED, "This server was stared on "+dateCreatedStr)
 
-	infoStr := s.Hostname + strings.Join([]string{s.Hostname, VERSION, "+", "+"}, SPACE)
-	c.sendServerMessage(s, RPL_MYINFO, infoStr)
+	c.sendMessage(strings.Join([]string{
+		s.Hostname,
+		padNumeric(RPL_MYINFO),
+		c.Nick,
+		s.Hostname,
+		VERSION,
+		USER_MODES,
+		CHANNEL_MODES,
+	}, SPACE))
 
-	c.sendServerMessage(s, RPL_ISUPPORT, iSupport(s))
+	c.sendISupport(s)
 
+	c.sendLusers(s, users, channels)
 	c.sendMotd(s)
 }
 
-// Generate ISUPPORT string
-func iSupport(s *ServerInfo) string {
-	supports := "CASEMAPPING NICKLEN=16"
+// Max number of tokens sent in a single RPL_ISUPPORT line
+const ISUPPORT_PER_LINE = 13
+
+// Generate ISUPPORT tokens from the server configuration and the features
+// this server implements
+func iSupport(s *ServerInfo) []string {
+	chanLimit := "CHANLIMIT=#&:"
+	if s.MaxChannels > 0 {
+		chanLimit += strconv.Itoa(s.MaxChannels)
+	}
 
-	supports += " NETWORK=" + s.Network
+	supports := []string{
+		"CASEMAPPING=ascii",
+		"CHATHISTORY=" + strconv.Itoa(CHATHISTORY_LIMIT),
+		"CHANTYPES=#&",
+		"CHANMODES=" + strings.Join([]string{CHANMODES_LIST, CHANMODES_PARAM, CHANMODES_SETPARAM, CHANMODES_FLAG}, COMMA),
+		chanLimit,
+		"ELIST=MNU",
+		"KICKLEN=" + strconv.Itoa(KICKLEN),
+		"MODES=" + strconv.Itoa(MAXMODES),
+		"MONITOR=" + strconv.Itoa(MONITOR_LIMIT),
+		"MSGREFTYPES=msgid,timestamp",
+		"NETWORK=" + s.Network,
+		"NICKLEN=" + strconv.Itoa(NICKLEN),
+		"PREFIX=" + prefixToken(),
+		"TARGMAX=JOIN:,PART:,PRIVMSG:1,MONITOR:",
+		"TOPICLEN=" + strconv.Itoa(TOPICLEN),
+	}
 
-	// TODO: Dynamically add on for MAXCHANNELS, MODES, etc.
+	if len(PREFIX_SYMBOLS) > 0 {
+		supports = append(supports, "STATUSMSG="+PREFIX_SYMBOLS)
+	}
 
 	return supports
 }
 
+// PREFIX is empty when there are no membership modes
+func prefixToken() string {
+	if len(PREFIX_MODES) == 0 {
+		return ""
+	}
+
+	return "(" + PREFIX_MODES + ")" + PREFIX_SYMBOLS
+}
+
+// Send ISUPPORT tokens, split across as many RPL_ISUPPORT lines as needed
+func (c *Client) sendISupport(s *ServerInfo) {
+	tokens := iSupport(s)
+
+	for i := 0; i < len(tokens); i += ISUPPORT_PER_LINE {
+		end := i + ISUPPORT_PER_LINE
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		c.sendServerTargetInfo(s, RPL_ISUPPORT, strings.Join(tokens[i:end], SPACE), "are supported by this server")
+	}
+}
+
 func (c *Client) sendMotd(s *ServerInfo) {
 	c.sendServerMessage(s, RPL_MOTDSTART, "- "+s.Hostname+" message of the day")
 	for _, line := range s.MotdData {
@@ -208,6 +496,41 @@ func (c *Client) sendMotd(s *ServerInfo) {
 	c.sendServerMessage(s, RPL_ENDOFMOTD, "End of MOTD command")
 }
 
+// Check if a string matches a mask, where `*` matches any number of
+// characters and `?` matches exactly one character. Matching is not
+// case-sensitive.
+func matchMask(mask, str string) bool {
+	mask = strings.ToLower(mask)
+	str = strings.ToLower(str)
+
+	// position to retry from after the last `*` in the mask
+	star, retry := -1, 0
+	m, i := 0, 0
+
+	for i < len(str) {
+		if m < len(mask) && (mask[m] == '?' || mask[m] == str[i]) {
+			m++
+			i++
+		} else if m < len(mask) && mask[m] == '*' {
+			star = m
+			retry = i
+			m++
+		} else if star != -1 {
+			m = star + 1
+			retry++
+			i = retry
+		} else {
+			return false
+		}
+	}
+
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+
+	return m == len(mask)
+}
+
 // pad a numeric to a length of 3 characters
 // TODO: Make safe and error resistant for numerics accidentally over 999
 func padNumeric(n int) string {
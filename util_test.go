@@ -99,3 +99,59 @@ func TestNumericPad(t *testing.T) {
 		t.Error("Bad numeric padding")
 	}
 }
+
+func TestCountCommand(t *testing.T) {
+	s := &ServerInfo{commandStats: make(map[string]*CommandStat)}
+
+	s.countCommand("PRIVMSG", 20)
+	s.countCommand("PRIVMSG", 10)
+	s.countCommand("JOIN", 8)
+
+	if s.commandStats["PRIVMSG"].Count != 2 || s.commandStats["PRIVMSG"].Bytes != 30 {
+		t.Error("Bad PRIVMSG command count")
+	}
+
+	if s.commandStats["JOIN"].Count != 1 || s.commandStats["JOIN"].Bytes != 8 {
+		t.Error("Bad JOIN command count")
+	}
+}
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask, str string
+		match     bool
+	}{
+		{"*", "#anything", true},
+		{"#go*", "#gochat", true},
+		{"#go*", "#rust", false},
+		{"*chat", "#GoChat", true},
+		{"#g?chat", "#gochat", true},
+		{"#g?chat", "#goochat", false},
+		{"*!*@*.example", "nick!user@host.example", true},
+		{"*!*@*.example", "nick!user@host.example.com", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"", "", true},
+		{"", "a", false},
+	}
+
+	for _, test := range tests {
+		if matchMask(test.mask, test.str) != test.match {
+			t.Errorf("matchMask(%q, %q) should be %v", test.mask, test.str, test.match)
+		}
+	}
+}
+
+func TestISupport(t *testing.T) {
+	s := &ServerInfo{Network: "TestNet", MaxChannels: 20}
+
+	tokens := map[string]bool{}
+	for _, token := range iSupport(s) {
+		tokens[token] = true
+	}
+
+	for _, token := range []string{"CASEMAPPING=ascii", "NETWORK=TestNet", "CHANLIMIT=#&:20", "NICKLEN=16"} {
+		if !tokens[token] {
+			t.Errorf("Missing ISUPPORT token %s", token)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Added to a client's key to make Sec-WebSocket-Accept (RFC 6455)
+const WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// IRCv3 WebSocket subprotocols. Each WebSocket message is one IRC line,
+// sent in text frames (as UTF-8) or binary frames.
+const (
+	WEBSOCKET_TEXT   = "text.ircv3.net"
+	WEBSOCKET_BINARY = "binary.ircv3.net"
+)
+
+// Biggest message accepted from a WebSocket client: a line with the most
+// tags a client may send, plus the rest of the line
+const WEBSOCKET_MAX_MESSAGE = MAX_CLIENT_TAGS_LEN + 512
+
+// Seconds a client has to finish the WebSocket handshake
+const WEBSOCKET_TIMEOUT = 10
+
+// WebSocket frame opcodes
+const (
+	WS_CONTINUATION = 0x0
+	WS_TEXT         = 0x1
+	WS_BINARY       = 0x2
+	WS_CLOSE        = 0x8
+	WS_PING         = 0x9
+	WS_PONG         = 0xa
+)
+
+// WebSocket close codes
+const (
+	WS_CLOSE_NORMAL   = 1000
+	WS_CLOSE_PROTOCOL = 1002
+	WS_CLOSE_TOO_BIG  = 1009
+)
+
+// A WebSocket connection which looks like a plain IRC connection: reads
+// give each message followed by CRLF, and each line written is sent as its
+// own message. Writes are locked, since pongs are sent while reading.
+type wsConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	binary  bool
+	pending []byte // part of a message not read yet
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Do the WebSocket handshake on a new connection. `origins` are masks of the
+// web pages allowed to connect. If there are none, any page may connect.
+func upgradeWebSocket(conn net.Conn, origins []string) (*wsConn, error) {
+	conn.SetDeadline(time.Now().Add(WEBSOCKET_TIMEOUT * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || !headerHas(req.Header, "Connection", "upgrade") ||
+		!headerHas(req.Header, "Upgrade", "websocket") || len(key) == 0 {
+		writeHTTPError(conn, http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket handshake")
+	}
+
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		conn.Write([]byte("HTTP/1.1 426 Upgrade Required" + CRLF + "Sec-WebSocket-Version: 13" + CRLF + CRLF))
+		return nil, errors.New("unsupported WebSocket version")
+	}
+
+	if origin := req.Header.Get("Origin"); !originAllowed(origin, origins) {
+		writeHTTPError(conn, http.StatusForbidden)
+		return nil, errors.New("origin not allowed: " + origin)
+	}
+
+	ws := &wsConn{Conn: conn, reader: reader}
+
+	// use the first subprotocol the client asks for which is supported
+	protocol := ""
+	for _, offered := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, name := range strings.Split(offered, ",") {
+			name = strings.TrimSpace(name)
+			if len(protocol) == 0 && (name == WEBSOCKET_TEXT || name == WEBSOCKET_BINARY) {
+				protocol = name
+			}
+		}
+	}
+	ws.binary = protocol == WEBSOCKET_BINARY
+
+	hash := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	response := "HTTP/1.1 101 Switching Protocols" + CRLF +
+		"Upgrade: websocket" + CRLF +
+		"Connection: Upgrade" + CRLF +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + CRLF
+	if len(protocol) > 0 {
+		response += "Sec-WebSocket-Protocol: " + protocol + CRLF
+	}
+
+	if _, err = conn.Write([]byte(response + CRLF)); err != nil {
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+// Check if a comma-separated header has a value, ignoring case
+func headerHas(header http.Header, name, value string) bool {
+	for _, line := range header.Values(name) {
+		for _, v := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func originAllowed(origin string, origins []string) bool {
+	if len(origins) == 0 {
+		return true
+	}
+
+	for _, mask := range origins {
+		if matchMask(mask, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeHTTPError(conn net.Conn, status int) {
+	conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + CRLF +
+		"Connection: close" + CRLF + CRLF))
+}
+
+// Read the next IRC line, as many bytes of it as fit in `b`
+func (ws *wsConn) Read(b []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		message, err := ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		ws.pending = append([]byte(strings.TrimRight(string(message), CRLF)), CRLF...)
+	}
+
+	n := copy(b, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+// Read frames until a whole data message has arrived, answering control
+// frames along the way
+func (ws *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := ws.readFrame(WEBSOCKET_MAX_MESSAGE - len(message))
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case WS_PING:
+			ws.writeFrame(WS_PONG, payload)
+			continue
+		case WS_PONG:
+			continue
+		case WS_CLOSE:
+			ws.writeFrame(WS_CLOSE, payload)
+			return nil, io.EOF
+		case WS_TEXT, WS_BINARY:
+			if started {
+				return nil, ws.fail(WS_CLOSE_PROTOCOL, "new message before the last one finished")
+			}
+			started = true
+		case WS_CONTINUATION:
+			if !started {
+				return nil, ws.fail(WS_CLOSE_PROTOCOL, "continuation without a message")
+			}
+		default:
+			return nil, ws.fail(WS_CLOSE_PROTOCOL, "unknown opcode")
+		}
+
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// Read a single frame with a payload of at most `limit` bytes. Frames from
+// clients must be masked.
+func (ws *wsConn) readFrame(limit int) (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin, opcode := header[0]&0x80 != 0, header[0]&0xf
+	masked, length := header[1]&0x80 != 0, uint64(header[1]&0x7f)
+
+	if header[0]&0x70 != 0 || !masked {
+		return false, 0, nil, ws.fail(WS_CLOSE_PROTOCOL, "bad frame header")
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(ws.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(ws.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if opcode >= WS_CLOSE && (!fin || length > 125) {
+		return false, 0, nil, ws.fail(WS_CLOSE_PROTOCOL, "bad control frame")
+	} else if opcode < WS_CLOSE && length > uint64(limit) {
+		return false, 0, nil, ws.fail(WS_CLOSE_TOO_BIG, "message too big")
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Send each line in `b` as its own message
+func (ws *wsConn) Write(b []byte) (int, error) {
+	opcode := byte(WS_TEXT)
+	if ws.binary {
+		opcode = WS_BINARY
+	}
+
+	for _, line := range strings.Split(string(b), CRLF) {
+		if len(line) == 0 {
+			continue
+		}
+
+		// text frames have to be valid UTF-8
+		if !ws.binary {
+			line = strings.ToValidUTF8(line, "�")
+		}
+
+		if err := ws.writeFrame(opcode, []byte(line)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Send a single unmasked frame
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		return net.ErrClosed
+	}
+
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	_, err := ws.Conn.Write(append(frame, payload...))
+	if opcode == WS_CLOSE {
+		ws.closed = true
+	}
+	return err
+}
+
+// Close the connection with a close code, for a client breaking the protocol
+func (ws *wsConn) fail(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	ws.writeFrame(WS_CLOSE, append(payload, reason...))
+	return errors.New("WebSocket error: " + reason)
+}
+
+// Say goodbye properly before closing the connection. The event handler
+// closes connections, so the close frame is sent in the background rather
+// than waiting on a slow client.
+func (ws *wsConn) Close() error {
+	go func() {
+		// also cuts short a write the writer goroutine is stuck in
+		ws.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		ws.writeFrame(WS_CLOSE, binary.BigEndian.AppendUint16(nil, WS_CLOSE_NORMAL))
+		ws.Conn.Close()
+	}()
+
+	return nil
+}
@@ -0,0 +1,180 @@
+/*
+gochat -- A light and speedy IRC server.
+Copyright (C) 2015 Cameron Conn <cam_at_camconn_dot_cc>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Do a WebSocket handshake over a pipe. Returns the server's end, and the
+// client's end with the response it got.
+func testHandshake(t *testing.T, headers string, origins []string) (*wsConn, net.Conn, *http.Response, error) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close(); client.Close() })
+
+	type result struct {
+		ws  *wsConn
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		ws, err := upgradeWebSocket(server, origins)
+		done <- result{ws, err}
+	}()
+
+	go client.Write([]byte("GET / HTTP/1.1\r\nHost: irc.example.com\r\nUpgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" + headers + "\r\n"))
+
+	response, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-done
+	return r.ws, client, response, r.err
+}
+
+// Send a masked frame from the client's end
+func writeClientFrame(conn net.Conn, opcode byte, payload string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+// Read an unmasked frame at the client's end
+func readServerFrame(t *testing.T, conn net.Conn) (byte, string) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0xf, string(payload)
+}
+
+func TestWebSocket(t *testing.T) {
+	ws, client, response, err := testHandshake(t,
+		"Origin: https://chat.example.com\r\nSec-WebSocket-Protocol: foo, binary.ircv3.net, text.ircv3.net\r\n",
+		[]string{"https://*.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols ||
+		response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Bad handshake response: %v", response)
+	}
+	if response.Header.Get("Sec-WebSocket-Protocol") != WEBSOCKET_BINARY || !ws.binary {
+		t.Error("The first supported subprotocol wasn't picked")
+	}
+
+	// each message is read as a line, and pings are answered along the way
+	go func() {
+		writeClientFrame(client, WS_PING, "hello")
+		writeClientFrame(client, WS_TEXT, "NICK camconn")
+	}()
+
+	lines := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(ws).ReadString('\n')
+		lines <- line
+	}()
+
+	if opcode, payload := readServerFrame(t, client); opcode != WS_PONG || payload != "hello" {
+		t.Errorf("Ping was answered with %x %q", opcode, payload)
+	}
+	if line := <-lines; line != "NICK camconn\r\n" {
+		t.Errorf("Read %q, not the message sent", line)
+	}
+
+	go ws.Write([]byte(":irc.example.com 001 camconn :Welcome\r\n"))
+	if opcode, payload := readServerFrame(t, client); opcode != WS_BINARY || payload != ":irc.example.com 001 camconn :Welcome" {
+		t.Errorf("Wrote %x %q", opcode, payload)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	_, _, response, err := testHandshake(t, "Origin: https://evil.example.net\r\n", []string{"https://*.example.com"})
+	if err == nil || response.StatusCode != http.StatusForbidden {
+		t.Error("Connection from another origin was allowed")
+	}
+
+	ws, _, response, err := testHandshake(t, "Origin: https://evil.example.net\r\n", nil)
+	if err != nil || response.StatusCode != http.StatusSwitchingProtocols || ws.binary {
+		t.Error("Connection wasn't allowed without an origin list")
+	}
+	if response.Header.Get("Sec-WebSocket-Protocol") != "" {
+		t.Error("Picked a subprotocol the client didn't ask for")
+	}
+}
+
+func TestWebSocketUnmasked(t *testing.T) {
+	ws, client, _, err := testHandshake(t, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go client.Write([]byte{0x80 | WS_TEXT, 4, 'P', 'I', 'N', 'G'})
+	go io.Copy(io.Discard, client)
+
+	if _, err = ws.Read(make([]byte, 64)); err == nil || !strings.Contains(err.Error(), "bad frame header") {
+		t.Error("Accepted an unmasked frame:", err)
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	ws, client, _, err := testHandshake(t, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing reads the client's end yet, which mustn't hold up Close
+	closed := make(chan struct{})
+	go func() {
+		ws.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Close waited for the client to read the close frame")
+	}
+
+	if opcode, _ := readServerFrame(t, client); opcode != WS_CLOSE {
+		t.Errorf("Sent opcode %x instead of a close frame", opcode)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection wasn't closed: %v", err)
+	}
+}